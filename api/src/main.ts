@@ -8,6 +8,7 @@ import cardRoutes from './routes/cards';
 import visitRoutes from './routes/visits';
 import claimRoutes from './routes/claims';
 import referralRoutes from './routes/referrals';
+import practitionerRoutes from './routes/practitioners';
 import dashboardRoutes from './routes/dashboard';
 
 dotenv.config();
@@ -41,6 +42,7 @@ app.use('/api/cards', cardRoutes);
 app.use('/api/visits', visitRoutes);
 app.use('/api/claims', claimRoutes);
 app.use('/api/referrals', referralRoutes);
+app.use('/api/practitioners', practitionerRoutes);
 app.use('/api/dashboard', dashboardRoutes);
 
 // Error handling
@@ -36,7 +36,7 @@ router.post('/issue', async (req: Request, res: Response): Promise<void> => {
       dateOfBirth || '',
       gender || '',
       address || '',
-      cardType || 'PBI',
+      cardType || 'PBPU',
       issueDate || new Date().toISOString().split('T')[0],
       expiryDate || new Date(Date.now() + 365 * 24 * 60 * 60 * 1000).toISOString().split('T')[0]
     ]);
@@ -93,16 +93,17 @@ router.get('/:cardID', async (req: Request, res: Response) => {
 router.put('/:cardID/status', async (req: Request, res: Response): Promise<void> => {
   try {
     const { cardID } = req.params;
-    const { status, reason } = req.body;
+    const { status, reasonCode, reason } = req.body;
 
-    if (!status) {
-      res.status(400).json({ error: 'Status is required' });
+    if (!status || !reasonCode) {
+      res.status(400).json({ error: 'Status and reasonCode are required' });
       return;
     }
 
     await blockchainService.invoke('UpdateCardStatus', [
       cardID,
       status,
+      reasonCode,
       reason || 'Status updated via API'
     ]);
 
@@ -15,13 +15,15 @@ router.post('/', async (req: Request, res: Response): Promise<void> => {
       cardID,
       visitID,
       faskesCode,
-      faskesName,
       claimType,
       serviceDate,
       diagnosis,
       treatment,
       totalAmount,
-      claimAmount
+      claimAmount,
+      roomClass,
+      primaryDiagnosisCode,
+      secondaryDiagnosisCodes
     } = req.body;
 
     if (!claimID || !patientID || !cardID || !visitID) {
@@ -36,13 +38,15 @@ router.post('/', async (req: Request, res: Response): Promise<void> => {
       cardID,
       visitID,
       faskesCode || '',
-      faskesName || '',
       claimType || 'rawat-jalan',
       serviceDate || new Date().toISOString().split('T')[0],
       diagnosis || '',
       treatment || '',
       totalAmount?.toString() || '0',
-      claimAmount?.toString() || '0'
+      claimAmount?.toString() || '0',
+      roomClass || '',
+      primaryDiagnosisCode || '',
+      Array.isArray(secondaryDiagnosisCodes) ? secondaryDiagnosisCodes.join(',') : secondaryDiagnosisCodes || ''
     ]);
 
     res.status(201).json({
@@ -103,4 +107,22 @@ router.get('/patient/:patientID', async (req: Request, res: Response) => {
   }
 });
 
+// Get claims billing an ICD-9-CM procedure
+router.get('/procedure/:procedureCode', async (req: Request, res: Response) => {
+  try {
+    const { procedureCode } = req.params;
+
+    const result = await blockchainService.query('GetClaimsByProcedure', [procedureCode]);
+
+    res.json({
+      success: true,
+      claims: Array.isArray(result) ? result : []
+    });
+
+  } catch (error: any) {
+    logger.error('Error getting claims by procedure:', error);
+    res.status(500).json({ error: error.message });
+  }
+});
+
 export default router;
@@ -113,7 +113,7 @@ router.get('/patient/:patientID', async (req: Request, res: Response): Promise<v
     
     // Fetch patient data in parallel
     const [visits, claims] = await Promise.all([
-      blockchainService.query('GetPatientVisits', [patientID]).catch(() => []),
+      blockchainService.query('GetPatientVisits', [patientID, 'false']).catch(() => []),
       blockchainService.query('GetPatientClaims', [patientID]).catch(() => [])
     ]);
 
@@ -0,0 +1,44 @@
+import { Router, Request, Response } from 'express';
+import { blockchainService } from '../fabric/blockchain.service';
+import { createLogger } from '../utils/logger';
+
+const router = Router();
+const logger = createLogger('PractitionersRoute');
+
+// Get a registered practitioner with their practice licenses
+router.get('/:practitionerID', async (req: Request, res: Response) => {
+  try {
+    const { practitionerID } = req.params;
+
+    const result = await blockchainService.query('GetPractitioner', [practitionerID]);
+
+    res.json({
+      success: true,
+      practitioner: result
+    });
+
+  } catch (error: any) {
+    logger.error('Error getting practitioner:', error);
+    res.status(500).json({ error: error.message });
+  }
+});
+
+// Get the visits and referrals of a practitioner across facilities
+router.get('/:practitionerID/activity', async (req: Request, res: Response) => {
+  try {
+    const { practitionerID } = req.params;
+
+    const result = await blockchainService.query('GetPractitionerActivity', [practitionerID]);
+
+    res.json({
+      success: true,
+      activity: result
+    });
+
+  } catch (error: any) {
+    logger.error('Error getting practitioner activity:', error);
+    res.status(500).json({ error: error.message });
+  }
+});
+
+export default router;
@@ -14,9 +14,7 @@ router.post('/', async (req: Request, res: Response): Promise<void> => {
       patientName,
       cardID,
       fromFaskesCode,
-      fromFaskesName,
       toFaskesCode,
-      toFaskesName,
       referralReason,
       diagnosis,
       referringDoctor,
@@ -36,9 +34,7 @@ router.post('/', async (req: Request, res: Response): Promise<void> => {
       patientName || '',
       cardID,
       fromFaskesCode || '',
-      fromFaskesName || '',
       toFaskesCode || '',
-      toFaskesName || '',
       referralReason || '',
       diagnosis || '',
       referringDoctor || '',
@@ -63,7 +59,7 @@ router.post('/', async (req: Request, res: Response): Promise<void> => {
 router.put('/:referralID/status', async (req: Request, res: Response): Promise<void> => {
   try {
     const { referralID } = req.params;
-    const { status, acceptedBy, notes } = req.body;
+    const { status, notes } = req.body;
 
     if (!status) {
       res.status(400).json({ error: 'Status is required' });
@@ -73,7 +69,6 @@ router.put('/:referralID/status', async (req: Request, res: Response): Promise<v
     await blockchainService.invoke('UpdateReferralStatus', [
       referralID,
       status,
-      acceptedBy || '',
       notes || ''
     ]);
 
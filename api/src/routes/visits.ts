@@ -14,15 +14,16 @@ router.post('/', async (req: Request, res: Response) => {
       patientID,
       patientName,
       faskesCode,
-      faskesName,
-      faskesType,
       visitDate,
       visitType,
       diagnosis,
       treatment,
-      doctorName,
       doctorID,
-      notes
+      notes,
+      primaryDiagnosisCode,
+      secondaryDiagnosisCodes,
+      procedures,
+      referralID
     } = req.body;
 
     if (!visitID || !cardID || !patientID) {
@@ -35,15 +36,16 @@ router.post('/', async (req: Request, res: Response) => {
       patientID,
       patientName || '',
       faskesCode || '',
-      faskesName || '',
-      faskesType || 'rumahsakit',
       visitDate || new Date().toISOString().split('T')[0],
       visitType || 'outpatient',
       diagnosis || '',
       treatment || '',
-      doctorName || '',
       doctorID || '',
-      notes || ''
+      notes || '',
+      primaryDiagnosisCode || '',
+      Array.isArray(secondaryDiagnosisCodes) ? secondaryDiagnosisCodes.join(',') : secondaryDiagnosisCodes || '',
+      procedures ? JSON.stringify(procedures) : '',
+      referralID || ''
     ]);
 
     return res.status(201).json({
@@ -58,12 +60,13 @@ router.post('/', async (req: Request, res: Response) => {
   }
 });
 
-// Get visits for a patient
+// Get visits for a patient, with addenda applied unless ?original=true
 router.get('/patient/:patientID', async (req: Request, res: Response) => {
   try {
     const { patientID } = req.params;
+    const showOriginal = req.query.original === 'true';
 
-    const result = await blockchainService.query('GetPatientVisits', [patientID]);
+    const result = await blockchainService.query('GetPatientVisits', [patientID, String(showOriginal)]);
 
     res.json({
       success: true,
@@ -76,4 +79,32 @@ router.get('/patient/:patientID', async (req: Request, res: Response) => {
   }
 });
 
+// Append a correction or clarification to a visit
+router.post('/:visitID/addenda', async (req: Request, res: Response) => {
+  try {
+    const { visitID } = req.params;
+    const { reason, changes } = req.body;
+
+    if (!reason) {
+      return res.status(400).json({ error: 'Missing required fields' });
+    }
+
+    await blockchainService.invoke('AddVisitAddendum', [
+      visitID,
+      reason,
+      changes ? JSON.stringify(changes) : ''
+    ]);
+
+    return res.status(201).json({
+      success: true,
+      message: 'Visit addendum added successfully',
+      visitID
+    });
+
+  } catch (error: any) {
+    logger.error('Error adding visit addendum:', error);
+    return res.status(500).json({ error: error.message });
+  }
+});
+
 export default router;
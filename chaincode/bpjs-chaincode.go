@@ -4,8 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/bpjs-blockchain/chaincode/eligibility"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
@@ -14,6 +19,24 @@ type BPJSSmartContract struct {
 	contractapi.Contract
 }
 
+// TransactionContext is the context of one transaction. It numbers the audit entries
+// written by the transaction so their keys stay unique.
+type TransactionContext struct {
+	contractapi.TransactionContext
+	auditSequence int
+}
+
+// nextAuditSequence returns the sequence number of the next audit entry of the transaction
+func (c *TransactionContext) nextAuditSequence() int {
+	c.auditSequence++
+	return c.auditSequence
+}
+
+// auditSequencer is implemented by transaction contexts that number audit entries
+type auditSequencer interface {
+	nextAuditSequence() int
+}
+
 // ===== HELPER FUNCTIONS =====
 
 // getTxTimestamp returns the transaction timestamp (deterministic across all peers)
@@ -25,6 +48,83 @@ func getTxTimestamp(ctx contractapi.TransactionContextInterface) time.Time {
 	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos))
 }
 
+// parseDate parses a YYYY-MM-DD date as used throughout the ledger
+func parseDate(value string) (time.Time, error) {
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", value)
+	}
+	return date, nil
+}
+
+// World state key prefixes. Every entity type has its own key namespace, so an ID
+// of one type can never overwrite an entity of another type.
+const (
+	cardKeyPrefix         = "CARD_"
+	visitKeyPrefix        = "VISIT_"
+	referralKeyPrefix     = "REFERRAL_"
+	claimKeyPrefix        = "CLAIM_"
+	prescriptionKeyPrefix = "PRESCRIPTION_"
+	faskesKeyPrefix       = "FASKES_"
+	practitionerKeyPrefix = "PRACTITIONER_"
+	documentKeyPrefix     = "DOCUMENT_"
+)
+
+// cardKey returns the world state key of a card
+func cardKey(cardID string) string {
+	return cardKeyPrefix + cardID
+}
+
+// visitKey returns the world state key of a visit
+func visitKey(visitID string) string {
+	return visitKeyPrefix + visitID
+}
+
+// referralKey returns the world state key of a referral
+func referralKey(referralID string) string {
+	return referralKeyPrefix + referralID
+}
+
+// claimKey returns the world state key of a claim
+func claimKey(claimID string) string {
+	return claimKeyPrefix + claimID
+}
+
+// prescriptionKey returns the world state key of a prescription
+func prescriptionKey(prescriptionID string) string {
+	return prescriptionKeyPrefix + prescriptionID
+}
+
+// faskesKey returns the world state key of a healthcare facility
+func faskesKey(faskesCode string) string {
+	return faskesKeyPrefix + faskesCode
+}
+
+// practitionerKey returns the world state key of a practitioner
+func practitionerKey(practitionerID string) string {
+	return practitionerKeyPrefix + practitionerID
+}
+
+// documentKey returns the world state key of a document anchor
+func documentKey(documentID string) string {
+	return documentKeyPrefix + documentID
+}
+
+// ensureKeyUnused rejects creating an entity whose key is already in use
+func ensureKeyUnused(ctx contractapi.TransactionContextInterface, key string, entityType string, id string) error {
+	if id == "" {
+		return fmt.Errorf("%s ID is required", entityType)
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("%s %s already exists", entityType, id)
+	}
+	return nil
+}
+
 // ===== DATA STRUCTURES =====
 
 // BPJSCard represents digital BPJS card
@@ -36,12 +136,45 @@ type BPJSCard struct {
 	DateOfBirth string    `json:"dateOfBirth"`
 	Gender      string    `json:"gender"`
 	Address     string    `json:"address"`
-	Status      string    `json:"status"`   // active, inactive, suspended
-	CardType    string    `json:"cardType"` // PBI, Non-PBI
+	Status      string    `json:"status"`               // active, inactive, suspended, expired, deceased, replaced
+	StatusCode  string    `json:"statusCode,omitempty"` // reason code of the last status change
+	CardType    string    `json:"cardType"`             // participant segment: PBI-APBN, PBI-APBD, PPU, PBPU, BP; PBI or Non-PBI on older cards
 	IssueDate   string    `json:"issueDate"`
 	ExpiryDate  string    `json:"expiryDate"`
+	ValidFrom   string    `json:"validFrom,omitempty"` // start of current validity period, issueDate if never renewed
 	IssuedBy    string    `json:"issuedBy"`
+	Replaces    string    `json:"replaces,omitempty"`   // card this card replaced
+	ReplacedBy  string    `json:"replacedBy,omitempty"` // card that replaced this card
 	Timestamp   time.Time `json:"timestamp"`
+
+	FundingSource        string `json:"fundingSource,omitempty"`
+	RegionCode           string `json:"regionCode,omitempty"`
+	SegmentEffectiveDate string `json:"segmentEffectiveDate,omitempty"`
+	CareClass            string `json:"careClass,omitempty"`       // 1, 2, 3
+	CareClassSince       string `json:"careClassSince,omitempty"`  // date the current care class started
+	PrimaryFacility      string `json:"primaryFacility,omitempty"` // faskes code of the registered FKTP
+	PrimaryFacilitySince string `json:"primaryFacilitySince,omitempty"`
+	DateOfDeath          string `json:"dateOfDeath,omitempty"`
+
+	ValidityHistory []ValidityPeriod `json:"validityHistory,omitempty"`
+	SegmentHistory  []SegmentChange  `json:"segmentHistory,omitempty"`
+}
+
+// SegmentChange records a move between participant segments
+type SegmentChange struct {
+	FromSegment   string `json:"fromSegment"`
+	ToSegment     string `json:"toSegment"`
+	EffectiveDate string `json:"effectiveDate"`
+	Reason        string `json:"reason"`
+	ChangedBy     string `json:"changedBy"`
+}
+
+// ValidityPeriod is a previous validity period of a renewed card
+type ValidityPeriod struct {
+	ValidFrom  string `json:"validFrom"`
+	ValidUntil string `json:"validUntil"`
+	RenewedBy  string `json:"renewedBy"`
+	RenewedOn  string `json:"renewedOn"`
 }
 
 // Visit represents patient visit to healthcare facility
@@ -52,16 +185,160 @@ type Visit struct {
 	PatientName string    `json:"patientName"`
 	FaskesCode  string    `json:"faskesCode"`
 	FaskesName  string    `json:"faskesName"`
-	FaskesType  string    `json:"faskesType"` // puskesmas, rumahsakit
+	FaskesType  string    `json:"faskesType"` // FKTP, FKRTL, from the faskes registry
 	VisitDate   string    `json:"visitDate"`
 	VisitType   string    `json:"visitType"` // outpatient, inpatient, emergency
-	Diagnosis   string    `json:"diagnosis"`
+	Diagnosis   string    `json:"diagnosis"` // clinical note, coded in the ICD-10 fields
 	Treatment   string    `json:"treatment"`
 	DoctorName  string    `json:"doctorName"`
 	DoctorID    string    `json:"doctorID"`
 	Notes       string    `json:"notes"`
 	RecordedBy  string    `json:"recordedBy"`
 	Timestamp   time.Time `json:"timestamp"`
+
+	PrimaryDiagnosisCode    string   `json:"primaryDiagnosisCode,omitempty"` // ICD-10
+	SecondaryDiagnosisCodes []string `json:"secondaryDiagnosisCodes,omitempty"`
+	ICD10Version            string   `json:"icd10Version,omitempty"` // code set version the codes were validated against
+
+	Procedures    []ProcedureEntry `json:"procedures,omitempty"`
+	ICD9CMVersion string           `json:"icd9cmVersion,omitempty"`
+
+	Episode *InpatientEpisode `json:"episode,omitempty"` // inpatient stay, set by AdmitPatient
+
+	ReferralID string `json:"referralID,omitempty"` // referral consumed by an FKRTL visit
+
+	Addenda []VisitAddendum `json:"addenda,omitempty"` // corrections, the fields above keep the original record
+}
+
+// VisitAddendum is a correction or clarification appended to a visit
+type VisitAddendum struct {
+	Sequence  int           `json:"sequence"`
+	Author    string        `json:"author"`
+	AuthorMSP string        `json:"authorMSP"`
+	Reason    string        `json:"reason"`
+	Changes   []FieldChange `json:"changes"` // empty for a clarification
+	TxID      string        `json:"txID"`
+	Timestamp time.Time     `json:"timestamp"`
+}
+
+// ProcedureEntry is a coded procedure performed during a visit
+type ProcedureEntry struct {
+	Code           string `json:"code"` // ICD-9-CM
+	Description    string `json:"description"`
+	Quantity       int    `json:"quantity"`
+	Date           string `json:"date"`
+	PractitionerID string `json:"practitionerID"` // performing practitioner
+}
+
+// InpatientEpisode is the hospital stay of an inpatient visit
+type InpatientEpisode struct {
+	Status          string     `json:"status"` // admitted, discharged
+	AdmissionDate   string     `json:"admissionDate"`
+	Ward            string     `json:"ward"`
+	Room            string     `json:"room"`
+	DischargeDate   string     `json:"dischargeDate,omitempty"`
+	DischargeStatus string     `json:"dischargeStatus,omitempty"` // home, referred, deceased, against-advice
+	LengthOfStay    int        `json:"lengthOfStay,omitempty"`    // days, counted as INA-CBG does
+	DischargeNotes  string     `json:"dischargeNotes,omitempty"`
+	WardStays       []WardStay `json:"wardStays"`
+}
+
+// WardStay is the time an inpatient spent in one ward and room
+type WardStay struct {
+	Ward     string `json:"ward"`
+	Room     string `json:"room"`
+	FromDate string `json:"fromDate"`
+	ToDate   string `json:"toDate,omitempty"`
+}
+
+// Prescription is the medication a doctor prescribed during a visit
+type Prescription struct {
+	PrescriptionID   string             `json:"prescriptionID"`
+	VisitID          string             `json:"visitID"`
+	CardID           string             `json:"cardID"`
+	PatientID        string             `json:"patientID"`
+	PatientName      string             `json:"patientName"`
+	FaskesCode       string             `json:"faskesCode"`
+	PrescriberID     string             `json:"prescriberID"`
+	PrescriptionDate string             `json:"prescriptionDate"`
+	Items            []PrescriptionItem `json:"items"`
+	Status           string             `json:"status"` // prescribed, partially-dispensed, dispensed
+	Dispensings      []Dispensing       `json:"dispensings"`
+	CreatedBy        string             `json:"createdBy"`
+	Timestamp        time.Time          `json:"timestamp"`
+}
+
+// PrescriptionItem is one drug line of a prescription
+type PrescriptionItem struct {
+	DrugCode          string `json:"drugCode"`
+	DrugName          string `json:"drugName"`
+	Dose              string `json:"dose"` // e.g. 500 mg 3x1
+	Quantity          int    `json:"quantity"`
+	DaysSupply        int    `json:"daysSupply"`
+	DispensedQuantity int    `json:"dispensedQuantity"`
+}
+
+// Dispensing is one hand-over of medication by a pharmacy
+type Dispensing struct {
+	PharmacyCode string          `json:"pharmacyCode"`
+	DispenseDate string          `json:"dispenseDate"`
+	Items        []DispensedItem `json:"items"`
+	DispensedBy  string          `json:"dispensedBy"`
+}
+
+// DispensedItem is the quantity of a drug handed over in one dispensing
+type DispensedItem struct {
+	DrugCode string `json:"drugCode"`
+	Quantity int    `json:"quantity"`
+}
+
+// Faskes is a healthcare facility contracted by BPJS
+type Faskes struct {
+	FaskesCode    string    `json:"faskesCode"`
+	Name          string    `json:"name"`
+	Type          string    `json:"type"`                    // FKTP, FKRTL
+	HospitalClass string    `json:"hospitalClass,omitempty"` // A, B, C, D, FKRTL only
+	RegionCode    string    `json:"regionCode"`              // province and regency code, as in the NIK
+	OwnerMSP      string    `json:"ownerMSP"`                // organization that transacts for the facility
+	ContractStart string    `json:"contractStart"`
+	ContractEnd   string    `json:"contractEnd"`
+	RegisteredBy  string    `json:"registeredBy"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// Practitioner is a health professional registered with the medical council (STR) and
+// licensed to practise at one or more facilities (SIP)
+type Practitioner struct {
+	PractitionerID string            `json:"practitionerID"`
+	Name           string            `json:"name"`
+	Specialty      string            `json:"specialty"`
+	STRNumber      string            `json:"strNumber"`
+	STRValidUntil  string            `json:"strValidUntil,omitempty"` // empty for a lifetime registration
+	Licenses       []PracticeLicense `json:"licenses"`
+	RegisteredBy   string            `json:"registeredBy"`
+	Timestamp      time.Time         `json:"timestamp"`
+}
+
+// PracticeLicense is a practice license (SIP) of a practitioner at one facility
+type PracticeLicense struct {
+	SIPNumber  string `json:"sipNumber"`
+	FaskesCode string `json:"faskesCode"`
+	ValidFrom  string `json:"validFrom"`
+	ValidUntil string `json:"validUntil"`
+}
+
+// PractitionerActivity lists the visits and referrals of a practitioner across facilities
+type PractitionerActivity struct {
+	PractitionerID string      `json:"practitionerID"`
+	Visits         []*Visit    `json:"visits"`
+	Referrals      []*Referral `json:"referrals"`
+}
+
+// PractitionerIndexBackfill reports a BackfillPractitionerIndexes run
+type PractitionerIndexBackfill struct {
+	Visits    []string `json:"visits"`    // visits added to their doctor's index
+	Referrals []string `json:"referrals"` // referrals added to their referring doctor's index
+	Remaining bool     `json:"remaining"` // more entries are left for another run
 }
 
 // Referral represents patient referral between healthcare facilities
@@ -76,13 +353,14 @@ type Referral struct {
 	ToFaskesName    string    `json:"toFaskesName"`
 	ReferralReason  string    `json:"referralReason"`
 	Diagnosis       string    `json:"diagnosis"`
-	ReferringDoctor string    `json:"referringDoctor"`
+	ReferringDoctor string    `json:"referringDoctor"` // practitioner ID
 	ReferralDate    string    `json:"referralDate"`
 	ValidUntil      string    `json:"validUntil"`
-	Status          string    `json:"status"` // pending, accepted, completed, expired
+	Status          string    `json:"status"` // pending, accepted, completed, expired, cancelled
 	AcceptedBy      string    `json:"acceptedBy"`
 	AcceptedDate    string    `json:"acceptedDate"`
 	Notes           string    `json:"notes"`
+	VisitID         string    `json:"visitID,omitempty"` // visit the referral was used for
 	CreatedBy       string    `json:"createdBy"`
 	Timestamp       time.Time `json:"timestamp"`
 }
@@ -96,9 +374,9 @@ type Claim struct {
 	VisitID     string    `json:"visitID"`
 	FaskesCode  string    `json:"faskesCode"`
 	FaskesName  string    `json:"faskesName"`
-	ClaimType   string    `json:"claimType"` // rawat-jalan, rawat-inap, emergency
+	ClaimType   string    `json:"claimType"` // rawat-jalan, rawat-inap, emergency, obat-kronis
 	ServiceDate string    `json:"serviceDate"`
-	Diagnosis   string    `json:"diagnosis"`
+	Diagnosis   string    `json:"diagnosis"` // clinical note, coded in the ICD-10 fields
 	Treatment   string    `json:"treatment"`
 	TotalAmount float64   `json:"totalAmount"`
 	ClaimAmount float64   `json:"claimAmount"`
@@ -110,6 +388,46 @@ type Claim struct {
 	ReviewNotes string    `json:"reviewNotes"`
 	PaymentDate string    `json:"paymentDate"`
 	Timestamp   time.Time `json:"timestamp"`
+
+	RoomClass     string  `json:"roomClass,omitempty"`     // care class of the room used, inpatient only
+	EntitledClass string  `json:"entitledClass,omitempty"` // member's care class at submission
+	CoPayment     float64 `json:"coPayment"`               // iur biaya paid by the patient for a class upgrade
+
+	LengthOfStay int `json:"lengthOfStay,omitempty"` // days of the discharged inpatient episode
+
+	PrimaryDiagnosisCode    string   `json:"primaryDiagnosisCode,omitempty"` // ICD-10
+	SecondaryDiagnosisCodes []string `json:"secondaryDiagnosisCodes,omitempty"`
+	ICD10Version            string   `json:"icd10Version,omitempty"`
+
+	Procedures    []ProcedureEntry `json:"procedures,omitempty"` // copied from the visit
+	ICD9CMVersion string           `json:"icd9cmVersion,omitempty"`
+
+	PrescriptionIDs []string `json:"prescriptionIDs,omitempty"` // prescriptions of the visit
+
+	Flagged    bool   `json:"flagged,omitempty"` // held back from approval until reviewed
+	FlagReason string `json:"flagReason,omitempty"`
+}
+
+// DocumentAnchor is the tamper evidence of an off-chain clinical document. The document
+// itself stays with the facility; only its hash is on the ledger.
+type DocumentAnchor struct {
+	DocumentID string    `json:"documentID"`
+	SHA256     string    `json:"sha256"` // lowercase hex
+	MediaType  string    `json:"mediaType"`
+	Size       int64     `json:"size"` // bytes
+	VisitID    string    `json:"visitID,omitempty"`
+	ClaimID    string    `json:"claimID,omitempty"`
+	Author     string    `json:"author"`
+	AuthorMSP  string    `json:"authorMSP"`
+	TxID       string    `json:"txID"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// DocumentVerification is the result of checking a presented document against its anchor
+type DocumentVerification struct {
+	DocumentID string          `json:"documentID"`
+	Match      bool            `json:"match"`
+	Anchor     *DocumentAnchor `json:"anchor"`
 }
 
 // AuditLog represents audit trail entry
@@ -122,35 +440,346 @@ type AuditLog struct {
 	ActorRole   string    `json:"actorRole"`
 	OrgID       string    `json:"orgID"`
 	Description string    `json:"description"`
+	OldState    string    `json:"oldState,omitempty"`
+	NewState    string    `json:"newState,omitempty"`
+	ReasonCode  string    `json:"reasonCode,omitempty"`
 	IPAddress   string    `json:"ipAddress"`
 	Timestamp   time.Time `json:"timestamp"`
+
+	Changes []FieldChange `json:"changes,omitempty"`
 }
 
-// ===== CARD MANAGEMENT FUNCTIONS =====
+// FieldChange records the before and after value of a changed field
+type FieldChange struct {
+	Field    string `json:"field"`
+	OldValue string `json:"oldValue"`
+	NewValue string `json:"newValue"`
+}
 
-// IssueCard creates a new BPJS card
-func (s *BPJSSmartContract) IssueCard(ctx contractapi.TransactionContextInterface,
-	cardID string, patientID string, patientName string, nik string,
-	dateOfBirth string, gender string, address string, cardType string,
-	issueDate string, expiryDate string) error {
+// HistoryEntry is one version of a world state key from the ledger history
+type HistoryEntry struct {
+	TxID      string        `json:"txID"`
+	Timestamp time.Time     `json:"timestamp"`
+	IsDelete  bool          `json:"isDelete"`
+	State     string        `json:"state"`   // JSON of the entity at this version, empty when deleted
+	Changes   []FieldChange `json:"changes"` // fields changed since the previous version
+}
 
-	// Check if card already exists
-	existing, err := ctx.GetStub().GetState(cardID)
-	if err != nil {
-		return fmt.Errorf("failed to read from world state: %v", err)
+// CodeSetVersion is one version of a reference code set such as ICD-10
+type CodeSetVersion struct {
+	System        string    `json:"system"` // ICD10
+	Version       string    `json:"version"`
+	Status        string    `json:"status"` // draft, active, retired
+	CodeCount     int       `json:"codeCount"`
+	LoadedBy      string    `json:"loadedBy"`
+	ActivatedBy   string    `json:"activatedBy,omitempty"`
+	ActivatedDate string    `json:"activatedDate,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// ReferenceCode is a code in a reference code set
+type ReferenceCode struct {
+	System      string `json:"system"`
+	Version     string `json:"version"`
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+// FamilyGroup represents a household (Kartu Keluarga) sharing one JKN membership
+type FamilyGroup struct {
+	KKNumber           string         `json:"kkNumber"`
+	HeadCardID         string         `json:"headCardID"`
+	Members            []FamilyMember `json:"members"`
+	ContributionStatus string         `json:"contributionStatus"` // current, arrears
+	CreatedBy          string         `json:"createdBy"`
+	Timestamp          time.Time      `json:"timestamp"`
+}
+
+// FamilyMember represents a card linked to a family group
+type FamilyMember struct {
+	CardID       string `json:"cardID"`
+	PatientID    string `json:"patientID"`
+	PatientName  string `json:"patientName"`
+	Relationship string `json:"relationship"` // head, spouse, child, parent
+	JoinedDate   string `json:"joinedDate"`
+}
+
+// ContributionPayment represents a member's monthly contribution (iuran) payment
+type ContributionPayment struct {
+	PaymentID      string    `json:"paymentID"`
+	CardID         string    `json:"cardID"`
+	PatientID      string    `json:"patientID"`
+	Period         string    `json:"period"` // YYYY-MM
+	Amount         float64   `json:"amount"`
+	PaymentDate    string    `json:"paymentDate"`
+	PaymentChannel string    `json:"paymentChannel"`
+	RecordedBy     string    `json:"recordedBy"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// ContributionArrears summarizes the unpaid contribution months of a card
+type ContributionArrears struct {
+	CardID           string   `json:"cardID"`
+	AsOf             string   `json:"asOf"`
+	UnpaidMonths     []string `json:"unpaidMonths"`
+	UnpaidMonthCount int      `json:"unpaidMonthCount"`
+}
+
+// SubsidyQuota represents the number of government-funded (PBI) members a region may enrol
+type SubsidyQuota struct {
+	Segment       string    `json:"segment"` // PBI-APBN, PBI-APBD
+	RegionCode    string    `json:"regionCode"`
+	FundingSource string    `json:"fundingSource"`
+	Quota         int       `json:"quota"`
+	Used          int       `json:"used"`
+	UpdatedBy     string    `json:"updatedBy"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// CardSpec holds the IssueCard arguments of one card in a batch
+type CardSpec struct {
+	CardID      string `json:"cardID"`
+	PatientID   string `json:"patientID"`
+	PatientName string `json:"patientName"`
+	NIK         string `json:"nik"`
+	DateOfBirth string `json:"dateOfBirth"`
+	Gender      string `json:"gender"`
+	Address     string `json:"address"`
+	CardType    string `json:"cardType"`
+	IssueDate   string `json:"issueDate"`
+	ExpiryDate  string `json:"expiryDate"`
+}
+
+// Batch issuance modes
+const (
+	BatchModeAllOrNothing = "all-or-nothing"
+	BatchModeBestEffort   = "best-effort"
+)
+
+// BatchIssueResult reports the outcome of IssueCardsBatch
+type BatchIssueResult struct {
+	Mode      string            `json:"mode"`
+	Total     int               `json:"total"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Results   []BatchItemResult `json:"results"`
+}
+
+// BatchItemResult reports the outcome of one card in a batch
+type BatchItemResult struct {
+	Index   int    `json:"index"`
+	CardID  string `json:"cardID"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ===== CARD STATUS STATE MACHINE =====
+
+// Card statuses
+const (
+	CardStatusActive    = "active"
+	CardStatusInactive  = "inactive"
+	CardStatusSuspended = "suspended"
+	CardStatusExpired   = "expired"
+	CardStatusDeceased  = "deceased"
+	CardStatusReplaced  = "replaced"
+)
+
+// cardStatusTransitions lists, per current status, the statuses a card may move
+// to and the reason codes accepted for each move. Deceased and replaced cards are final.
+var cardStatusTransitions = map[string]map[string][]string{
+	CardStatusActive: {
+		CardStatusInactive:  {"MEMBERSHIP_TERMINATED", "DUPLICATE_MEMBERSHIP"},
+		CardStatusSuspended: {"CONTRIBUTION_ARREARS", "FRAUD_INVESTIGATION", "ADMINISTRATIVE_HOLD"},
+		CardStatusExpired:   {"VALIDITY_ENDED"},
+		CardStatusDeceased:  {"MEMBER_DECEASED"},
+		CardStatusReplaced:  {"CARD_LOST", "CARD_DAMAGED"},
+	},
+	CardStatusSuspended: {
+		CardStatusActive:   {"CONTRIBUTION_SETTLED", "INVESTIGATION_CLEARED", "HOLD_RELEASED"},
+		CardStatusInactive: {"MEMBERSHIP_TERMINATED", "DUPLICATE_MEMBERSHIP"},
+		CardStatusExpired:  {"VALIDITY_ENDED"},
+		CardStatusDeceased: {"MEMBER_DECEASED"},
+	},
+	CardStatusInactive: {
+		CardStatusActive:   {"MEMBERSHIP_REINSTATED"},
+		CardStatusDeceased: {"MEMBER_DECEASED"},
+	},
+	CardStatusExpired: {
+		CardStatusActive:   {"CARD_RENEWED"},
+		CardStatusInactive: {"MEMBERSHIP_TERMINATED"},
+		CardStatusDeceased: {"MEMBER_DECEASED"},
+	},
+	CardStatusDeceased: {},
+	CardStatusReplaced: {},
+}
+
+// CardStatusTransitionError is returned when a card status change is not allowed
+type CardStatusTransitionError struct {
+	CardID     string
+	FromStatus string
+	ToStatus   string
+	ReasonCode string
+	Message    string
+}
+
+func (e *CardStatusTransitionError) Error() string {
+	return fmt.Sprintf("card %s cannot change status from %s to %s (reason code %q): %s",
+		e.CardID, e.FromStatus, e.ToStatus, e.ReasonCode, e.Message)
+}
+
+// validateCardStatusTransition checks a status change against cardStatusTransitions
+func validateCardStatusTransition(cardID string, fromStatus string, toStatus string, reasonCode string) error {
+	transitionErr := &CardStatusTransitionError{
+		CardID:     cardID,
+		FromStatus: fromStatus,
+		ToStatus:   toStatus,
+		ReasonCode: reasonCode,
 	}
-	if existing != nil {
-		return fmt.Errorf("card %s already exists", cardID)
+
+	if _, ok := cardStatusTransitions[toStatus]; !ok {
+		transitionErr.Message = "unknown card status"
+		return transitionErr
 	}
+	allowed, ok := cardStatusTransitions[fromStatus]
+	if !ok {
+		transitionErr.Message = "current card status is unknown"
+		return transitionErr
+	}
+	reasonCodes, ok := allowed[toStatus]
+	if !ok {
+		transitionErr.Message = "transition not allowed"
+		return transitionErr
+	}
+	for _, code := range reasonCodes {
+		if code == reasonCode {
+			return nil
+		}
+	}
+	transitionErr.Message = fmt.Sprintf("reason code must be one of %v", reasonCodes)
+	return transitionErr
+}
 
-	// Get issuer identity
-	issuer, err := ctx.GetClientIdentity().GetID()
+// isFinalCardStatus reports whether a card status allows no further transitions
+func isFinalCardStatus(status string) bool {
+	allowed, ok := cardStatusTransitions[status]
+	return ok && len(allowed) == 0
+}
+
+// applyCardStatusTransition moves the card to a new status if the transition is allowed
+// and returns the previous status
+func applyCardStatusTransition(ctx contractapi.TransactionContextInterface, card *BPJSCard,
+	newStatus string, reasonCode string) (string, error) {
+
+	oldStatus := card.Status
+	if err := validateCardStatusTransition(card.CardID, oldStatus, newStatus, reasonCode); err != nil {
+		return oldStatus, err
+	}
+
+	card.Status = newStatus
+	card.StatusCode = reasonCode
+	card.Timestamp = getTxTimestamp(ctx)
+	return oldStatus, nil
+}
+
+// ===== NIK VALIDATION =====
+
+// NIK validation error codes
+const (
+	NIKErrInvalidLength       = "NIK_INVALID_LENGTH"
+	NIKErrNotNumeric          = "NIK_NOT_NUMERIC"
+	NIKErrInvalidRegion       = "NIK_INVALID_REGION"
+	NIKErrInvalidBirthDate    = "NIK_INVALID_BIRTH_DATE"
+	NIKErrInvalidDateOfBirth  = "NIK_INVALID_DATE_OF_BIRTH"
+	NIKErrInvalidGender       = "NIK_INVALID_GENDER"
+	NIKErrBirthDateMismatch   = "NIK_BIRTH_DATE_MISMATCH"
+	NIKErrGenderMismatch      = "NIK_GENDER_MISMATCH"
+	nikFemaleBirthDayIncrease = 40
+)
+
+// nikProvinceCodes lists the province codes a NIK can start with
+var nikProvinceCodes = map[string]bool{
+	"11": true, "12": true, "13": true, "14": true, "15": true, "16": true, "17": true, "18": true, "19": true,
+	"21": true,
+	"31": true, "32": true, "33": true, "34": true, "35": true, "36": true,
+	"51": true, "52": true, "53": true,
+	"61": true, "62": true, "63": true, "64": true, "65": true,
+	"71": true, "72": true, "73": true, "74": true, "75": true, "76": true,
+	"81": true, "82": true,
+	"91": true, "92": true, "93": true, "94": true, "95": true, "96": true,
+}
+
+// NIKValidationError is returned when a NIK is malformed or inconsistent with the
+// holder's date of birth or gender. Code is one of the NIKErr constants.
+type NIKValidationError struct {
+	Code    string
+	NIK     string
+	Message string
+}
+
+func (e *NIKValidationError) Error() string {
+	return fmt.Sprintf("%s: NIK %s %s", e.Code, e.NIK, e.Message)
+}
+
+// validateNIK checks the NIK format (16 digits, region code prefix, embedded birth date)
+// and that the embedded birth date and gender match dateOfBirth and gender.
+// The NIK layout is PPKKCC DDMMYY SSSS; women have 40 added to DD.
+func validateNIK(nik string, dateOfBirth string, gender string) error {
+	fail := func(code string, format string, args ...interface{}) error {
+		return &NIKValidationError{Code: code, NIK: nik, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if len(nik) != 16 {
+		return fail(NIKErrInvalidLength, "must be 16 digits, got %d characters", len(nik))
+	}
+	for _, c := range nik {
+		if c < '0' || c > '9' {
+			return fail(NIKErrNotNumeric, "must contain digits only")
+		}
+	}
+	if !nikProvinceCodes[nik[0:2]] || nik[2:4] == "00" || nik[4:6] == "00" {
+		return fail(NIKErrInvalidRegion, "has invalid region code %s", nik[0:6])
+	}
+
+	day, _ := strconv.Atoi(nik[6:8])
+	nikGender := "Male"
+	if day > nikFemaleBirthDayIncrease {
+		nikGender = "Female"
+		day -= nikFemaleBirthDayIncrease
+	}
+	month, _ := strconv.Atoi(nik[8:10])
+	year, _ := strconv.Atoi(nik[10:12])
+	if day < 1 || day > 31 || month < 1 || month > 12 {
+		return fail(NIKErrInvalidBirthDate, "has invalid birth date digits %s", nik[6:12])
+	}
+
+	birthDate, err := parseDate(dateOfBirth)
 	if err != nil {
-		return fmt.Errorf("failed to get issuer identity: %v", err)
+		return fail(NIKErrInvalidDateOfBirth, "cannot be checked against date of birth %q", dateOfBirth)
+	}
+	if gender != "Male" && gender != "Female" {
+		return fail(NIKErrInvalidGender, "cannot be checked against gender %q, must be Male or Female", gender)
 	}
 
-	// Create card
-	card := BPJSCard{
+	if birthDate.Day() != day || int(birthDate.Month()) != month || birthDate.Year()%100 != year {
+		return fail(NIKErrBirthDateMismatch, "encodes birth date %02d-%02d-%02d, not %s", day, month, year, dateOfBirth)
+	}
+	if gender != nikGender {
+		return fail(NIKErrGenderMismatch, "encodes gender %s, not %s", nikGender, gender)
+	}
+
+	return nil
+}
+
+// ===== CARD MANAGEMENT FUNCTIONS =====
+
+// IssueCard creates a new BPJS card
+func (s *BPJSSmartContract) IssueCard(ctx contractapi.TransactionContextInterface,
+	cardID string, patientID string, patientName string, nik string,
+	dateOfBirth string, gender string, address string, cardType string,
+	issueDate string, expiryDate string) error {
+
+	spec := CardSpec{
 		CardID:      cardID,
 		PatientID:   patientID,
 		PatientName: patientName,
@@ -158,32 +787,17 @@ func (s *BPJSSmartContract) IssueCard(ctx contractapi.TransactionContextInterfac
 		DateOfBirth: dateOfBirth,
 		Gender:      gender,
 		Address:     address,
-		Status:      "active",
 		CardType:    cardType,
 		IssueDate:   issueDate,
 		ExpiryDate:  expiryDate,
-		IssuedBy:    issuer,
-		Timestamp:   getTxTimestamp(ctx),
-	}
-
-	cardJSON, err := json.Marshal(card)
-	if err != nil {
-		return fmt.Errorf("failed to marshal card: %v", err)
-	}
-
-	err = ctx.GetStub().PutState(cardID, cardJSON)
-	if err != nil {
-		return fmt.Errorf("failed to put state: %v", err)
 	}
 
-	// Create composite key for querying by patientID
-	indexName := "patientID~cardID"
-	patientCardIndexKey, err := ctx.GetStub().CreateCompositeKey(indexName, []string{patientID, cardID})
+	issuance := newCardIssuance()
+	card, err := s.prepareCard(ctx, &spec, issuance)
 	if err != nil {
 		return err
 	}
-	err = ctx.GetStub().PutState(patientCardIndexKey, []byte{0x00})
-	if err != nil {
+	if err := s.writeIssuedCards(ctx, []*BPJSCard{card}, issuance); err != nil {
 		return err
 	}
 
@@ -191,172 +805,4178 @@ func (s *BPJSSmartContract) IssueCard(ctx contractapi.TransactionContextInterfac
 	ctx.GetStub().SetEvent("CardIssued", []byte(fmt.Sprintf("Card %s issued to %s", cardID, patientName)))
 
 	// Log audit
-	return s.createAuditLog(ctx, "IssueCard", "card", cardID, issuer, "BPJS_ADMIN",
+	return s.createAuditLog(ctx, "IssueCard", "card", cardID, card.IssuedBy, "BPJS_ADMIN",
 		fmt.Sprintf("Issued BPJS card to %s", patientName))
 }
 
-// VerifyCard verifies card status and returns card details
-func (s *BPJSSmartContract) VerifyCard(ctx contractapi.TransactionContextInterface,
-	cardID string) (*BPJSCard, error) {
+// cardIssuance tracks the cards, NIKs and quota places taken by earlier cards of the
+// same transaction, since GetState does not see writes before the transaction commits
+type cardIssuance struct {
+	cardIDs map[string]bool
+	niks    map[string]bool
+	quotas  map[string]*SubsidyQuota
+}
+
+func newCardIssuance() *cardIssuance {
+	return &cardIssuance{
+		cardIDs: make(map[string]bool),
+		niks:    make(map[string]bool),
+		quotas:  make(map[string]*SubsidyQuota),
+	}
+}
+
+// prepareCard applies the IssueCard rules to a card spec and builds the card without
+// writing it. Quota places are reserved in the issuance only.
+func (s *BPJSSmartContract) prepareCard(ctx contractapi.TransactionContextInterface,
+	spec *CardSpec, issuance *cardIssuance) (*BPJSCard, error) {
+
+	if err := validateNIK(spec.NIK, spec.DateOfBirth, spec.Gender); err != nil {
+		return nil, err
+	}
 
-	cardJSON, err := ctx.GetStub().GetState(cardID)
+	// VerifyCard compares the expiry date, so a card must start with valid dates
+	issueDate, err := parseDate(spec.IssueDate)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read from world state: %v", err)
+		return nil, fmt.Errorf("invalid issue date: %v", err)
 	}
-	if cardJSON == nil {
-		return nil, fmt.Errorf("card %s not found", cardID)
+	expiryDate, err := parseDate(spec.ExpiryDate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry date: %v", err)
+	}
+	if !expiryDate.After(issueDate) {
+		return nil, fmt.Errorf("expiry date %s must be after issue date %s", spec.ExpiryDate, spec.IssueDate)
 	}
 
-	var card BPJSCard
-	err = json.Unmarshal(cardJSON, &card)
+	// Check if card already exists
+	existing, err := ctx.GetStub().GetState(cardKey(spec.CardID))
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal card: %v", err)
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existing != nil || issuance.cardIDs[spec.CardID] {
+		return nil, fmt.Errorf("card %s already exists", spec.CardID)
 	}
 
-	if card.Status != "active" {
-		return nil, fmt.Errorf("card status is %s, not active", card.Status)
+	// Only one card per NIK until it is replaced or the member dies
+	if issuance.niks[spec.NIK] {
+		return nil, fmt.Errorf("NIK %s already has a card in this transaction", spec.NIK)
+	}
+	if err := s.ensureNoOpenCardForNIK(ctx, spec.NIK, ""); err != nil {
+		return nil, err
 	}
 
-	return &card, nil
-}
+	// Government-funded segments draw from the region's quota
+	fundingSource, ok := participantSegments[spec.CardType]
+	if !ok {
+		return nil, fmt.Errorf("invalid card type %s, must be PBI-APBN, PBI-APBD, PPU, PBPU or BP", spec.CardType)
+	}
+	regionCode := regionCodeFromNIK(spec.NIK)
+	var subsidyQuota *SubsidyQuota
+	if hasSubsidyQuota(spec.CardType) {
+		key := subsidyQuotaKey(spec.CardType, regionCode)
+		subsidyQuota = issuance.quotas[key]
+		if subsidyQuota == nil {
+			if subsidyQuota, err = s.getSubsidyQuota(ctx, spec.CardType, regionCode); err != nil {
+				return nil, err
+			}
+		}
+		if subsidyQuota == nil {
+			return nil, fmt.Errorf("no %s quota for region %s", spec.CardType, regionCode)
+		}
+		if subsidyQuota.Used >= subsidyQuota.Quota {
+			return nil, fmt.Errorf("%s quota for region %s is exhausted (%d of %d used)",
+				spec.CardType, regionCode, subsidyQuota.Used, subsidyQuota.Quota)
+		}
+	}
 
-// UpdateCardStatus updates card status (suspend, reactivate, etc.)
-func (s *BPJSSmartContract) UpdateCardStatus(ctx contractapi.TransactionContextInterface,
-	cardID string, newStatus string, reason string) error {
+	// Get issuer identity
+	issuer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get issuer identity: %v", err)
+	}
 
-	cardJSON, err := ctx.GetStub().GetState(cardID)
-	if err != nil || cardJSON == nil {
-		return fmt.Errorf("card %s not found", cardID)
+	// All checks passed, take the card ID, NIK and quota place
+	issuance.cardIDs[spec.CardID] = true
+	issuance.niks[spec.NIK] = true
+	if subsidyQuota != nil {
+		subsidyQuota.Used++
+		issuance.quotas[subsidyQuotaKey(spec.CardType, regionCode)] = subsidyQuota
 	}
 
-	var card BPJSCard
-	json.Unmarshal(cardJSON, &card)
+	// Create card
+	return &BPJSCard{
+		CardID:      spec.CardID,
+		PatientID:   spec.PatientID,
+		PatientName: spec.PatientName,
+		NIK:         spec.NIK,
+		DateOfBirth: spec.DateOfBirth,
+		Gender:      spec.Gender,
+		Address:     spec.Address,
+		Status:      CardStatusActive,
+		CardType:    spec.CardType,
+		IssueDate:   spec.IssueDate,
+		ExpiryDate:  spec.ExpiryDate,
+		IssuedBy:    issuer,
+		Timestamp:   getTxTimestamp(ctx),
 
-	oldStatus := card.Status
-	card.Status = newStatus
-	card.Timestamp = getTxTimestamp(ctx)
+		FundingSource:        fundingSource,
+		RegionCode:           regionCode,
+		SegmentEffectiveDate: spec.IssueDate,
+		CareClass:            "3",
+		CareClassSince:       spec.IssueDate,
+	}, nil
+}
 
-	updatedJSON, _ := json.Marshal(card)
-	err = ctx.GetStub().PutState(cardID, updatedJSON)
-	if err != nil {
-		return err
+// writeIssuedCards writes prepared cards and the quota places they took
+func (s *BPJSSmartContract) writeIssuedCards(ctx contractapi.TransactionContextInterface,
+	cards []*BPJSCard, issuance *cardIssuance) error {
+
+	quotaKeys := make([]string, 0, len(issuance.quotas))
+	for key := range issuance.quotas {
+		quotaKeys = append(quotaKeys, key)
+	}
+	sort.Strings(quotaKeys)
+	for _, key := range quotaKeys {
+		if err := s.putSubsidyQuota(ctx, issuance.quotas[key]); err != nil {
+			return err
+		}
 	}
 
-	actor, _ := ctx.GetClientIdentity().GetID()
-	return s.createAuditLog(ctx, "UpdateCardStatus", "card", cardID, actor, "BPJS_ADMIN",
-		fmt.Sprintf("Status changed from %s to %s. Reason: %s", oldStatus, newStatus, reason))
+	for _, card := range cards {
+		if err := s.putNewCard(ctx, card); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// ===== VISIT RECORDING FUNCTIONS =====
+// IssueCardsBatch issues the cards in cardsJSON, a JSON array of card specs, applying the
+// IssueCard rules to each. In "all-or-nothing" mode no card is issued unless every card is
+// valid; in "best-effort" mode valid cards are issued and invalid ones are reported.
+func (s *BPJSSmartContract) IssueCardsBatch(ctx contractapi.TransactionContextInterface,
+	cardsJSON string, mode string) (*BatchIssueResult, error) {
 
-// RecordVisit records a patient visit at healthcare facility
-func (s *BPJSSmartContract) RecordVisit(ctx contractapi.TransactionContextInterface,
-	visitID string, cardID string, patientID string, patientName string,
-	faskesCode string, faskesName string, faskesType string,
-	visitDate string, visitType string, diagnosis string, treatment string,
-	doctorName string, doctorID string, notes string) error {
+	if mode != BatchModeAllOrNothing && mode != BatchModeBestEffort {
+		return nil, fmt.Errorf("invalid mode %s, must be %s or %s", mode, BatchModeAllOrNothing, BatchModeBestEffort)
+	}
 
-	// Verify card is active
+	var specs []CardSpec
+	if err := json.Unmarshal([]byte(cardsJSON), &specs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal card specs: %v", err)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no cards given")
+	}
+
+	result := &BatchIssueResult{
+		Mode:    mode,
+		Total:   len(specs),
+		Results: make([]BatchItemResult, len(specs)),
+	}
+
+	issuance := newCardIssuance()
+	var cards []*BPJSCard
+	for i := range specs {
+		result.Results[i] = BatchItemResult{Index: i, CardID: specs[i].CardID}
+
+		card, err := s.prepareCard(ctx, &specs[i], issuance)
+		if err != nil {
+			result.Results[i].Error = err.Error()
+			result.Failed++
+			continue
+		}
+		cards = append(cards, card)
+	}
+
+	if mode == BatchModeAllOrNothing && result.Failed > 0 {
+		for i := range result.Results {
+			if result.Results[i].Error == "" {
+				result.Results[i].Error = "not issued, another card in the batch failed"
+			}
+		}
+		ctx.GetStub().SetEvent("CardsBatchIssued", []byte(fmt.Sprintf("Batch failed, issued 0 of %d cards (%s), %d failed",
+			result.Total, mode, result.Failed)))
+		return result, nil
+	}
+
+	if err := s.writeIssuedCards(ctx, cards, issuance); err != nil {
+		return nil, err
+	}
+	for i := range result.Results {
+		if result.Results[i].Error == "" {
+			result.Results[i].Success = true
+			result.Succeeded++
+		}
+	}
+
+	issuer, _ := ctx.GetClientIdentity().GetID()
+	for _, card := range cards {
+		err := s.createAuditLog(ctx, "IssueCardsBatch", "card", card.CardID, issuer, "BPJS_ADMIN",
+			fmt.Sprintf("Issued BPJS card to %s", card.PatientName))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx.GetStub().SetEvent("CardsBatchIssued", []byte(fmt.Sprintf("Batch issued %d of %d cards (%s), %d failed",
+		result.Succeeded, result.Total, mode, result.Failed)))
+
+	return result, nil
+}
+
+// ensureNoOpenCardForNIK rejects a NIK that already holds a card other than exceptCardID in a
+// status that is not final. Suspended, inactive and expired cards can still be reactivated.
+func (s *BPJSSmartContract) ensureNoOpenCardForNIK(ctx contractapi.TransactionContextInterface,
+	nik string, exceptCardID string) error {
+
+	nikCards, err := s.getCardsByNIK(ctx, nik)
+	if err != nil {
+		return err
+	}
+	for _, nikCard := range nikCards {
+		if !isFinalCardStatus(nikCard.Status) && nikCard.CardID != exceptCardID {
+			return fmt.Errorf("NIK %s already has %s card %s", nik, nikCard.Status, nikCard.CardID)
+		}
+	}
+	return nil
+}
+
+// putNewCard writes a newly issued card together with its patientID and NIK indexes
+func (s *BPJSSmartContract) putNewCard(ctx contractapi.TransactionContextInterface, card *BPJSCard) error {
+	cardJSON, err := json.Marshal(card)
+	if err != nil {
+		return fmt.Errorf("failed to marshal card: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(cardKey(card.CardID), cardJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+
+	// Create composite key for querying by patientID
+	indexName := "patientID~cardID"
+	patientCardIndexKey, err := ctx.GetStub().CreateCompositeKey(indexName, []string{card.PatientID, card.CardID})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(patientCardIndexKey, []byte{0x00})
+	if err != nil {
+		return err
+	}
+
+	// Create composite key for looking up cards by NIK
+	nikCardIndexKey, err := ctx.GetStub().CreateCompositeKey("nik~cardID", []string{card.NIK, card.CardID})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(nikCardIndexKey, []byte{0x00})
+}
+
+// ReplaceCard replaces a lost or damaged card. The old card is marked replaced and a
+// new card with the same holder and validity is issued, linked through Replaces/ReplacedBy.
+func (s *BPJSSmartContract) ReplaceCard(ctx contractapi.TransactionContextInterface,
+	oldCardID string, newCardID string, reasonCode string) error {
+
+	existing, err := ctx.GetStub().GetState(cardKey(newCardID))
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("card %s already exists", newCardID)
+	}
+
+	oldCardJSON, err := ctx.GetStub().GetState(cardKey(oldCardID))
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if oldCardJSON == nil {
+		return fmt.Errorf("card %s not found", oldCardID)
+	}
+
+	var oldCard BPJSCard
+	err = json.Unmarshal(oldCardJSON, &oldCard)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal card: %v", err)
+	}
+
+	// The replacement is issued active, so a suspension has to be resolved first
+	// rather than being shed by replacing the card
+	if oldCard.Status == CardStatusSuspended {
+		return fmt.Errorf("card %s is suspended, resolve the suspension before replacing it", oldCardID)
+	}
+
+	oldStatus, err := applyCardStatusTransition(ctx, &oldCard, CardStatusReplaced, reasonCode)
+	if err != nil {
+		return err
+	}
+	if err := s.ensureNoOpenCardForNIK(ctx, oldCard.NIK, oldCardID); err != nil {
+		return err
+	}
+
+	issuer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get issuer identity: %v", err)
+	}
+
+	// The new card takes over the old card's segment and PBI quota place
+	newCard := oldCard
+	newCard.CardID = newCardID
+	newCard.Status = CardStatusActive
+	newCard.StatusCode = ""
+	newCard.IssueDate = getTxTimestamp(ctx).Format("2006-01-02")
+	newCard.IssuedBy = issuer
+	newCard.Replaces = oldCardID
+	newCard.ReplacedBy = ""
+	if newCard.ValidFrom == "" {
+		newCard.ValidFrom = oldCard.IssueDate
+	}
+
+	oldCard.ReplacedBy = newCardID
+
+	oldCardJSON, err = json.Marshal(oldCard)
+	if err != nil {
+		return fmt.Errorf("failed to marshal card: %v", err)
+	}
+	err = ctx.GetStub().PutState(cardKey(oldCardID), oldCardJSON)
+	if err != nil {
+		return err
+	}
+	if err := s.putNewCard(ctx, &newCard); err != nil {
+		return err
+	}
+
+	// Move the FKTP registration to the new card
+	if newCard.PrimaryFacility != "" {
+		if err := s.deletePrimaryFacilityIndex(ctx, newCard.PrimaryFacility, oldCardID); err != nil {
+			return err
+		}
+		if err := s.putPrimaryFacilityIndex(ctx, newCard.PrimaryFacility, newCardID); err != nil {
+			return err
+		}
+	}
+
+	// Keep the household linked to the card in use
+	kkNumber, err := s.getFamilyGroupOfCard(ctx, oldCardID)
+	if err != nil {
+		return err
+	}
+	if kkNumber != "" {
+		if err := s.replaceFamilyMemberCard(ctx, kkNumber, oldCardID, newCardID); err != nil {
+			return err
+		}
+	}
+
+	ctx.GetStub().SetEvent("CardReplaced", []byte(fmt.Sprintf("Card %s replaced by %s", oldCardID, newCardID)))
+
+	return s.createStateChangeAuditLog(ctx, "ReplaceCard", "card", oldCardID, issuer, "BPJS_ADMIN",
+		oldStatus, CardStatusReplaced, reasonCode,
+		fmt.Sprintf("Card replaced by %s for %s", newCardID, oldCard.PatientName))
+}
+
+// getCardChain returns all cards linked to cardID through replacements,
+// from the original card to the card currently in use
+func (s *BPJSSmartContract) getCardChain(ctx contractapi.TransactionContextInterface,
+	cardID string) ([]*BPJSCard, error) {
+
+	loadCard := func(id string) (*BPJSCard, error) {
+		cardJSON, err := ctx.GetStub().GetState(cardKey(id))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from world state: %v", err)
+		}
+		if cardJSON == nil {
+			return nil, fmt.Errorf("card %s not found", id)
+		}
+		var card BPJSCard
+		if err := json.Unmarshal(cardJSON, &card); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal card: %v", err)
+		}
+		return &card, nil
+	}
+
+	card, err := loadCard(cardID)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{card.CardID: true}
+	chain := []*BPJSCard{card}
+	for previous := card.Replaces; previous != "" && !seen[previous]; {
+		prevCard, err := loadCard(previous)
+		if err != nil {
+			return nil, err
+		}
+		seen[previous] = true
+		chain = append([]*BPJSCard{prevCard}, chain...)
+		previous = prevCard.Replaces
+	}
+	for next := card.ReplacedBy; next != "" && !seen[next]; {
+		nextCard, err := loadCard(next)
+		if err != nil {
+			return nil, err
+		}
+		seen[next] = true
+		chain = append(chain, nextCard)
+		next = nextCard.ReplacedBy
+	}
+
+	return chain, nil
+}
+
+// splitCardChain returns the set of card IDs in a replacement chain and the distinct
+// patient IDs holding them
+func splitCardChain(chain []*BPJSCard) (map[string]bool, []string) {
+	cardIDs := make(map[string]bool)
+	var patientIDs []string
+	seenPatients := make(map[string]bool)
+	for _, card := range chain {
+		cardIDs[card.CardID] = true
+		if !seenPatients[card.PatientID] {
+			seenPatients[card.PatientID] = true
+			patientIDs = append(patientIDs, card.PatientID)
+		}
+	}
+	return cardIDs, patientIDs
+}
+
+// GetCardChain retrieves every card linked to a card through replacements, oldest first
+func (s *BPJSSmartContract) GetCardChain(ctx contractapi.TransactionContextInterface,
+	cardID string) ([]*BPJSCard, error) {
+
+	return s.getCardChain(ctx, cardID)
+}
+
+// VerifyCard verifies card status and returns card details
+func (s *BPJSSmartContract) VerifyCard(ctx contractapi.TransactionContextInterface,
+	cardID string) (*BPJSCard, error) {
+
+	cardJSON, err := ctx.GetStub().GetState(cardKey(cardID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if cardJSON == nil {
+		return nil, fmt.Errorf("card %s not found", cardID)
+	}
+
+	var card BPJSCard
+	err = json.Unmarshal(cardJSON, &card)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal card: %v", err)
+	}
+
+	if card.Status == CardStatusSuspended && card.StatusCode == "CONTRIBUTION_ARREARS" {
+		return nil, fmt.Errorf("card %s is suspended for arrears, not active", cardID)
+	}
+	if card.Status != CardStatusActive {
+		return nil, fmt.Errorf("card status is %s, not active", card.Status)
+	}
+
+	expired, err := isCardExpired(ctx, &card)
+	if err != nil {
+		return nil, err
+	}
+	if expired {
+		return nil, fmt.Errorf("card %s expired on %s", cardID, card.ExpiryDate)
+	}
+
+	return &card, nil
+}
+
+// GetCardByNIK returns the card held by a NIK: the active card if there is one,
+// otherwise the most recently issued card
+func (s *BPJSSmartContract) GetCardByNIK(ctx contractapi.TransactionContextInterface,
+	nik string) (*BPJSCard, error) {
+
+	cards, err := s.getCardsByNIK(ctx, nik)
+	if err != nil {
+		return nil, err
+	}
+	if len(cards) == 0 {
+		return nil, fmt.Errorf("no card found for NIK %s", nik)
+	}
+
+	latest := cards[0]
+	for _, card := range cards {
+		if card.Status == CardStatusActive {
+			return card, nil
+		}
+		if card.Timestamp.After(latest.Timestamp) {
+			latest = card
+		}
+	}
+	return latest, nil
+}
+
+// getCardsByNIK loads all cards registered to a NIK through the nik~cardID index
+func (s *BPJSSmartContract) getCardsByNIK(ctx contractapi.TransactionContextInterface,
+	nik string) ([]*BPJSCard, error) {
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("nik~cardID", []string{nik})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query NIK index: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var cards []*BPJSCard
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(response.Key)
+		if err != nil {
+			continue
+		}
+		cardJSON, err := ctx.GetStub().GetState(cardKey(compositeKeyParts[1]))
+		if err != nil || cardJSON == nil {
+			continue
+		}
+
+		var card BPJSCard
+		if err := json.Unmarshal(cardJSON, &card); err != nil {
+			continue
+		}
+		cards = append(cards, &card)
+	}
+
+	return cards, nil
+}
+
+// cardDetailFields lists the demographic fields UpdateCardDetails may correct,
+// with accessors into the card
+var cardDetailFields = map[string]func(card *BPJSCard) *string{
+	"patientName": func(card *BPJSCard) *string { return &card.PatientName },
+	"dateOfBirth": func(card *BPJSCard) *string { return &card.DateOfBirth },
+	"gender":      func(card *BPJSCard) *string { return &card.Gender },
+	"address":     func(card *BPJSCard) *string { return &card.Address },
+}
+
+// UpdateCardDetails corrects demographic fields of a card. changes is a JSON object of
+// field name to new value, e.g. {"patientName":"Budi Santoso"}; only patientName,
+// dateOfBirth, gender and address can be changed. The audit log records each changed field.
+func (s *BPJSSmartContract) UpdateCardDetails(ctx contractapi.TransactionContextInterface,
+	cardID string, changes string, justification string) error {
+
+	if justification == "" {
+		return fmt.Errorf("justification is required")
+	}
+
+	var requested map[string]string
+	if err := json.Unmarshal([]byte(changes), &requested); err != nil {
+		return fmt.Errorf("changes must be a JSON object of field names to values: %v", err)
+	}
+	if len(requested) == 0 {
+		return fmt.Errorf("no changes given")
+	}
+
+	cardJSON, err := ctx.GetStub().GetState(cardKey(cardID))
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if cardJSON == nil {
+		return fmt.Errorf("card %s not found", cardID)
+	}
+
+	var card BPJSCard
+	err = json.Unmarshal(cardJSON, &card)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal card: %v", err)
+	}
+
+	fields := make([]string, 0, len(requested))
+	for field := range requested {
+		if _, ok := cardDetailFields[field]; !ok {
+			return fmt.Errorf("field %s cannot be changed with UpdateCardDetails", field)
+		}
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var fieldChanges []FieldChange
+	for _, field := range fields {
+		value := cardDetailFields[field](&card)
+		if *value == requested[field] {
+			continue
+		}
+		fieldChanges = append(fieldChanges, FieldChange{
+			Field:    field,
+			OldValue: *value,
+			NewValue: requested[field],
+		})
+		*value = requested[field]
+	}
+	if len(fieldChanges) == 0 {
+		return fmt.Errorf("changes do not differ from the current card details")
+	}
+	_, dateOfBirthChanged := requested["dateOfBirth"]
+	_, genderChanged := requested["gender"]
+	if dateOfBirthChanged || genderChanged {
+		if err := validateNIK(card.NIK, card.DateOfBirth, card.Gender); err != nil {
+			return err
+		}
+	}
+	card.Timestamp = getTxTimestamp(ctx)
+
+	updatedJSON, err := json.Marshal(card)
+	if err != nil {
+		return fmt.Errorf("failed to marshal card: %v", err)
+	}
+	err = ctx.GetStub().PutState(cardKey(cardID), updatedJSON)
+	if err != nil {
+		return err
+	}
+
+	// Keep the member name shown in the family group in line with the card
+	if _, ok := requested["patientName"]; ok {
+		kkNumber, err := s.getFamilyGroupOfCard(ctx, cardID)
+		if err != nil {
+			return err
+		}
+		if kkNumber != "" {
+			group, err := s.GetFamilyGroup(ctx, kkNumber)
+			if err != nil {
+				return err
+			}
+			for i := range group.Members {
+				if group.Members[i].CardID == cardID {
+					group.Members[i].PatientName = card.PatientName
+				}
+			}
+			if err := s.putFamilyGroup(ctx, group); err != nil {
+				return err
+			}
+		}
+	}
+
+	actor, _ := ctx.GetClientIdentity().GetID()
+	return s.putAuditLog(ctx, &AuditLog{
+		Action:      "UpdateCardDetails",
+		EntityType:  "card",
+		EntityID:    cardID,
+		ActorID:     actor,
+		ActorRole:   "BPJS_ADMIN",
+		Description: fmt.Sprintf("Corrected %d card field(s). Justification: %s", len(fieldChanges), justification),
+		Changes:     fieldChanges,
+	})
+}
+
+// isCardExpired compares the card expiry date with the transaction date.
+// Cards without an expiry date never expire.
+func isCardExpired(ctx contractapi.TransactionContextInterface, card *BPJSCard) (bool, error) {
+	if card.ExpiryDate == "" {
+		return false, nil
+	}
+	expiryDate, err := parseDate(card.ExpiryDate)
+	if err != nil {
+		return false, fmt.Errorf("card %s has an invalid expiry date: %v", card.CardID, err)
+	}
+	txDate, _ := parseDate(getTxTimestamp(ctx).Format("2006-01-02"))
+	return txDate.After(expiryDate), nil
+}
+
+// RenewCard extends the validity of an active or expired card until newExpiryDate.
+// The previous validity period is kept in the card's validity history.
+func (s *BPJSSmartContract) RenewCard(ctx contractapi.TransactionContextInterface,
+	cardID string, newExpiryDate string) error {
+
+	cardJSON, err := ctx.GetStub().GetState(cardKey(cardID))
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if cardJSON == nil {
+		return fmt.Errorf("card %s not found", cardID)
+	}
+
+	var card BPJSCard
+	err = json.Unmarshal(cardJSON, &card)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal card: %v", err)
+	}
+
+	if card.Status != CardStatusActive && card.Status != CardStatusExpired {
+		return fmt.Errorf("card %s with status %s cannot be renewed", cardID, card.Status)
+	}
+
+	if _, err := parseDate(newExpiryDate); err != nil {
+		return err
+	}
+	renewalDate := getTxTimestamp(ctx).Format("2006-01-02")
+	if newExpiryDate <= renewalDate || (card.ExpiryDate != "" && newExpiryDate <= card.ExpiryDate) {
+		return fmt.Errorf("new expiry date %s must be after the current expiry date and the renewal date", newExpiryDate)
+	}
+
+	renewer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get renewer identity: %v", err)
+	}
+
+	validFrom := card.ValidFrom
+	if validFrom == "" {
+		validFrom = card.IssueDate
+	}
+	card.ValidityHistory = append(card.ValidityHistory, ValidityPeriod{
+		ValidFrom:  validFrom,
+		ValidUntil: card.ExpiryDate,
+		RenewedBy:  renewer,
+		RenewedOn:  renewalDate,
+	})
+
+	oldStatus := card.Status
+	if card.Status == CardStatusExpired {
+		if _, err := applyCardStatusTransition(ctx, &card, CardStatusActive, "CARD_RENEWED"); err != nil {
+			return err
+		}
+	}
+
+	oldExpiryDate := card.ExpiryDate
+	card.ValidFrom = renewalDate
+	card.ExpiryDate = newExpiryDate
+	card.Timestamp = getTxTimestamp(ctx)
+
+	updatedJSON, err := json.Marshal(card)
+	if err != nil {
+		return fmt.Errorf("failed to marshal card: %v", err)
+	}
+	err = ctx.GetStub().PutState(cardKey(cardID), updatedJSON)
+	if err != nil {
+		return err
+	}
+
+	ctx.GetStub().SetEvent("CardRenewed", []byte(fmt.Sprintf("Card %s renewed until %s", cardID, newExpiryDate)))
+
+	return s.createStateChangeAuditLog(ctx, "RenewCard", "card", cardID, renewer, "BPJS_ADMIN",
+		oldStatus, card.Status, "CARD_RENEWED",
+		fmt.Sprintf("Card validity extended from %s to %s", oldExpiryDate, newExpiryDate))
+}
+
+// UpdateCardStatus moves a card to a new status following the card status state machine.
+// Every transition requires one of the reason codes allowed for it.
+func (s *BPJSSmartContract) UpdateCardStatus(ctx contractapi.TransactionContextInterface,
+	cardID string, newStatus string, reasonCode string, reason string) error {
+
+	cardJSON, err := ctx.GetStub().GetState(cardKey(cardID))
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if cardJSON == nil {
+		return fmt.Errorf("card %s not found", cardID)
+	}
+
+	var card BPJSCard
+	err = json.Unmarshal(cardJSON, &card)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal card: %v", err)
+	}
+
+	if newStatus == CardStatusDeceased {
+		return fmt.Errorf("card %s cannot be marked deceased here, use RegisterDeath", cardID)
+	}
+	if newStatus == CardStatusReplaced {
+		return fmt.Errorf("card %s cannot be marked replaced here, use ReplaceCard", cardID)
+	}
+
+	oldStatus, err := applyCardStatusTransition(ctx, &card, newStatus, reasonCode)
+	if err != nil {
+		return err
+	}
+	if err := s.updateSubsidyQuotaPlace(ctx, &card, oldStatus); err != nil {
+		return err
+	}
+	if err := s.updatePrimaryFacilityIndex(ctx, &card, oldStatus); err != nil {
+		return err
+	}
+
+	updatedJSON, err := json.Marshal(card)
+	if err != nil {
+		return fmt.Errorf("failed to marshal card: %v", err)
+	}
+	err = ctx.GetStub().PutState(cardKey(cardID), updatedJSON)
+	if err != nil {
+		return err
+	}
+
+	actor, _ := ctx.GetClientIdentity().GetID()
+	return s.createStateChangeAuditLog(ctx, "UpdateCardStatus", "card", cardID, actor, "BPJS_ADMIN",
+		oldStatus, newStatus, reasonCode,
+		fmt.Sprintf("Status changed from %s to %s. Reason: %s", oldStatus, newStatus, reason))
+}
+
+// RegisterDeath records a member's date of death and marks the card deceased. In the same
+// transaction it cancels open referrals dated after the death, flags claims for services
+// after the death, removes the member from their family group and releases a PBI quota place.
+// Claims for care given up to the date of death can still be submitted.
+func (s *BPJSSmartContract) RegisterDeath(ctx contractapi.TransactionContextInterface,
+	cardID string, dateOfDeath string, reason string) error {
+
+	cardJSON, err := ctx.GetStub().GetState(cardKey(cardID))
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if cardJSON == nil {
+		return fmt.Errorf("card %s not found", cardID)
+	}
+
+	var card BPJSCard
+	err = json.Unmarshal(cardJSON, &card)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal card: %v", err)
+	}
+
+	if _, err := parseDate(dateOfDeath); err != nil {
+		return err
+	}
+	if dateOfDeath > getTxTimestamp(ctx).Format("2006-01-02") {
+		return fmt.Errorf("date of death %s is in the future", dateOfDeath)
+	}
+	if dateOfDeath < card.DateOfBirth {
+		return fmt.Errorf("date of death %s is before date of birth %s", dateOfDeath, card.DateOfBirth)
+	}
+
+	oldStatus, err := applyCardStatusTransition(ctx, &card, CardStatusDeceased, "MEMBER_DECEASED")
+	if err != nil {
+		return err
+	}
+	if err := s.updateSubsidyQuotaPlace(ctx, &card, oldStatus); err != nil {
+		return err
+	}
+	if err := s.updatePrimaryFacilityIndex(ctx, &card, oldStatus); err != nil {
+		return err
+	}
+	card.DateOfDeath = dateOfDeath
+
+	updatedJSON, err := json.Marshal(card)
+	if err != nil {
+		return fmt.Errorf("failed to marshal card: %v", err)
+	}
+	err = ctx.GetStub().PutState(cardKey(cardID), updatedJSON)
+	if err != nil {
+		return err
+	}
+
+	actor, _ := ctx.GetClientIdentity().GetID()
+
+	// Cancel open referrals dated after the death
+	referrals, err := s.getCardReferrals(ctx, cardID)
+	if err != nil {
+		return err
+	}
+	var cancelledReferrals []string
+	for _, referral := range referrals {
+		if referral.Status != ReferralStatusPending && referral.Status != ReferralStatusAccepted {
+			continue
+		}
+		if referral.ReferralDate <= dateOfDeath {
+			continue
+		}
+
+		referral.Status = ReferralStatusCancelled
+		referral.Notes = fmt.Sprintf("Cancelled, patient died on %s", dateOfDeath)
+		referral.Timestamp = getTxTimestamp(ctx)
+
+		referralJSON, err := json.Marshal(referral)
+		if err != nil {
+			return fmt.Errorf("failed to marshal referral: %v", err)
+		}
+		if err := ctx.GetStub().PutState(referralKey(referral.ReferralID), referralJSON); err != nil {
+			return err
+		}
+		cancelledReferrals = append(cancelledReferrals, referral.ReferralID)
+	}
+
+	// Flag claims for services after the death
+	claims, err := s.GetCardClaims(ctx, cardID)
+	if err != nil {
+		return err
+	}
+	var flaggedClaims []string
+	for _, claim := range claims {
+		if claim.ServiceDate <= dateOfDeath || claim.Flagged {
+			continue
+		}
+
+		claim.Flagged = true
+		claim.FlagReason = fmt.Sprintf("service date %s is after patient died on %s", claim.ServiceDate, dateOfDeath)
+		claim.Timestamp = getTxTimestamp(ctx)
+
+		claimJSON, err := json.Marshal(claim)
+		if err != nil {
+			return fmt.Errorf("failed to marshal claim: %v", err)
+		}
+		if err := ctx.GetStub().PutState(claimKey(claim.ClaimID), claimJSON); err != nil {
+			return err
+		}
+		flaggedClaims = append(flaggedClaims, claim.ClaimID)
+	}
+
+	// Leave the family group
+	kkNumber, err := s.getFamilyGroupOfCard(ctx, cardID)
+	if err != nil {
+		return err
+	}
+	if kkNumber != "" {
+		group, err := s.GetFamilyGroup(ctx, kkNumber)
+		if err != nil {
+			return err
+		}
+		if err := s.removeDeceasedFamilyMember(ctx, group, cardID); err != nil {
+			return err
+		}
+		if err := s.putFamilyGroup(ctx, group); err != nil {
+			return err
+		}
+	}
+
+	ctx.GetStub().SetEvent("MemberDeceased", []byte(fmt.Sprintf("Card %s holder %s died on %s", cardID, card.PatientName, dateOfDeath)))
+
+	return s.createStateChangeAuditLog(ctx, "RegisterDeath", "card", cardID, actor, "BPJS_ADMIN",
+		oldStatus, CardStatusDeceased, "MEMBER_DECEASED",
+		fmt.Sprintf("Died on %s. Cancelled referrals: %v. Flagged claims: %v. Removed from family group: %s. Reason: %s",
+			dateOfDeath, cancelledReferrals, flaggedClaims, kkNumber, reason))
+}
+
+// ===== ELIGIBILITY TOKEN FUNCTIONS =====
+
+const (
+	// bpjsMSPID is the MSP ID of the BPJS organization, the only issuer of eligibility tokens
+	bpjsMSPID = "BPJSMSP"
+	// maxEligibilityTokenMinutes caps how long an eligibility token stays valid
+	maxEligibilityTokenMinutes = 24 * 60
+)
+
+// GetEligibilityClaims returns the eligibility token claims of an active card: the card ID,
+// status, care class, validity window and issuing organization. The BPJS client signs them
+// offline with the eligibility package, so the signing key never leaves BPJS.
+func (s *BPJSSmartContract) GetEligibilityClaims(ctx contractapi.TransactionContextInterface,
+	cardID string, validMinutes int) (*eligibility.Claims, error) {
+
+	issuer, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get issuer organization: %v", err)
+	}
+	if issuer != bpjsMSPID {
+		return nil, fmt.Errorf("eligibility tokens can only be issued by %s, not %s", bpjsMSPID, issuer)
+	}
+	if validMinutes < 1 || validMinutes > maxEligibilityTokenMinutes {
+		return nil, fmt.Errorf("token validity must be between 1 and %d minutes", maxEligibilityTokenMinutes)
+	}
+
+	card, err := s.VerifyCard(ctx, cardID)
+	if err != nil {
+		return nil, fmt.Errorf("card verification failed: %v", err)
+	}
+
+	// The token never outlives the card, which is valid through its expiry date
+	now := getTxTimestamp(ctx)
+	validUntil := now.Add(time.Duration(validMinutes) * time.Minute)
+	if card.ExpiryDate != "" {
+		expiryDate, err := parseDate(card.ExpiryDate)
+		if err != nil {
+			return nil, fmt.Errorf("card %s has an invalid expiry date: %v", cardID, err)
+		}
+		if cardValidUntil := expiryDate.AddDate(0, 0, 1); cardValidUntil.Before(validUntil) {
+			validUntil = cardValidUntil
+		}
+	}
+
+	return &eligibility.Claims{
+		CardID:     card.CardID,
+		Status:     card.Status,
+		CareClass:  entitledCareClass(card),
+		ValidFrom:  now.Unix(),
+		ValidUntil: validUntil.Unix(),
+		Issuer:     issuer,
+		IssuedAt:   now.Unix(),
+	}, nil
+}
+
+// ===== FAMILY GROUP FUNCTIONS =====
+
+// familyRelationships lists the relationships a dependent can have to the head of family
+var familyRelationships = map[string]bool{
+	"spouse": true,
+	"child":  true,
+	"parent": true,
+}
+
+// familyGroupKey returns the world state key of a family group
+func familyGroupKey(kkNumber string) string {
+	return "FAMILY_" + kkNumber
+}
+
+// validateKKNumber checks the Kartu Keluarga number format: 16 digits laid out like a NIK,
+// PPKKCC DDMMYY SSSS, with the region code and the issue date of the KK.
+func validateKKNumber(kkNumber string) error {
+	if len(kkNumber) != 16 {
+		return fmt.Errorf("KK number %s must be 16 digits, got %d characters", kkNumber, len(kkNumber))
+	}
+	for _, c := range kkNumber {
+		if c < '0' || c > '9' {
+			return fmt.Errorf("KK number %s must contain digits only", kkNumber)
+		}
+	}
+	if !nikProvinceCodes[kkNumber[0:2]] || kkNumber[2:4] == "00" || kkNumber[4:6] == "00" {
+		return fmt.Errorf("KK number %s has invalid region code %s", kkNumber, kkNumber[0:6])
+	}
+	day, _ := strconv.Atoi(kkNumber[6:8])
+	month, _ := strconv.Atoi(kkNumber[8:10])
+	if day < 1 || day > 31 || month < 1 || month > 12 {
+		return fmt.Errorf("KK number %s has invalid issue date digits %s", kkNumber, kkNumber[6:12])
+	}
+	return nil
+}
+
+// CreateFamilyGroup creates a family group for a KK number with the given card as head of family
+func (s *BPJSSmartContract) CreateFamilyGroup(ctx contractapi.TransactionContextInterface,
+	kkNumber string, headCardID string) error {
+
+	if err := validateKKNumber(kkNumber); err != nil {
+		return err
+	}
+
+	existing, err := ctx.GetStub().GetState(familyGroupKey(kkNumber))
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("family group %s already exists", kkNumber)
+	}
+
+	head, err := s.VerifyCard(ctx, headCardID)
+	if err != nil {
+		return fmt.Errorf("card verification failed: %v", err)
+	}
+	if err := s.ensureNotInFamilyGroup(ctx, headCardID); err != nil {
+		return err
+	}
+
+	creator, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get creator identity: %v", err)
+	}
+
+	group := FamilyGroup{
+		KKNumber:           kkNumber,
+		HeadCardID:         headCardID,
+		ContributionStatus: "current",
+		CreatedBy:          creator,
+	}
+	s.appendFamilyMember(ctx, &group, head, "head")
+
+	if err := s.putFamilyGroup(ctx, &group); err != nil {
+		return err
+	}
+	if err := s.putFamilyMemberIndex(ctx, headCardID, kkNumber); err != nil {
+		return err
+	}
+
+	ctx.GetStub().SetEvent("FamilyGroupCreated", []byte(fmt.Sprintf("Family group %s created with head %s", kkNumber, head.PatientName)))
+
+	return s.createAuditLog(ctx, "CreateFamilyGroup", "family", kkNumber, creator, "BPJS_ADMIN",
+		fmt.Sprintf("Created family group with head of family %s", head.PatientName))
+}
+
+// AddFamilyMember links a card to a family group as a dependent
+func (s *BPJSSmartContract) AddFamilyMember(ctx contractapi.TransactionContextInterface,
+	kkNumber string, cardID string, relationship string) error {
+
+	group, err := s.GetFamilyGroup(ctx, kkNumber)
+	if err != nil {
+		return err
+	}
+	if !familyRelationships[relationship] {
+		return fmt.Errorf("invalid relationship %s, must be spouse, child or parent", relationship)
+	}
+
+	card, err := s.VerifyCard(ctx, cardID)
+	if err != nil {
+		return fmt.Errorf("card verification failed: %v", err)
+	}
+	if err := s.ensureNotInFamilyGroup(ctx, cardID); err != nil {
+		return err
+	}
+
+	s.appendFamilyMember(ctx, group, card, relationship)
+	if err := s.putFamilyGroup(ctx, group); err != nil {
+		return err
+	}
+	if err := s.putFamilyMemberIndex(ctx, cardID, kkNumber); err != nil {
+		return err
+	}
+
+	actor, _ := ctx.GetClientIdentity().GetID()
+	return s.createAuditLog(ctx, "AddFamilyMember", "family", kkNumber, actor, "BPJS_ADMIN",
+		fmt.Sprintf("Added %s as %s", card.PatientName, relationship))
+}
+
+// RemoveFamilyMember unlinks a card from a family group
+func (s *BPJSSmartContract) RemoveFamilyMember(ctx contractapi.TransactionContextInterface,
+	kkNumber string, cardID string, reason string) error {
+
+	group, err := s.GetFamilyGroup(ctx, kkNumber)
+	if err != nil {
+		return err
+	}
+
+	member, err := s.removeFamilyMember(ctx, group, cardID)
+	if err != nil {
+		return err
+	}
+	if err := s.putFamilyGroup(ctx, group); err != nil {
+		return err
+	}
+
+	actor, _ := ctx.GetClientIdentity().GetID()
+	return s.createAuditLog(ctx, "RemoveFamilyMember", "family", kkNumber, actor, "BPJS_ADMIN",
+		fmt.Sprintf("Removed %s (%s). Reason: %s", member.PatientName, member.Relationship, reason))
+}
+
+// TransferFamilyMember moves a dependent's card from one family group to another
+func (s *BPJSSmartContract) TransferFamilyMember(ctx contractapi.TransactionContextInterface,
+	fromKKNumber string, toKKNumber string, cardID string, relationship string) error {
+
+	if fromKKNumber == toKKNumber {
+		return fmt.Errorf("source and destination family groups are the same")
+	}
+	if !familyRelationships[relationship] {
+		return fmt.Errorf("invalid relationship %s, must be spouse, child or parent", relationship)
+	}
+
+	fromGroup, err := s.GetFamilyGroup(ctx, fromKKNumber)
+	if err != nil {
+		return err
+	}
+	toGroup, err := s.GetFamilyGroup(ctx, toKKNumber)
+	if err != nil {
+		return err
+	}
+
+	card, err := s.VerifyCard(ctx, cardID)
+	if err != nil {
+		return fmt.Errorf("card verification failed: %v", err)
+	}
+
+	if _, err := s.removeFamilyMember(ctx, fromGroup, cardID); err != nil {
+		return err
+	}
+	s.appendFamilyMember(ctx, toGroup, card, relationship)
+
+	if err := s.putFamilyGroup(ctx, fromGroup); err != nil {
+		return err
+	}
+	if err := s.putFamilyGroup(ctx, toGroup); err != nil {
+		return err
+	}
+	if err := s.putFamilyMemberIndex(ctx, cardID, toKKNumber); err != nil {
+		return err
+	}
+
+	actor, _ := ctx.GetClientIdentity().GetID()
+	return s.createAuditLog(ctx, "TransferFamilyMember", "family", toKKNumber, actor, "BPJS_ADMIN",
+		fmt.Sprintf("Transferred %s from family group %s as %s", card.PatientName, fromKKNumber, relationship))
+}
+
+// GetFamilyGroup retrieves a family group by KK number
+func (s *BPJSSmartContract) GetFamilyGroup(ctx contractapi.TransactionContextInterface,
+	kkNumber string) (*FamilyGroup, error) {
+
+	groupJSON, err := ctx.GetStub().GetState(familyGroupKey(kkNumber))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if groupJSON == nil {
+		return nil, fmt.Errorf("family group %s not found", kkNumber)
+	}
+
+	var group FamilyGroup
+	err = json.Unmarshal(groupJSON, &group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal family group: %v", err)
+	}
+
+	return &group, nil
+}
+
+// GetFamilyGroupByCard retrieves the family group a card belongs to
+func (s *BPJSSmartContract) GetFamilyGroupByCard(ctx contractapi.TransactionContextInterface,
+	cardID string) (*FamilyGroup, error) {
+
+	kkNumber, err := s.getFamilyGroupOfCard(ctx, cardID)
+	if err != nil {
+		return nil, err
+	}
+	if kkNumber == "" {
+		return nil, fmt.Errorf("card %s is not a member of any family group", cardID)
+	}
+
+	return s.GetFamilyGroup(ctx, kkNumber)
+}
+
+// getFamilyGroupOfCard returns the KK number linked to a card through the
+// cardID~kkNumber index, or an empty string if the card has no family group
+func (s *BPJSSmartContract) getFamilyGroupOfCard(ctx contractapi.TransactionContextInterface,
+	cardID string) (string, error) {
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("cardID~kkNumber", []string{cardID})
+	if err != nil {
+		return "", fmt.Errorf("failed to query family index: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	if !resultsIterator.HasNext() {
+		return "", nil
+	}
+	response, err := resultsIterator.Next()
+	if err != nil {
+		return "", err
+	}
+	_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(response.Key)
+	if err != nil {
+		return "", err
+	}
+
+	return compositeKeyParts[1], nil
+}
+
+// ensureNotInFamilyGroup rejects cards that already belong to a family group
+func (s *BPJSSmartContract) ensureNotInFamilyGroup(ctx contractapi.TransactionContextInterface,
+	cardID string) error {
+
+	kkNumber, err := s.getFamilyGroupOfCard(ctx, cardID)
+	if err != nil {
+		return err
+	}
+	if kkNumber != "" {
+		return fmt.Errorf("card %s is already a member of family group %s", cardID, kkNumber)
+	}
+	return nil
+}
+
+// appendFamilyMember adds a card to the group's member list
+func (s *BPJSSmartContract) appendFamilyMember(ctx contractapi.TransactionContextInterface,
+	group *FamilyGroup, card *BPJSCard, relationship string) {
+
+	group.Members = append(group.Members, FamilyMember{
+		CardID:       card.CardID,
+		PatientID:    card.PatientID,
+		PatientName:  card.PatientName,
+		Relationship: relationship,
+		JoinedDate:   getTxTimestamp(ctx).Format("2006-01-02"),
+	})
+}
+
+// removeFamilyMember drops a card from the group's member list and deletes its
+// index entry. The head of family can only leave a group with no dependents.
+func (s *BPJSSmartContract) removeFamilyMember(ctx contractapi.TransactionContextInterface,
+	group *FamilyGroup, cardID string) (*FamilyMember, error) {
+
+	for i, member := range group.Members {
+		if member.CardID != cardID {
+			continue
+		}
+		if member.Relationship == "head" && len(group.Members) > 1 {
+			return nil, fmt.Errorf("head of family %s cannot leave family group %s while it has dependents",
+				cardID, group.KKNumber)
+		}
+
+		if err := s.dropFamilyMember(ctx, group, i); err != nil {
+			return nil, err
+		}
+		return &member, nil
+	}
+
+	return nil, fmt.Errorf("card %s is not a member of family group %s", cardID, group.KKNumber)
+}
+
+// removeDeceasedFamilyMember drops a deceased member from the group. If the head of family
+// died, the spouse becomes head, or the longest-standing remaining member if there is none.
+func (s *BPJSSmartContract) removeDeceasedFamilyMember(ctx contractapi.TransactionContextInterface,
+	group *FamilyGroup, cardID string) error {
+
+	for i, member := range group.Members {
+		if member.CardID != cardID {
+			continue
+		}
+		if err := s.dropFamilyMember(ctx, group, i); err != nil {
+			return err
+		}
+		if member.Relationship != "head" || len(group.Members) == 0 {
+			return nil
+		}
+
+		successor := 0
+		for j := range group.Members {
+			if group.Members[j].Relationship == "spouse" {
+				successor = j
+				break
+			}
+		}
+		group.Members[successor].Relationship = "head"
+		group.HeadCardID = group.Members[successor].CardID
+		return nil
+	}
+
+	return fmt.Errorf("card %s is not a member of family group %s", cardID, group.KKNumber)
+}
+
+// dropFamilyMember removes the member at index i from the group and deletes its index entry
+func (s *BPJSSmartContract) dropFamilyMember(ctx contractapi.TransactionContextInterface,
+	group *FamilyGroup, i int) error {
+
+	cardID := group.Members[i].CardID
+	if group.Members[i].Relationship == "head" {
+		group.HeadCardID = ""
+	}
+	group.Members = append(group.Members[:i], group.Members[i+1:]...)
+
+	indexKey, err := ctx.GetStub().CreateCompositeKey("cardID~kkNumber", []string{cardID, group.KKNumber})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(indexKey)
+}
+
+// replaceFamilyMemberCard points a family member at the card that replaced their old card
+func (s *BPJSSmartContract) replaceFamilyMemberCard(ctx contractapi.TransactionContextInterface,
+	kkNumber string, oldCardID string, newCardID string) error {
+
+	group, err := s.GetFamilyGroup(ctx, kkNumber)
+	if err != nil {
+		return err
+	}
+	for i := range group.Members {
+		if group.Members[i].CardID == oldCardID {
+			group.Members[i].CardID = newCardID
+		}
+	}
+	if group.HeadCardID == oldCardID {
+		group.HeadCardID = newCardID
+	}
+	if err := s.putFamilyGroup(ctx, group); err != nil {
+		return err
+	}
+
+	oldIndexKey, err := ctx.GetStub().CreateCompositeKey("cardID~kkNumber", []string{oldCardID, kkNumber})
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().DelState(oldIndexKey); err != nil {
+		return err
+	}
+	return s.putFamilyMemberIndex(ctx, newCardID, kkNumber)
+}
+
+// putFamilyGroup writes a family group to the world state. A group whose last member has
+// left is deleted, so no group is left without a head of family.
+func (s *BPJSSmartContract) putFamilyGroup(ctx contractapi.TransactionContextInterface, group *FamilyGroup) error {
+	if len(group.Members) == 0 {
+		return ctx.GetStub().DelState(familyGroupKey(group.KKNumber))
+	}
+	group.Timestamp = getTxTimestamp(ctx)
+
+	groupJSON, err := json.Marshal(group)
+	if err != nil {
+		return fmt.Errorf("failed to marshal family group: %v", err)
+	}
+	return ctx.GetStub().PutState(familyGroupKey(group.KKNumber), groupJSON)
+}
+
+// putFamilyMemberIndex links a card to its family group for lookups by card
+func (s *BPJSSmartContract) putFamilyMemberIndex(ctx contractapi.TransactionContextInterface,
+	cardID string, kkNumber string) error {
+
+	indexKey, err := ctx.GetStub().CreateCompositeKey("cardID~kkNumber", []string{cardID, kkNumber})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(indexKey, []byte{0x00})
+}
+
+// ===== CONTRIBUTION (IURAN) FUNCTIONS =====
+
+// contributionPaymentKey returns the world state key of a card's payment for a month
+func contributionPaymentKey(cardID string, period string) string {
+	return "IURAN_" + cardID + "_" + period
+}
+
+// RecordContributionPayment records a member's contribution payment for one month (YYYY-MM)
+func (s *BPJSSmartContract) RecordContributionPayment(ctx contractapi.TransactionContextInterface,
+	paymentID string, cardID string, period string, amount float64,
+	paymentDate string, paymentChannel string) error {
+
+	if _, err := time.Parse("2006-01", period); err != nil {
+		return fmt.Errorf("invalid period %q, expected YYYY-MM", period)
+	}
+	if _, err := parseDate(paymentDate); err != nil {
+		return err
+	}
+	if amount <= 0 {
+		return fmt.Errorf("payment amount must be positive")
+	}
+
+	cardJSON, err := ctx.GetStub().GetState(cardKey(cardID))
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if cardJSON == nil {
+		return fmt.Errorf("card %s not found", cardID)
+	}
+
+	var card BPJSCard
+	err = json.Unmarshal(cardJSON, &card)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal card: %v", err)
+	}
+
+	key := contributionPaymentKey(cardID, period)
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("contribution for card %s period %s already recorded", cardID, period)
+	}
+
+	recorder, _ := ctx.GetClientIdentity().GetID()
+
+	payment := ContributionPayment{
+		PaymentID:      paymentID,
+		CardID:         cardID,
+		PatientID:      card.PatientID,
+		Period:         period,
+		Amount:         amount,
+		PaymentDate:    paymentDate,
+		PaymentChannel: paymentChannel,
+		RecordedBy:     recorder,
+		Timestamp:      getTxTimestamp(ctx),
+	}
+
+	paymentJSON, err := json.Marshal(payment)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payment: %v", err)
+	}
+	err = ctx.GetStub().PutState(key, paymentJSON)
+	if err != nil {
+		return err
+	}
+
+	// Create index for querying payments by card
+	indexKey, err := ctx.GetStub().CreateCompositeKey("cardID~period", []string{cardID, period})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(indexKey, []byte{0x00})
+	if err != nil {
+		return err
+	}
+
+	if err := s.clearFamilyArrears(ctx, cardID, period); err != nil {
+		return err
+	}
+
+	ctx.GetStub().SetEvent("ContributionPaid", []byte(fmt.Sprintf("Contribution %s paid for card %s", period, cardID)))
+
+	return s.createAuditLog(ctx, "RecordContributionPayment", "contribution", key, recorder, "BPJS_FINANCE",
+		fmt.Sprintf("Recorded contribution of %.2f for %s", amount, period))
+}
+
+// GetContributionPayments retrieves all contribution payments of a card, oldest period first
+func (s *BPJSSmartContract) GetContributionPayments(ctx contractapi.TransactionContextInterface,
+	cardID string) ([]*ContributionPayment, error) {
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("cardID~period", []string{cardID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var payments []*ContributionPayment
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(response.Key)
+		if err != nil {
+			continue
+		}
+		period := compositeKeyParts[1]
+
+		paymentJSON, err := ctx.GetStub().GetState(contributionPaymentKey(cardID, period))
+		if err != nil || paymentJSON == nil {
+			continue
+		}
+
+		var payment ContributionPayment
+		json.Unmarshal(paymentJSON, &payment)
+		payments = append(payments, &payment)
+	}
+
+	return payments, nil
+}
+
+// clearFamilyArrears marks the family group of a card current again once no member has unpaid
+// months. paidPeriod is the payment just recorded for the card, which GetState does not see yet.
+func (s *BPJSSmartContract) clearFamilyArrears(ctx contractapi.TransactionContextInterface,
+	cardID string, paidPeriod string) error {
+
+	kkNumber, err := s.getFamilyGroupOfCard(ctx, cardID)
+	if err != nil || kkNumber == "" {
+		return err
+	}
+	group, err := s.GetFamilyGroup(ctx, kkNumber)
+	if err != nil {
+		return err
+	}
+	if group.ContributionStatus != "arrears" {
+		return nil
+	}
+
+	for _, member := range group.Members {
+		arrears, err := s.GetContributionArrears(ctx, member.CardID)
+		if err != nil {
+			return err
+		}
+		for _, period := range arrears.UnpaidMonths {
+			if member.CardID != cardID || period != paidPeriod {
+				return nil
+			}
+		}
+	}
+
+	group.ContributionStatus = "current"
+	return s.putFamilyGroup(ctx, group)
+}
+
+// GetContributionArrears calculates the unpaid months of a card. Every month from the start
+// of the membership up to the month before the transaction date is due, counting payments
+// made for earlier cards the card replaced. PBI members owe nothing, the state pays for them.
+func (s *BPJSSmartContract) GetContributionArrears(ctx contractapi.TransactionContextInterface,
+	cardID string) (*ContributionArrears, error) {
+
+	cardJSON, err := ctx.GetStub().GetState(cardKey(cardID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if cardJSON == nil {
+		return nil, fmt.Errorf("card %s not found", cardID)
+	}
+
+	var card BPJSCard
+	err = json.Unmarshal(cardJSON, &card)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal card: %v", err)
+	}
+
+	return s.calculateArrears(ctx, &card)
+}
+
+// calculateArrears lists the due months without a recorded payment
+func (s *BPJSSmartContract) calculateArrears(ctx contractapi.TransactionContextInterface,
+	card *BPJSCard) (*ContributionArrears, error) {
+
+	txTime := getTxTimestamp(ctx)
+	arrears := &ContributionArrears{
+		CardID:       card.CardID,
+		AsOf:         txTime.Format("2006-01-02"),
+		UnpaidMonths: []string{},
+	}
+
+	if isSubsidizedSegment(card.CardType) {
+		return arrears, nil
+	}
+
+	chain, err := s.getCardChain(ctx, card.CardID)
+	if err != nil {
+		return nil, err
+	}
+	start := membershipStartDate(chain[0])
+	// Months spent in a PBI segment were paid by the state
+	for _, change := range card.SegmentHistory {
+		if isSubsidizedSegment(change.FromSegment) && change.EffectiveDate > start {
+			start = change.EffectiveDate
+		}
+	}
+	if start == "" {
+		return arrears, nil
+	}
+	startDate, err := parseDate(start)
+	if err != nil {
+		return nil, fmt.Errorf("card %s has an invalid start date: %v", card.CardID, err)
+	}
+
+	paid := make(map[string]bool)
+	for _, chainCard := range chain {
+		payments, err := s.GetContributionPayments(ctx, chainCard.CardID)
+		if err != nil {
+			return nil, err
+		}
+		for _, payment := range payments {
+			paid[payment.Period] = true
+		}
+	}
+
+	currentMonth := time.Date(txTime.Year(), txTime.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for month := time.Date(startDate.Year(), startDate.Month(), 1, 0, 0, 0, 0, time.UTC); month.Before(currentMonth); month = month.AddDate(0, 1, 0) {
+		period := month.Format("2006-01")
+		if !paid[period] {
+			arrears.UnpaidMonths = append(arrears.UnpaidMonths, period)
+		}
+	}
+	arrears.UnpaidMonthCount = len(arrears.UnpaidMonths)
+
+	return arrears, nil
+}
+
+// membershipStartDate returns the start of a card's first validity period. Renewals move
+// ValidFrom but keep the earlier periods in the validity history.
+func membershipStartDate(card *BPJSCard) string {
+	if len(card.ValidityHistory) > 0 {
+		return card.ValidityHistory[0].ValidFrom
+	}
+	if card.ValidFrom != "" {
+		return card.ValidFrom
+	}
+	return card.IssueDate
+}
+
+// SuspendCardsInArrears suspends every active card with more than maxUnpaidMonths unpaid
+// months and returns the IDs of the suspended cards. PBI cards are never suspended for arrears.
+func (s *BPJSSmartContract) SuspendCardsInArrears(ctx contractapi.TransactionContextInterface,
+	maxUnpaidMonths int) ([]string, error) {
+
+	if maxUnpaidMonths < 0 {
+		return nil, fmt.Errorf("maxUnpaidMonths must not be negative")
+	}
+
+	cards, err := s.GetAllCards(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	actor, _ := ctx.GetClientIdentity().GetID()
+	suspended := []string{}
+	for _, card := range cards {
+		if card.Status != CardStatusActive || isSubsidizedSegment(card.CardType) {
+			continue
+		}
+
+		arrears, err := s.calculateArrears(ctx, card)
+		if err != nil {
+			return nil, err
+		}
+		if arrears.UnpaidMonthCount <= maxUnpaidMonths {
+			continue
+		}
+
+		oldStatus, err := applyCardStatusTransition(ctx, card, CardStatusSuspended, "CONTRIBUTION_ARREARS")
+		if err != nil {
+			return nil, err
+		}
+		cardJSON, err := json.Marshal(card)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal card: %v", err)
+		}
+		if err := ctx.GetStub().PutState(cardKey(card.CardID), cardJSON); err != nil {
+			return nil, err
+		}
+
+		kkNumber, err := s.getFamilyGroupOfCard(ctx, card.CardID)
+		if err != nil {
+			return nil, err
+		}
+		if kkNumber != "" {
+			group, err := s.GetFamilyGroup(ctx, kkNumber)
+			if err != nil {
+				return nil, err
+			}
+			group.ContributionStatus = "arrears"
+			if err := s.putFamilyGroup(ctx, group); err != nil {
+				return nil, err
+			}
+		}
+
+		err = s.createStateChangeAuditLog(ctx, "SuspendCardsInArrears", "card", card.CardID, actor, "BPJS_FINANCE",
+			oldStatus, CardStatusSuspended, "CONTRIBUTION_ARREARS",
+			fmt.Sprintf("Suspended for %d unpaid months", arrears.UnpaidMonthCount))
+		if err != nil {
+			return nil, err
+		}
+		suspended = append(suspended, card.CardID)
+	}
+
+	if len(suspended) > 0 {
+		ctx.GetStub().SetEvent("CardsSuspendedForArrears", []byte(fmt.Sprintf("%d cards suspended for arrears", len(suspended))))
+	}
+
+	return suspended, nil
+}
+
+// ===== PARTICIPANT SEGMENT FUNCTIONS =====
+
+// participantSegments maps each JKN participant segment to its funding source
+var participantSegments = map[string]string{
+	"PBI-APBN": "APBN",              // contribution assistance recipients funded by the state budget
+	"PBI-APBD": "APBD",              // contribution assistance recipients funded by the regional budget
+	"PPU":      "EMPLOYER_EMPLOYEE", // wage earners, shared by employer and employee
+	"PBPU":     "SELF",              // non-wage earners paying their own contribution
+	"BP":       "SELF",              // non-workers (investors, employers, pensioners)
+}
+
+// legacyPBICardType is the card type of government-funded members on cards issued before
+// participant segments were introduced. Those cards never took a place from a regional quota.
+const legacyPBICardType = "PBI"
+
+// isSubsidizedSegment reports whether a segment, or legacy card type, is government funded
+func isSubsidizedSegment(segment string) bool {
+	return hasSubsidyQuota(segment) || segment == legacyPBICardType
+}
+
+// hasSubsidyQuota reports whether a segment is subject to a regional quota
+func hasSubsidyQuota(segment string) bool {
+	return segment == "PBI-APBN" || segment == "PBI-APBD"
+}
+
+// regionCodeFromNIK returns the regency/city code embedded in the first four digits of a NIK
+func regionCodeFromNIK(nik string) string {
+	if len(nik) < 4 {
+		return ""
+	}
+	return nik[:4]
+}
+
+// subsidyQuotaKey returns the world state key of a segment's quota in a region
+func subsidyQuotaKey(segment string, regionCode string) string {
+	return "QUOTA_" + segment + "_" + regionCode
+}
+
+// SetSubsidyQuota sets the number of government-funded members a region may enrol in a PBI segment
+func (s *BPJSSmartContract) SetSubsidyQuota(ctx contractapi.TransactionContextInterface,
+	segment string, regionCode string, quota int) error {
+
+	if !hasSubsidyQuota(segment) {
+		return fmt.Errorf("segment %s is not government funded", segment)
+	}
+	if quota < 0 {
+		return fmt.Errorf("quota must not be negative")
+	}
+
+	actor, _ := ctx.GetClientIdentity().GetID()
+
+	subsidyQuota, err := s.getSubsidyQuota(ctx, segment, regionCode)
+	if err != nil {
+		return err
+	}
+	if subsidyQuota == nil {
+		subsidyQuota = &SubsidyQuota{
+			Segment:       segment,
+			RegionCode:    regionCode,
+			FundingSource: participantSegments[segment],
+		}
+	}
+	if quota < subsidyQuota.Used {
+		return fmt.Errorf("quota %d is below the %d members already enrolled", quota, subsidyQuota.Used)
+	}
+
+	oldQuota := subsidyQuota.Quota
+	subsidyQuota.Quota = quota
+	subsidyQuota.UpdatedBy = actor
+	if err := s.putSubsidyQuota(ctx, subsidyQuota); err != nil {
+		return err
+	}
+
+	return s.createAuditLog(ctx, "SetSubsidyQuota", "quota", subsidyQuotaKey(segment, regionCode), actor, "BPJS_ADMIN",
+		fmt.Sprintf("Quota for %s in region %s changed from %d to %d", segment, regionCode, oldQuota, quota))
+}
+
+// GetSubsidyQuota retrieves the quota of a PBI segment in a region
+func (s *BPJSSmartContract) GetSubsidyQuota(ctx contractapi.TransactionContextInterface,
+	segment string, regionCode string) (*SubsidyQuota, error) {
+
+	subsidyQuota, err := s.getSubsidyQuota(ctx, segment, regionCode)
+	if err != nil {
+		return nil, err
+	}
+	if subsidyQuota == nil {
+		return nil, fmt.Errorf("no %s quota for region %s", segment, regionCode)
+	}
+	return subsidyQuota, nil
+}
+
+// ChangeSegment moves a member to another participant segment as of effectiveDate.
+// The effective date cannot be in the future or before the current segment took effect.
+func (s *BPJSSmartContract) ChangeSegment(ctx contractapi.TransactionContextInterface,
+	cardID string, newSegment string, effectiveDate string, reason string) error {
+
+	cardJSON, err := ctx.GetStub().GetState(cardKey(cardID))
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if cardJSON == nil {
+		return fmt.Errorf("card %s not found", cardID)
+	}
+
+	var card BPJSCard
+	err = json.Unmarshal(cardJSON, &card)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal card: %v", err)
+	}
+
+	if card.Status != CardStatusActive && card.Status != CardStatusSuspended {
+		return fmt.Errorf("card %s with status %s cannot change segment", cardID, card.Status)
+	}
+	if _, ok := participantSegments[newSegment]; !ok {
+		return fmt.Errorf("invalid segment %s, must be PBI-APBN, PBI-APBD, PPU, PBPU or BP", newSegment)
+	}
+	if newSegment == card.CardType {
+		return fmt.Errorf("card %s is already in segment %s", cardID, newSegment)
+	}
+	if _, err := parseDate(effectiveDate); err != nil {
+		return err
+	}
+	if effectiveDate > getTxTimestamp(ctx).Format("2006-01-02") {
+		return fmt.Errorf("effective date %s is in the future", effectiveDate)
+	}
+	if effectiveDate < card.SegmentEffectiveDate {
+		return fmt.Errorf("effective date %s is before the current segment took effect on %s",
+			effectiveDate, card.SegmentEffectiveDate)
+	}
+
+	if hasSubsidyQuota(card.CardType) {
+		if err := s.releaseSubsidyQuota(ctx, card.CardType, card.RegionCode); err != nil {
+			return err
+		}
+	}
+	if hasSubsidyQuota(newSegment) {
+		if err := s.reserveSubsidyQuota(ctx, newSegment, card.RegionCode); err != nil {
+			return err
+		}
+	}
+
+	actor, _ := ctx.GetClientIdentity().GetID()
+
+	oldSegment := card.CardType
+	card.SegmentHistory = append(card.SegmentHistory, SegmentChange{
+		FromSegment:   oldSegment,
+		ToSegment:     newSegment,
+		EffectiveDate: effectiveDate,
+		Reason:        reason,
+		ChangedBy:     actor,
+	})
+	card.CardType = newSegment
+	card.FundingSource = participantSegments[newSegment]
+	if isSubsidizedSegment(newSegment) && entitledCareClass(&card) != "3" {
+		card.CareClass = "3"
+		card.CareClassSince = effectiveDate
+	}
+	card.SegmentEffectiveDate = effectiveDate
+	card.Timestamp = getTxTimestamp(ctx)
+
+	updatedJSON, err := json.Marshal(card)
+	if err != nil {
+		return fmt.Errorf("failed to marshal card: %v", err)
+	}
+	err = ctx.GetStub().PutState(cardKey(cardID), updatedJSON)
+	if err != nil {
+		return err
+	}
+
+	ctx.GetStub().SetEvent("SegmentChanged", []byte(fmt.Sprintf("Card %s moved from %s to %s", cardID, oldSegment, newSegment)))
+
+	return s.createStateChangeAuditLog(ctx, "ChangeSegment", "card", cardID, actor, "BPJS_ADMIN",
+		oldSegment, newSegment, "",
+		fmt.Sprintf("Segment changed from %s to %s effective %s. Reason: %s", oldSegment, newSegment, effectiveDate, reason))
+}
+
+// reserveSubsidyQuota takes one place from a region's PBI quota
+func (s *BPJSSmartContract) reserveSubsidyQuota(ctx contractapi.TransactionContextInterface,
+	segment string, regionCode string) error {
+
+	subsidyQuota, err := s.getSubsidyQuota(ctx, segment, regionCode)
+	if err != nil {
+		return err
+	}
+	if subsidyQuota == nil {
+		return fmt.Errorf("no %s quota for region %s", segment, regionCode)
+	}
+	if subsidyQuota.Used >= subsidyQuota.Quota {
+		return fmt.Errorf("%s quota for region %s is exhausted (%d of %d used)",
+			segment, regionCode, subsidyQuota.Used, subsidyQuota.Quota)
+	}
+
+	subsidyQuota.Used++
+	return s.putSubsidyQuota(ctx, subsidyQuota)
+}
+
+// releaseSubsidyQuota returns one place to a region's PBI quota
+func (s *BPJSSmartContract) releaseSubsidyQuota(ctx contractapi.TransactionContextInterface,
+	segment string, regionCode string) error {
+
+	subsidyQuota, err := s.getSubsidyQuota(ctx, segment, regionCode)
+	if err != nil {
+		return err
+	}
+	if subsidyQuota == nil || subsidyQuota.Used == 0 {
+		return nil
+	}
+
+	subsidyQuota.Used--
+	return s.putSubsidyQuota(ctx, subsidyQuota)
+}
+
+// isMembershipStatus reports whether a card in the status is still part of the membership.
+// Inactive, deceased and replaced cards have left it.
+func isMembershipStatus(status string) bool {
+	return status != CardStatusInactive && status != CardStatusDeceased && status != CardStatusReplaced
+}
+
+// updateSubsidyQuotaPlace releases the PBI quota place of a card that left the membership
+// (inactive, deceased, replaced without a new card) and takes it again when the card is reinstated
+func (s *BPJSSmartContract) updateSubsidyQuotaPlace(ctx contractapi.TransactionContextInterface,
+	card *BPJSCard, oldStatus string) error {
+
+	if !hasSubsidyQuota(card.CardType) {
+		return nil
+	}
+	switch {
+	case isMembershipStatus(oldStatus) && !isMembershipStatus(card.Status):
+		return s.releaseSubsidyQuota(ctx, card.CardType, card.RegionCode)
+	case !isMembershipStatus(oldStatus) && isMembershipStatus(card.Status):
+		return s.reserveSubsidyQuota(ctx, card.CardType, card.RegionCode)
+	}
+	return nil
+}
+
+// getSubsidyQuota reads a quota, returning nil if none has been set
+func (s *BPJSSmartContract) getSubsidyQuota(ctx contractapi.TransactionContextInterface,
+	segment string, regionCode string) (*SubsidyQuota, error) {
+
+	quotaJSON, err := ctx.GetStub().GetState(subsidyQuotaKey(segment, regionCode))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if quotaJSON == nil {
+		return nil, nil
+	}
+
+	var subsidyQuota SubsidyQuota
+	err = json.Unmarshal(quotaJSON, &subsidyQuota)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal quota: %v", err)
+	}
+	return &subsidyQuota, nil
+}
+
+// putSubsidyQuota writes a quota to the world state
+func (s *BPJSSmartContract) putSubsidyQuota(ctx contractapi.TransactionContextInterface,
+	subsidyQuota *SubsidyQuota) error {
+
+	subsidyQuota.Timestamp = getTxTimestamp(ctx)
+
+	quotaJSON, err := json.Marshal(subsidyQuota)
+	if err != nil {
+		return fmt.Errorf("failed to marshal quota: %v", err)
+	}
+	return ctx.GetStub().PutState(subsidyQuotaKey(subsidyQuota.Segment, subsidyQuota.RegionCode), quotaJSON)
+}
+
+// ===== CARE CLASS FUNCTIONS =====
+
+// careClassMinHoldingMonths is how long a member must stay in a care class before changing it again
+const careClassMinHoldingMonths = 12
+
+// careClassTariffFactors gives the INA-CBG inpatient tariff of each care class relative to class 3
+var careClassTariffFactors = map[string]float64{
+	"1": 1.4,
+	"2": 1.2,
+	"3": 1.0,
+}
+
+// entitledCareClass returns the care class a card is entitled to. Cards issued before
+// care classes were recorded are treated as class 3.
+func entitledCareClass(card *BPJSCard) string {
+	if card.CareClass == "" {
+		return "3"
+	}
+	return card.CareClass
+}
+
+// splitCoPayment splits an inpatient claim amount billed at roomClass into the part covered
+// at the member's entitled class and the patient's co-payment (iur biaya) for the upgrade
+func splitCoPayment(claimAmount float64, roomClass string, entitledClass string) (float64, float64) {
+	if roomClass >= entitledClass {
+		// Same class or a lower class than entitled: fully covered
+		return claimAmount, 0
+	}
+	covered := claimAmount * careClassTariffFactors[entitledClass] / careClassTariffFactors[roomClass]
+	return covered, claimAmount - covered
+}
+
+// ChangeCareClass moves a member to another care class. PBI members are fixed at class 3,
+// and a class must be held for careClassMinHoldingMonths before it can be changed again.
+func (s *BPJSSmartContract) ChangeCareClass(ctx contractapi.TransactionContextInterface,
+	cardID string, newClass string, reason string) error {
+
+	card, err := s.VerifyCard(ctx, cardID)
+	if err != nil {
+		return fmt.Errorf("card verification failed: %v", err)
+	}
+
+	if _, ok := careClassTariffFactors[newClass]; !ok {
+		return fmt.Errorf("invalid care class %s, must be 1, 2 or 3", newClass)
+	}
+	if isSubsidizedSegment(card.CardType) {
+		return fmt.Errorf("%s members are fixed at care class 3", card.CardType)
+	}
+	oldClass := entitledCareClass(card)
+	if newClass == oldClass {
+		return fmt.Errorf("card %s is already in care class %s", cardID, newClass)
+	}
+
+	txDate := getTxTimestamp(ctx).Format("2006-01-02")
+	if card.CareClassSince != "" {
+		since, err := parseDate(card.CareClassSince)
+		if err != nil {
+			return fmt.Errorf("card %s has an invalid care class date: %v", cardID, err)
+		}
+		allowedFrom := since.AddDate(0, careClassMinHoldingMonths, 0).Format("2006-01-02")
+		if txDate < allowedFrom {
+			return fmt.Errorf("care class %s held since %s cannot be changed before %s",
+				oldClass, card.CareClassSince, allowedFrom)
+		}
+	}
+
+	card.CareClass = newClass
+	card.CareClassSince = txDate
+	card.Timestamp = getTxTimestamp(ctx)
+
+	updatedJSON, err := json.Marshal(card)
+	if err != nil {
+		return fmt.Errorf("failed to marshal card: %v", err)
+	}
+	err = ctx.GetStub().PutState(cardKey(cardID), updatedJSON)
+	if err != nil {
+		return err
+	}
+
+	actor, _ := ctx.GetClientIdentity().GetID()
+	return s.createStateChangeAuditLog(ctx, "ChangeCareClass", "card", cardID, actor, "BPJS_ADMIN",
+		oldClass, newClass, "",
+		fmt.Sprintf("Care class changed from %s to %s. Reason: %s", oldClass, newClass, reason))
+}
+
+// ===== FASKES REGISTRY FUNCTIONS =====
+
+// Facility types: first-level (puskesmas, klinik, dokter praktik) and advanced referral (hospital) care
+const (
+	FaskesTypeFKTP  = "FKTP"
+	FaskesTypeFKRTL = "FKRTL"
+)
+
+// hospitalClasses lists the Ministry of Health hospital classes
+var hospitalClasses = map[string]bool{"A": true, "B": true, "C": true, "D": true}
+
+// RegisterFaskes adds a contracted healthcare facility to the registry. Visits, referrals and
+// claims are only accepted for registered facilities with a running contract.
+func (s *BPJSSmartContract) RegisterFaskes(ctx contractapi.TransactionContextInterface,
+	faskesCode string, name string, faskesType string, hospitalClass string, regionCode string,
+	ownerMSP string, contractStart string, contractEnd string) error {
+
+	actor, err := requireBPJSOrg(ctx, "registering facilities")
+	if err != nil {
+		return err
+	}
+	if err := ensureKeyUnused(ctx, faskesKey(faskesCode), "faskes", faskesCode); err != nil {
+		return err
+	}
+	if name == "" || ownerMSP == "" {
+		return fmt.Errorf("facility name and owning MSP are required")
+	}
+
+	switch faskesType {
+	case FaskesTypeFKTP:
+		if hospitalClass != "" {
+			return fmt.Errorf("hospital class only applies to FKRTL facilities")
+		}
+	case FaskesTypeFKRTL:
+		if !hospitalClasses[hospitalClass] {
+			return fmt.Errorf("invalid hospital class %q, must be A, B, C or D", hospitalClass)
+		}
+	default:
+		return fmt.Errorf("invalid faskes type %q, must be FKTP or FKRTL", faskesType)
+	}
+
+	if len(regionCode) != 4 || !nikProvinceCodes[regionCode[:2]] {
+		return fmt.Errorf("invalid region code %q", regionCode)
+	}
+	if err := validateContractPeriod(contractStart, contractEnd); err != nil {
+		return err
+	}
+
+	faskes := Faskes{
+		FaskesCode:    faskesCode,
+		Name:          name,
+		Type:          faskesType,
+		HospitalClass: hospitalClass,
+		RegionCode:    regionCode,
+		OwnerMSP:      ownerMSP,
+		ContractStart: contractStart,
+		ContractEnd:   contractEnd,
+		RegisteredBy:  actor,
+	}
+	if err := s.putFaskes(ctx, &faskes); err != nil {
+		return err
+	}
+
+	ctx.GetStub().SetEvent("FaskesRegistered", []byte(fmt.Sprintf("Faskes %s (%s) registered", faskesCode, name)))
+
+	return s.createAuditLog(ctx, "RegisterFaskes", "faskes", faskesCode, actor, "BPJS_ADMIN",
+		fmt.Sprintf("Registered %s %s, contract %s to %s", faskesType, name, contractStart, contractEnd))
+}
+
+// RenewFaskesContract sets a new contract period for a registered facility. Ending the
+// contract early is done by renewing it with an end date in the past.
+func (s *BPJSSmartContract) RenewFaskesContract(ctx contractapi.TransactionContextInterface,
+	faskesCode string, contractStart string, contractEnd string) error {
+
+	actor, err := requireBPJSOrg(ctx, "renewing facility contracts")
+	if err != nil {
+		return err
+	}
+	faskes, err := s.getFaskes(ctx, faskesCode)
+	if err != nil {
+		return err
+	}
+	if err := validateContractPeriod(contractStart, contractEnd); err != nil {
+		return err
+	}
+
+	oldContractEnd := faskes.ContractEnd
+	faskes.ContractStart = contractStart
+	faskes.ContractEnd = contractEnd
+	if err := s.putFaskes(ctx, faskes); err != nil {
+		return err
+	}
+
+	return s.createStateChangeAuditLog(ctx, "RenewFaskesContract", "faskes", faskesCode, actor, "BPJS_ADMIN",
+		oldContractEnd, contractEnd, "",
+		fmt.Sprintf("Contract of %s set to %s to %s", faskes.Name, contractStart, contractEnd))
+}
+
+// GetFaskes returns a registered facility
+func (s *BPJSSmartContract) GetFaskes(ctx contractapi.TransactionContextInterface,
+	faskesCode string) (*Faskes, error) {
+
+	return s.getFaskes(ctx, faskesCode)
+}
+
+// validateContractPeriod checks a facility contract period
+func validateContractPeriod(contractStart string, contractEnd string) error {
+	if _, err := parseDate(contractStart); err != nil {
+		return fmt.Errorf("invalid contract start: %v", err)
+	}
+	if _, err := parseDate(contractEnd); err != nil {
+		return fmt.Errorf("invalid contract end: %v", err)
+	}
+	if contractEnd <= contractStart {
+		return fmt.Errorf("contract end %s must be after contract start %s", contractEnd, contractStart)
+	}
+	return nil
+}
+
+// resolveFaskes returns a registered facility with a contract running on the transaction date
+func (s *BPJSSmartContract) resolveFaskes(ctx contractapi.TransactionContextInterface,
+	faskesCode string) (*Faskes, error) {
+
+	faskes, err := s.getFaskes(ctx, faskesCode)
+	if err != nil {
+		return nil, err
+	}
+
+	txDate := getTxTimestamp(ctx).Format("2006-01-02")
+	if txDate < faskes.ContractStart {
+		return nil, fmt.Errorf("contract of faskes %s starts on %s", faskesCode, faskes.ContractStart)
+	}
+	if txDate > faskes.ContractEnd {
+		return nil, fmt.Errorf("contract of faskes %s expired on %s", faskesCode, faskes.ContractEnd)
+	}
+	return faskes, nil
+}
+
+// requireFaskesOwner rejects callers that do not transact for the facility. BPJS may act for any facility.
+func requireFaskesOwner(ctx contractapi.TransactionContextInterface, faskes *Faskes) error {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to get client organization: %v", err)
+	}
+	if mspID != faskes.OwnerMSP && mspID != bpjsMSPID {
+		return fmt.Errorf("faskes %s is operated by %s, not %s", faskes.FaskesCode, faskes.OwnerMSP, mspID)
+	}
+	return nil
+}
+
+// getFaskes reads a facility from the registry
+func (s *BPJSSmartContract) getFaskes(ctx contractapi.TransactionContextInterface,
+	faskesCode string) (*Faskes, error) {
+
+	faskesJSON, err := ctx.GetStub().GetState(faskesKey(faskesCode))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if faskesJSON == nil {
+		return nil, fmt.Errorf("faskes %s is not registered", faskesCode)
+	}
+
+	var faskes Faskes
+	err = json.Unmarshal(faskesJSON, &faskes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal faskes: %v", err)
+	}
+	return &faskes, nil
+}
+
+// putFaskes writes a facility to the registry
+func (s *BPJSSmartContract) putFaskes(ctx contractapi.TransactionContextInterface, faskes *Faskes) error {
+	faskes.Timestamp = getTxTimestamp(ctx)
+
+	faskesJSON, err := json.Marshal(faskes)
+	if err != nil {
+		return fmt.Errorf("failed to marshal faskes: %v", err)
+	}
+	return ctx.GetStub().PutState(faskesKey(faskes.FaskesCode), faskesJSON)
+}
+
+// ===== PRACTITIONER REGISTRY FUNCTIONS =====
+
+// maxPracticeLocations is the number of facilities a practitioner may hold a running SIP at
+const maxPracticeLocations = 3
+
+// RegisterPractitioner adds a practitioner to the registry. strValidUntil is empty for a
+// lifetime registration.
+func (s *BPJSSmartContract) RegisterPractitioner(ctx contractapi.TransactionContextInterface,
+	practitionerID string, name string, specialty string, strNumber string, strValidUntil string) error {
+
+	actor, err := requireBPJSOrg(ctx, "registering practitioners")
+	if err != nil {
+		return err
+	}
+	if err := ensureKeyUnused(ctx, practitionerKey(practitionerID), "practitioner", practitionerID); err != nil {
+		return err
+	}
+	if name == "" || strNumber == "" {
+		return fmt.Errorf("practitioner name and STR number are required")
+	}
+	if strValidUntil != "" {
+		if _, err := parseDate(strValidUntil); err != nil {
+			return fmt.Errorf("invalid STR validity: %v", err)
+		}
+	}
+
+	practitioner := Practitioner{
+		PractitionerID: practitionerID,
+		Name:           name,
+		Specialty:      specialty,
+		STRNumber:      strNumber,
+		STRValidUntil:  strValidUntil,
+		Licenses:       []PracticeLicense{},
+		RegisteredBy:   actor,
+	}
+	if err := s.putPractitioner(ctx, &practitioner); err != nil {
+		return err
+	}
+
+	ctx.GetStub().SetEvent("PractitionerRegistered", []byte(fmt.Sprintf("Practitioner %s (%s) registered", practitionerID, name)))
+
+	return s.createAuditLog(ctx, "RegisterPractitioner", "practitioner", practitionerID, actor, "BPJS_ADMIN",
+		fmt.Sprintf("Registered %s, STR %s", name, strNumber))
+}
+
+// RenewPractitionerRegistration records a renewed registration (STR) of a practitioner
+func (s *BPJSSmartContract) RenewPractitionerRegistration(ctx contractapi.TransactionContextInterface,
+	practitionerID string, strNumber string, strValidUntil string) error {
+
+	actor, err := requireBPJSOrg(ctx, "renewing practitioner registrations")
+	if err != nil {
+		return err
+	}
+	practitioner, err := s.getPractitioner(ctx, practitionerID)
+	if err != nil {
+		return err
+	}
+	if strNumber == "" {
+		return fmt.Errorf("STR number is required")
+	}
+	if strValidUntil != "" {
+		if _, err := parseDate(strValidUntil); err != nil {
+			return fmt.Errorf("invalid STR validity: %v", err)
+		}
+	}
+
+	oldSTR := practitioner.STRNumber
+	practitioner.STRNumber = strNumber
+	practitioner.STRValidUntil = strValidUntil
+	if err := s.putPractitioner(ctx, practitioner); err != nil {
+		return err
+	}
+
+	return s.createStateChangeAuditLog(ctx, "RenewPractitionerRegistration", "practitioner", practitionerID, actor, "BPJS_ADMIN",
+		oldSTR, strNumber, "", fmt.Sprintf("STR of %s renewed until %s", practitioner.Name, strValidUntil))
+}
+
+// GrantPracticeLicense records a practice license (SIP) of a practitioner at a registered facility.
+// A license at a facility the practitioner is already licensed at replaces the previous one.
+func (s *BPJSSmartContract) GrantPracticeLicense(ctx contractapi.TransactionContextInterface,
+	practitionerID string, sipNumber string, faskesCode string, validFrom string, validUntil string) error {
+
+	actor, err := requireBPJSOrg(ctx, "granting practice licenses")
+	if err != nil {
+		return err
+	}
+	practitioner, err := s.getPractitioner(ctx, practitionerID)
+	if err != nil {
+		return err
+	}
+	if _, err := s.getFaskes(ctx, faskesCode); err != nil {
+		return err
+	}
+	if sipNumber == "" {
+		return fmt.Errorf("SIP number is required")
+	}
+	if _, err := parseDate(validFrom); err != nil {
+		return fmt.Errorf("invalid license start: %v", err)
+	}
+	if _, err := parseDate(validUntil); err != nil {
+		return fmt.Errorf("invalid license end: %v", err)
+	}
+	if validUntil <= validFrom {
+		return fmt.Errorf("license end %s must be after license start %s", validUntil, validFrom)
+	}
+
+	txDate := getTxTimestamp(ctx).Format("2006-01-02")
+	licenses := []PracticeLicense{}
+	running := 0
+	for _, license := range practitioner.Licenses {
+		if license.FaskesCode == faskesCode {
+			continue
+		}
+		if license.ValidUntil >= txDate {
+			running++
+		}
+		licenses = append(licenses, license)
+	}
+	if validUntil >= txDate && running >= maxPracticeLocations {
+		return fmt.Errorf("practitioner %s already holds practice licenses at %d facilities", practitionerID, running)
+	}
+
+	practitioner.Licenses = append(licenses, PracticeLicense{
+		SIPNumber:  sipNumber,
+		FaskesCode: faskesCode,
+		ValidFrom:  validFrom,
+		ValidUntil: validUntil,
+	})
+	if err := s.putPractitioner(ctx, practitioner); err != nil {
+		return err
+	}
+
+	return s.createAuditLog(ctx, "GrantPracticeLicense", "practitioner", practitionerID, actor, "BPJS_ADMIN",
+		fmt.Sprintf("SIP %s at %s valid %s to %s", sipNumber, faskesCode, validFrom, validUntil))
+}
+
+// GetPractitioner returns a registered practitioner
+func (s *BPJSSmartContract) GetPractitioner(ctx contractapi.TransactionContextInterface,
+	practitionerID string) (*Practitioner, error) {
+
+	return s.getPractitioner(ctx, practitionerID)
+}
+
+// GetPractitionerActivity returns the visits attended and referrals made by a practitioner at any facility
+func (s *BPJSSmartContract) GetPractitionerActivity(ctx contractapi.TransactionContextInterface,
+	practitionerID string) (*PractitionerActivity, error) {
+
+	if _, err := s.getPractitioner(ctx, practitionerID); err != nil {
+		return nil, err
+	}
+
+	activity := PractitionerActivity{
+		PractitionerID: practitionerID,
+		Visits:         []*Visit{},
+		Referrals:      []*Referral{},
+	}
+
+	visitIDs, err := s.getPractitionerIndex(ctx, "practitionerID~visitID", practitionerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, visitID := range visitIDs {
+		visit, err := s.getVisit(ctx, visitID)
+		if err != nil {
+			continue
+		}
+		applyVisitAddenda(visit)
+		activity.Visits = append(activity.Visits, visit)
+	}
+
+	referralIDs, err := s.getPractitionerIndex(ctx, "practitionerID~referralID", practitionerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, referralID := range referralIDs {
+		referralJSON, err := ctx.GetStub().GetState(referralKey(referralID))
+		if err != nil || referralJSON == nil {
+			continue
+		}
+		var referral Referral
+		json.Unmarshal(referralJSON, &referral)
+		activity.Referrals = append(activity.Referrals, &referral)
+	}
+
+	return &activity, nil
+}
+
+// BackfillPractitionerIndexes adds visits and referrals recorded before the practitioner registry
+// to the indexes GetPractitionerActivity reads. Run it after MigrateKeyNamespaces. At most limit
+// entries are added per run; run it again while the result reports remaining entries.
+func (s *BPJSSmartContract) BackfillPractitionerIndexes(ctx contractapi.TransactionContextInterface,
+	limit int) (*PractitionerIndexBackfill, error) {
+
+	actor, err := requireBPJSOrg(ctx, "practitioner index backfill")
+	if err != nil {
+		return nil, err
+	}
+	if limit < 1 {
+		return nil, fmt.Errorf("limit must be at least 1")
+	}
+
+	visitDoctor := func(value []byte) (string, string, error) {
+		var visit Visit
+		if err := json.Unmarshal(value, &visit); err != nil {
+			return "", "", fmt.Errorf("failed to unmarshal visit: %v", err)
+		}
+		applyVisitAddenda(&visit)
+		return visit.VisitID, visit.DoctorID, nil
+	}
+	referringDoctor := func(value []byte) (string, string, error) {
+		var referral Referral
+		if err := json.Unmarshal(value, &referral); err != nil {
+			return "", "", fmt.Errorf("failed to unmarshal referral: %v", err)
+		}
+		return referral.ReferralID, referral.ReferringDoctor, nil
+	}
+
+	result := &PractitionerIndexBackfill{}
+	result.Visits, err = s.backfillPractitionerIndex(ctx, visitKeyPrefix, "practitionerID~visitID",
+		visitDoctor, limit, &result.Remaining)
+	if err != nil {
+		return nil, err
+	}
+	result.Referrals, err = s.backfillPractitionerIndex(ctx, referralKeyPrefix, "practitionerID~referralID",
+		referringDoctor, limit-len(result.Visits), &result.Remaining)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, s.createAuditLog(ctx, "BackfillPractitionerIndexes", "ledger", "INDEXES", actor, "BPJS_ADMIN",
+		fmt.Sprintf("Indexed %d visits and %d referrals by practitioner", len(result.Visits), len(result.Referrals)))
+}
+
+// backfillPractitionerIndex adds the entities stored under keyPrefix that are missing from
+// indexName, at most limit of them, and returns their IDs
+func (s *BPJSSmartContract) backfillPractitionerIndex(ctx contractapi.TransactionContextInterface,
+	keyPrefix string, indexName string, practitionerOf func([]byte) (string, string, error),
+	limit int, remaining *bool) ([]string, error) {
+
+	resultsIterator, err := ctx.GetStub().GetStateByRange(keyPrefix, keyPrefix+"~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan world state: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	indexed := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		id, practitionerID, err := practitionerOf(queryResponse.Value)
+		if err != nil {
+			return nil, err
+		}
+		if practitionerID == "" {
+			continue
+		}
+		indexKey, err := ctx.GetStub().CreateCompositeKey(indexName, []string{practitionerID, id})
+		if err != nil {
+			return nil, err
+		}
+		existing, err := ctx.GetStub().GetState(indexKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from world state: %v", err)
+		}
+		if existing != nil {
+			continue
+		}
+
+		if len(indexed) >= limit {
+			*remaining = true
+			break
+		}
+		if err := ctx.GetStub().PutState(indexKey, []byte{0x00}); err != nil {
+			return nil, err
+		}
+		indexed = append(indexed, id)
+	}
+
+	return indexed, nil
+}
+
+// getPractitionerIndex returns the IDs indexed under a practitioner
+func (s *BPJSSmartContract) getPractitionerIndex(ctx contractapi.TransactionContextInterface,
+	indexName string, practitionerID string) ([]string, error) {
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(indexName, []string{practitionerID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var ids []string
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(response.Key)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, compositeKeyParts[1])
+	}
+	return ids, nil
+}
+
+// resolvePractitioner returns a practitioner whose registration (STR) and practice license (SIP)
+// at the facility are valid on the service date
+func (s *BPJSSmartContract) resolvePractitioner(ctx contractapi.TransactionContextInterface,
+	practitionerID string, faskesCode string, serviceDate string) (*Practitioner, error) {
+
+	if practitionerID == "" {
+		return nil, fmt.Errorf("practitioner ID is required")
+	}
+	if _, err := parseDate(serviceDate); err != nil {
+		return nil, fmt.Errorf("invalid service date: %v", err)
+	}
+	practitioner, err := s.getPractitioner(ctx, practitionerID)
+	if err != nil {
+		return nil, err
+	}
+	if practitioner.STRValidUntil != "" && serviceDate > practitioner.STRValidUntil {
+		return nil, fmt.Errorf("registration (STR) of practitioner %s expired on %s",
+			practitionerID, practitioner.STRValidUntil)
+	}
+
+	for _, license := range practitioner.Licenses {
+		if license.FaskesCode != faskesCode {
+			continue
+		}
+		if serviceDate < license.ValidFrom {
+			return nil, fmt.Errorf("practice license (SIP) of practitioner %s at faskes %s starts on %s",
+				practitionerID, faskesCode, license.ValidFrom)
+		}
+		if serviceDate > license.ValidUntil {
+			return nil, fmt.Errorf("practice license (SIP) of practitioner %s at faskes %s expired on %s",
+				practitionerID, faskesCode, license.ValidUntil)
+		}
+		return practitioner, nil
+	}
+	return nil, fmt.Errorf("practitioner %s is not licensed to practise at faskes %s", practitionerID, faskesCode)
+}
+
+// getPractitioner reads a practitioner from the registry
+func (s *BPJSSmartContract) getPractitioner(ctx contractapi.TransactionContextInterface,
+	practitionerID string) (*Practitioner, error) {
+
+	practitionerJSON, err := ctx.GetStub().GetState(practitionerKey(practitionerID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if practitionerJSON == nil {
+		return nil, fmt.Errorf("practitioner %s is not registered", practitionerID)
+	}
+
+	var practitioner Practitioner
+	err = json.Unmarshal(practitionerJSON, &practitioner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal practitioner: %v", err)
+	}
+	return &practitioner, nil
+}
+
+// putPractitioner writes a practitioner to the registry
+func (s *BPJSSmartContract) putPractitioner(ctx contractapi.TransactionContextInterface, practitioner *Practitioner) error {
+	practitioner.Timestamp = getTxTimestamp(ctx)
+
+	practitionerJSON, err := json.Marshal(practitioner)
+	if err != nil {
+		return fmt.Errorf("failed to marshal practitioner: %v", err)
+	}
+	return ctx.GetStub().PutState(practitionerKey(practitioner.PractitionerID), practitionerJSON)
+}
+
+// ===== PRIMARY CARE FACILITY (FKTP) FUNCTIONS =====
+
+// primaryFacilityMinHoldingMonths is how long a member must stay registered to an FKTP before moving
+const primaryFacilityMinHoldingMonths = 3
+
+// ChangePrimaryFacility registers a member to a primary care facility (FKTP). The first
+// registration is free; afterwards a member can move at most once every three months.
+func (s *BPJSSmartContract) ChangePrimaryFacility(ctx contractapi.TransactionContextInterface,
+	cardID string, faskesCode string, reason string) error {
+
+	card, err := s.VerifyCard(ctx, cardID)
+	if err != nil {
+		return fmt.Errorf("card verification failed: %v", err)
+	}
+	faskes, err := s.resolveFaskes(ctx, faskesCode)
+	if err != nil {
+		return err
+	}
+	if faskes.Type != FaskesTypeFKTP {
+		return fmt.Errorf("faskes %s is %s, members can only register to an FKTP", faskesCode, faskes.Type)
+	}
+	if faskesCode == card.PrimaryFacility {
+		return fmt.Errorf("card %s is already registered to %s", cardID, faskesCode)
+	}
+
+	txDate := getTxTimestamp(ctx).Format("2006-01-02")
+	if card.PrimaryFacilitySince != "" {
+		since, err := parseDate(card.PrimaryFacilitySince)
+		if err != nil {
+			return fmt.Errorf("card %s has an invalid registration date: %v", cardID, err)
+		}
+		allowedFrom := since.AddDate(0, primaryFacilityMinHoldingMonths, 0).Format("2006-01-02")
+		if txDate < allowedFrom {
+			return fmt.Errorf("card %s registered to %s since %s cannot change facility before %s",
+				cardID, card.PrimaryFacility, card.PrimaryFacilitySince, allowedFrom)
+		}
+	}
+
+	oldFacility := card.PrimaryFacility
+	if oldFacility != "" {
+		if err := s.deletePrimaryFacilityIndex(ctx, oldFacility, cardID); err != nil {
+			return err
+		}
+	}
+	if err := s.putPrimaryFacilityIndex(ctx, faskesCode, cardID); err != nil {
+		return err
+	}
+
+	card.PrimaryFacility = faskesCode
+	card.PrimaryFacilitySince = txDate
+	card.Timestamp = getTxTimestamp(ctx)
+
+	updatedJSON, err := json.Marshal(card)
+	if err != nil {
+		return fmt.Errorf("failed to marshal card: %v", err)
+	}
+	err = ctx.GetStub().PutState(cardKey(cardID), updatedJSON)
+	if err != nil {
+		return err
+	}
+
+	actor, _ := ctx.GetClientIdentity().GetID()
+	return s.createStateChangeAuditLog(ctx, "ChangePrimaryFacility", "card", cardID, actor, "BPJS_ADMIN",
+		oldFacility, faskesCode, "",
+		fmt.Sprintf("Primary care facility changed from %s to %s. Reason: %s", oldFacility, faskesCode, reason))
+}
+
+// GetMembersByPrimaryFacility retrieves all cards registered to a primary care facility
+func (s *BPJSSmartContract) GetMembersByPrimaryFacility(ctx contractapi.TransactionContextInterface,
+	faskesCode string) ([]*BPJSCard, error) {
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("faskesCode~cardID", []string{faskesCode})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var cards []*BPJSCard
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(response.Key)
+		if err != nil {
+			continue
+		}
+		cardJSON, err := ctx.GetStub().GetState(cardKey(compositeKeyParts[1]))
+		if err != nil || cardJSON == nil {
+			continue
+		}
+
+		var card BPJSCard
+		json.Unmarshal(cardJSON, &card)
+		// Entries written before cards leaving the membership were unlinked
+		if !isMembershipStatus(card.Status) {
+			continue
+		}
+		cards = append(cards, &card)
+	}
+
+	return cards, nil
+}
+
+// putPrimaryFacilityIndex links a card to its registered FKTP
+func (s *BPJSSmartContract) putPrimaryFacilityIndex(ctx contractapi.TransactionContextInterface,
+	faskesCode string, cardID string) error {
+
+	indexKey, err := ctx.GetStub().CreateCompositeKey("faskesCode~cardID", []string{faskesCode, cardID})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(indexKey, []byte{0x00})
+}
+
+// updatePrimaryFacilityIndex unlinks a card that left the membership from its registered FKTP
+// and links it again when the card is reinstated
+func (s *BPJSSmartContract) updatePrimaryFacilityIndex(ctx contractapi.TransactionContextInterface,
+	card *BPJSCard, oldStatus string) error {
+
+	if card.PrimaryFacility == "" {
+		return nil
+	}
+	switch {
+	case isMembershipStatus(oldStatus) && !isMembershipStatus(card.Status):
+		return s.deletePrimaryFacilityIndex(ctx, card.PrimaryFacility, card.CardID)
+	case !isMembershipStatus(oldStatus) && isMembershipStatus(card.Status):
+		return s.putPrimaryFacilityIndex(ctx, card.PrimaryFacility, card.CardID)
+	}
+	return nil
+}
+
+// deletePrimaryFacilityIndex unlinks a card from its registered FKTP
+func (s *BPJSSmartContract) deletePrimaryFacilityIndex(ctx contractapi.TransactionContextInterface,
+	faskesCode string, cardID string) error {
+
+	indexKey, err := ctx.GetStub().CreateCompositeKey("faskesCode~cardID", []string{faskesCode, cardID})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(indexKey)
+}
+
+// ===== REFERENCE CODE REGISTRY FUNCTIONS =====
+
+// Coding systems held in the reference code registry
+const (
+	CodeSystemICD10  = "ICD10"
+	CodeSystemICD9CM = "ICD9CM"
+)
+
+// Code set version statuses
+const (
+	CodeSetStatusDraft   = "draft"
+	CodeSetStatusActive  = "active"
+	CodeSetStatusRetired = "retired"
+)
+
+// codeFormats gives the code pattern of each coding system
+var codeFormats = map[string]*regexp.Regexp{
+	CodeSystemICD10:  regexp.MustCompile(`^[A-Z][0-9]{2}(\.[0-9A-Z]{1,4})?$`),
+	CodeSystemICD9CM: regexp.MustCompile(`^[0-9]{2}(\.[0-9]{1,2})?$`),
+}
+
+// codeSystemNames gives the display name of each coding system for messages
+var codeSystemNames = map[string]string{
+	CodeSystemICD10:  "ICD-10",
+	CodeSystemICD9CM: "ICD-9-CM",
+}
+
+// LoadICD10Codes adds ICD-10 codes to a draft version of the ICD-10 reference set.
+// codesJSON is a JSON array of {"code", "description"}; large sets can be loaded in several calls.
+func (s *BPJSSmartContract) LoadICD10Codes(ctx contractapi.TransactionContextInterface,
+	version string, codesJSON string) (*CodeSetVersion, error) {
+
+	return s.loadReferenceCodes(ctx, CodeSystemICD10, version, codesJSON)
+}
+
+// ActivateICD10Version makes a loaded ICD-10 version the one visits and claims are validated against
+func (s *BPJSSmartContract) ActivateICD10Version(ctx contractapi.TransactionContextInterface,
+	version string) error {
+
+	return s.activateCodeSet(ctx, CodeSystemICD10, version)
+}
+
+// GetActiveICD10Version returns the ICD-10 version currently in use
+func (s *BPJSSmartContract) GetActiveICD10Version(ctx contractapi.TransactionContextInterface) (*CodeSetVersion, error) {
+	return s.getActiveCodeSet(ctx, CodeSystemICD10)
+}
+
+// GetICD10Code looks up a code in the active ICD-10 version
+func (s *BPJSSmartContract) GetICD10Code(ctx contractapi.TransactionContextInterface,
+	code string) (*ReferenceCode, error) {
+
+	codeSet, err := s.getActiveCodeSet(ctx, CodeSystemICD10)
+	if err != nil {
+		return nil, err
+	}
+	return s.getReferenceCode(ctx, codeSet, code)
+}
+
+// LoadICD9CMCodes adds procedure codes to a draft version of the ICD-9-CM reference set.
+// codesJSON is a JSON array of {"code", "description"}; large sets can be loaded in several calls.
+func (s *BPJSSmartContract) LoadICD9CMCodes(ctx contractapi.TransactionContextInterface,
+	version string, codesJSON string) (*CodeSetVersion, error) {
+
+	return s.loadReferenceCodes(ctx, CodeSystemICD9CM, version, codesJSON)
+}
+
+// ActivateICD9CMVersion makes a loaded ICD-9-CM version the one procedures are validated against
+func (s *BPJSSmartContract) ActivateICD9CMVersion(ctx contractapi.TransactionContextInterface,
+	version string) error {
+
+	return s.activateCodeSet(ctx, CodeSystemICD9CM, version)
+}
+
+// GetActiveICD9CMVersion returns the ICD-9-CM version currently in use
+func (s *BPJSSmartContract) GetActiveICD9CMVersion(ctx contractapi.TransactionContextInterface) (*CodeSetVersion, error) {
+	return s.getActiveCodeSet(ctx, CodeSystemICD9CM)
+}
+
+// GetICD9CMCode looks up a procedure code in the active ICD-9-CM version
+func (s *BPJSSmartContract) GetICD9CMCode(ctx contractapi.TransactionContextInterface,
+	code string) (*ReferenceCode, error) {
+
+	codeSet, err := s.getActiveCodeSet(ctx, CodeSystemICD9CM)
+	if err != nil {
+		return nil, err
+	}
+	return s.getReferenceCode(ctx, codeSet, code)
+}
+
+// validateDiagnosisCodes checks a primary ICD-10 code and a comma separated list of secondary
+// codes against the active ICD-10 version. It returns the normalized codes and the version used.
+func (s *BPJSSmartContract) validateDiagnosisCodes(ctx contractapi.TransactionContextInterface,
+	primaryCode string, secondaryCodes string) (string, []string, string, error) {
+
+	primaryCode = normalizeCode(primaryCode)
+	if primaryCode == "" {
+		return "", nil, "", fmt.Errorf("primary ICD-10 diagnosis code is required")
+	}
+
+	codeSet, err := s.getActiveCodeSet(ctx, CodeSystemICD10)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if _, err := s.getReferenceCode(ctx, codeSet, primaryCode); err != nil {
+		return "", nil, "", err
+	}
+
+	seen := map[string]bool{primaryCode: true}
+	var secondary []string
+	for _, code := range splitCodes(secondaryCodes) {
+		if seen[code] {
+			return "", nil, "", fmt.Errorf("ICD-10 code %s is given more than once", code)
+		}
+		if _, err := s.getReferenceCode(ctx, codeSet, code); err != nil {
+			return "", nil, "", err
+		}
+		seen[code] = true
+		secondary = append(secondary, code)
+	}
+
+	return primaryCode, secondary, codeSet.Version, nil
+}
+
+// validateProcedures parses a JSON array of procedure entries performed during a visit and checks
+// them against the active ICD-9-CM version and the practitioner registry. It returns the entries
+// with their descriptions and the version used.
+func (s *BPJSSmartContract) validateProcedures(ctx contractapi.TransactionContextInterface,
+	visit *Visit, proceduresJSON string) ([]ProcedureEntry, string, error) {
+
+	if strings.TrimSpace(proceduresJSON) == "" {
+		return nil, "", nil
+	}
+
+	var procedures []ProcedureEntry
+	if err := json.Unmarshal([]byte(proceduresJSON), &procedures); err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal procedures: %v", err)
+	}
+	if len(procedures) == 0 {
+		return nil, "", nil
+	}
+
+	codeSet, err := s.getActiveCodeSet(ctx, CodeSystemICD9CM)
+	if err != nil {
+		return nil, "", err
+	}
+	if visit.ICD9CMVersion != "" && visit.ICD9CMVersion != codeSet.Version {
+		return nil, "", fmt.Errorf("procedures of visit %s are coded in ICD-9-CM version %s, not the active version %s",
+			visit.VisitID, visit.ICD9CMVersion, codeSet.Version)
+	}
+
+	visitDate, err := parseDate(visit.VisitDate)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid visit date: %v", err)
+	}
+	today := getTxTimestamp(ctx).Format("2006-01-02")
+
+	for i := range procedures {
+		procedure := &procedures[i]
+		referenceCode, err := s.getReferenceCode(ctx, codeSet, procedure.Code)
+		if err != nil {
+			return nil, "", err
+		}
+		procedure.Code = referenceCode.Code
+		procedure.Description = referenceCode.Description
+
+		if procedure.Quantity < 1 {
+			return nil, "", fmt.Errorf("procedure %s must have a quantity of at least 1", procedure.Code)
+		}
+		if procedure.PractitionerID == "" {
+			return nil, "", fmt.Errorf("procedure %s has no performing practitioner", procedure.Code)
+		}
+		date, err := parseDate(procedure.Date)
+		if err != nil {
+			return nil, "", fmt.Errorf("procedure %s: %v", procedure.Code, err)
+		}
+		if date.Before(visitDate) {
+			return nil, "", fmt.Errorf("procedure %s date %s is before the visit date %s", procedure.Code, procedure.Date, visit.VisitDate)
+		}
+		if procedure.Date > today {
+			return nil, "", fmt.Errorf("procedure %s date %s is in the future", procedure.Code, procedure.Date)
+		}
+		// The practitioner must be licensed at the visit's facility on the procedure date
+		if _, err := s.resolvePractitioner(ctx, procedure.PractitionerID, visit.FaskesCode, procedure.Date); err != nil {
+			return nil, "", fmt.Errorf("procedure %s: %v", procedure.Code, err)
+		}
+	}
+
+	return procedures, codeSet.Version, nil
+}
+
+// normalizeCode trims and upper-cases a code
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// splitCodes splits a comma separated code list, skipping empty entries
+func splitCodes(codes string) []string {
+	var result []string
+	for _, code := range strings.Split(codes, ",") {
+		if code = normalizeCode(code); code != "" {
+			result = append(result, code)
+		}
+	}
+	return result
+}
+
+// codeSetKey returns the world state key of a code set version
+func codeSetKey(system string, version string) string {
+	return "CODESET_" + system + "_" + version
+}
+
+// activeCodeSetKey returns the world state key holding the active version of a coding system
+func activeCodeSetKey(system string) string {
+	return "ACTIVECODESET_" + system
+}
+
+// referenceCodeKey returns the world state key of a code in a code set version
+func referenceCodeKey(system string, version string, code string) string {
+	return "CODE_" + system + "_" + version + "_" + code
+}
+
+// requireBPJSOrg rejects callers outside the BPJS organization
+func requireBPJSOrg(ctx contractapi.TransactionContextInterface, action string) (string, error) {
+	actor, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get client identity: %v", err)
+	}
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get client organization: %v", err)
+	}
+	if mspID != bpjsMSPID {
+		return "", fmt.Errorf("%s is restricted to %s, not %s", action, bpjsMSPID, mspID)
+	}
+	return actor, nil
+}
+
+// loadReferenceCodes adds codes to a draft code set version, creating the version if needed
+func (s *BPJSSmartContract) loadReferenceCodes(ctx contractapi.TransactionContextInterface,
+	system string, version string, codesJSON string) (*CodeSetVersion, error) {
+
+	systemName := codeSystemNames[system]
+	actor, err := requireBPJSOrg(ctx, "loading "+systemName+" codes")
+	if err != nil {
+		return nil, err
+	}
+	if version == "" || strings.Contains(version, "_") {
+		return nil, fmt.Errorf("invalid %s version %q", systemName, version)
+	}
+
+	var codes []ReferenceCode
+	if err := json.Unmarshal([]byte(codesJSON), &codes); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal codes: %v", err)
+	}
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("no codes given")
+	}
+
+	codeSet, err := s.getCodeSet(ctx, system, version)
+	if err != nil {
+		return nil, err
+	}
+	if codeSet == nil {
+		codeSet = &CodeSetVersion{System: system, Version: version, Status: CodeSetStatusDraft, LoadedBy: actor}
+	}
+	if codeSet.Status != CodeSetStatusDraft {
+		return nil, fmt.Errorf("%s version %s is %s and can no longer be changed", systemName, version, codeSet.Status)
+	}
+
+	loaded := make(map[string]bool)
+	for _, code := range codes {
+		code.Code = normalizeCode(code.Code)
+		if !codeFormats[system].MatchString(code.Code) {
+			return nil, fmt.Errorf("invalid %s code %q", systemName, code.Code)
+		}
+		if code.Description == "" {
+			return nil, fmt.Errorf("%s code %s has no description", systemName, code.Code)
+		}
+
+		key := referenceCodeKey(system, version, code.Code)
+		existing, err := ctx.GetStub().GetState(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from world state: %v", err)
+		}
+		if existing == nil && !loaded[code.Code] {
+			codeSet.CodeCount++
+		}
+		loaded[code.Code] = true
+
+		code.System = system
+		code.Version = version
+		codeJSON, err := json.Marshal(code)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal code: %v", err)
+		}
+		if err := ctx.GetStub().PutState(key, codeJSON); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.putCodeSet(ctx, codeSet); err != nil {
+		return nil, err
+	}
+
+	return codeSet, s.createAuditLog(ctx, "Load"+system+"Codes", "codeset", codeSetKey(system, version), actor, "BPJS_ADMIN",
+		fmt.Sprintf("Loaded %d %s codes into version %s", len(loaded), systemName, version))
+}
+
+// activateCodeSet makes a version the active one of its coding system and retires the previous one.
+// A retired version can be activated again to roll back.
+func (s *BPJSSmartContract) activateCodeSet(ctx contractapi.TransactionContextInterface,
+	system string, version string) error {
+
+	systemName := codeSystemNames[system]
+	actor, err := requireBPJSOrg(ctx, "activating "+systemName+" versions")
+	if err != nil {
+		return err
+	}
+
+	codeSet, err := s.getCodeSet(ctx, system, version)
+	if err != nil {
+		return err
+	}
+	if codeSet == nil {
+		return fmt.Errorf("%s version %s not found", systemName, version)
+	}
+	if codeSet.Status == CodeSetStatusActive {
+		return fmt.Errorf("%s version %s is already active", systemName, version)
+	}
+
+	previous, err := s.getActiveCodeSet(ctx, system)
+	if err == nil {
+		previous.Status = CodeSetStatusRetired
+		if err := s.putCodeSet(ctx, previous); err != nil {
+			return err
+		}
+	}
+
+	codeSet.Status = CodeSetStatusActive
+	codeSet.ActivatedBy = actor
+	codeSet.ActivatedDate = getTxTimestamp(ctx).Format("2006-01-02")
+	if err := s.putCodeSet(ctx, codeSet); err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(activeCodeSetKey(system), []byte(version)); err != nil {
+		return err
+	}
+
+	ctx.GetStub().SetEvent("CodeSetActivated", []byte(fmt.Sprintf("%s version %s activated", systemName, version)))
+
+	return s.createAuditLog(ctx, "Activate"+system+"Version", "codeset", codeSetKey(system, version), actor, "BPJS_ADMIN",
+		fmt.Sprintf("Activated %s version %s with %d codes", systemName, version, codeSet.CodeCount))
+}
+
+// getActiveCodeSet returns the active version of a coding system
+func (s *BPJSSmartContract) getActiveCodeSet(ctx contractapi.TransactionContextInterface,
+	system string) (*CodeSetVersion, error) {
+
+	version, err := ctx.GetStub().GetState(activeCodeSetKey(system))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if version == nil {
+		return nil, fmt.Errorf("no active %s version", codeSystemNames[system])
+	}
+
+	codeSet, err := s.getCodeSet(ctx, system, string(version))
+	if err != nil {
+		return nil, err
+	}
+	if codeSet == nil {
+		return nil, fmt.Errorf("%s version %s not found", codeSystemNames[system], version)
+	}
+	return codeSet, nil
+}
+
+// getReferenceCode looks up a code in a code set version
+func (s *BPJSSmartContract) getReferenceCode(ctx contractapi.TransactionContextInterface,
+	codeSet *CodeSetVersion, code string) (*ReferenceCode, error) {
+
+	systemName := codeSystemNames[codeSet.System]
+	code = normalizeCode(code)
+	if !codeFormats[codeSet.System].MatchString(code) {
+		return nil, fmt.Errorf("invalid %s code %q", systemName, code)
+	}
+
+	codeJSON, err := ctx.GetStub().GetState(referenceCodeKey(codeSet.System, codeSet.Version, code))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if codeJSON == nil {
+		return nil, fmt.Errorf("%s code %s is not in version %s", systemName, code, codeSet.Version)
+	}
+
+	var referenceCode ReferenceCode
+	err = json.Unmarshal(codeJSON, &referenceCode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal code: %v", err)
+	}
+	return &referenceCode, nil
+}
+
+// getCodeSet reads a code set version, returning nil if it does not exist
+func (s *BPJSSmartContract) getCodeSet(ctx contractapi.TransactionContextInterface,
+	system string, version string) (*CodeSetVersion, error) {
+
+	codeSetJSON, err := ctx.GetStub().GetState(codeSetKey(system, version))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if codeSetJSON == nil {
+		return nil, nil
+	}
+
+	var codeSet CodeSetVersion
+	err = json.Unmarshal(codeSetJSON, &codeSet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal code set: %v", err)
+	}
+	return &codeSet, nil
+}
+
+// putCodeSet writes a code set version to the world state
+func (s *BPJSSmartContract) putCodeSet(ctx contractapi.TransactionContextInterface, codeSet *CodeSetVersion) error {
+	codeSet.Timestamp = getTxTimestamp(ctx)
+
+	codeSetJSON, err := json.Marshal(codeSet)
+	if err != nil {
+		return fmt.Errorf("failed to marshal code set: %v", err)
+	}
+	return ctx.GetStub().PutState(codeSetKey(codeSet.System, codeSet.Version), codeSetJSON)
+}
+
+// ===== VISIT RECORDING FUNCTIONS =====
+
+// visitTypes lists the kinds of visit RecordVisit accepts
+var visitTypes = map[string]bool{
+	"outpatient": true,
+	"inpatient":  true,
+	"emergency":  true,
+}
+
+// RecordVisit records a patient visit at healthcare facility
+func (s *BPJSSmartContract) RecordVisit(ctx contractapi.TransactionContextInterface,
+	visitID string, cardID string, patientID string, patientName string, faskesCode string,
+	visitDate string, visitType string, diagnosis string, treatment string,
+	doctorID string, notes string,
+	primaryDiagnosisCode string, secondaryDiagnosisCodes string, procedures string, referralID string) error {
+
+	if err := ensureKeyUnused(ctx, visitKey(visitID), "visit", visitID); err != nil {
+		return err
+	}
+	if !visitTypes[visitType] {
+		return fmt.Errorf("invalid visit type %s, must be outpatient, inpatient or emergency", visitType)
+	}
+
+	// Verify card is active
 	card, err := s.VerifyCard(ctx, cardID)
 	if err != nil {
-		return fmt.Errorf("card verification failed: %v", err)
+		return fmt.Errorf("card verification failed: %v", err)
+	}
+
+	primaryCode, secondaryCodes, icd10Version, err := s.validateDiagnosisCodes(ctx, primaryDiagnosisCode, secondaryDiagnosisCodes)
+	if err != nil {
+		return err
+	}
+
+	// Check if patient matches card
+	if card.PatientID != patientID {
+		return fmt.Errorf("patient ID mismatch")
+	}
+
+	faskes, err := s.resolveFaskes(ctx, faskesCode)
+	if err != nil {
+		return err
+	}
+	if err := requireFaskesOwner(ctx, faskes); err != nil {
+		return err
+	}
+
+	doctor, err := s.resolvePractitioner(ctx, doctorID, faskesCode, visitDate)
+	if err != nil {
+		return err
+	}
+
+	// Routine primary care is only covered at the member's registered FKTP
+	if faskes.Type == FaskesTypeFKTP && visitType != "emergency" && faskesCode != card.PrimaryFacility {
+		if card.PrimaryFacility == "" {
+			return fmt.Errorf("card %s has no registered primary care facility", cardID)
+		}
+		return fmt.Errorf("card %s is registered to primary care facility %s, not %s",
+			cardID, card.PrimaryFacility, faskesCode)
+	}
+
+	// Routine hospital outpatient care needs a referral from primary care
+	var referral *Referral
+	if referralID != "" {
+		referral, err = s.resolveReferral(ctx, referralID, patientID, faskesCode, visitDate)
+		if err != nil {
+			return err
+		}
+	} else if faskes.Type == FaskesTypeFKRTL && visitType == "outpatient" {
+		return fmt.Errorf("outpatient visits at FKRTL %s require a referral", faskesCode)
+	}
+
+	recorder, _ := ctx.GetClientIdentity().GetID()
+
+	visit := Visit{
+		VisitID:     visitID,
+		CardID:      cardID,
+		PatientID:   patientID,
+		PatientName: patientName,
+		FaskesCode:  faskesCode,
+		FaskesName:  faskes.Name,
+		FaskesType:  faskes.Type,
+		VisitDate:   visitDate,
+		VisitType:   visitType,
+		Diagnosis:   diagnosis,
+		Treatment:   treatment,
+		DoctorName:  doctor.Name,
+		DoctorID:    doctorID,
+		Notes:       notes,
+		ReferralID:  referralID,
+		RecordedBy:  recorder,
+		Timestamp:   getTxTimestamp(ctx),
+
+		PrimaryDiagnosisCode:    primaryCode,
+		SecondaryDiagnosisCodes: secondaryCodes,
+		ICD10Version:            icd10Version,
+	}
+
+	visit.Procedures, visit.ICD9CMVersion, err = s.validateProcedures(ctx, &visit, procedures)
+	if err != nil {
+		return err
+	}
+
+	visitJSON, _ := json.Marshal(visit)
+	err = ctx.GetStub().PutState(visitKey(visitID), visitJSON)
+	if err != nil {
+		return err
+	}
+
+	// Create composite key for querying visits by patient
+	indexName := "patientID~visitID"
+	indexKey, _ := ctx.GetStub().CreateCompositeKey(indexName, []string{patientID, visitID})
+	ctx.GetStub().PutState(indexKey, []byte{0x00})
+
+	doctorIndexKey, _ := ctx.GetStub().CreateCompositeKey("practitionerID~visitID", []string{doctorID, visitID})
+	ctx.GetStub().PutState(doctorIndexKey, []byte{0x00})
+
+	// A referral is used up by the visit it was made for
+	if referral != nil {
+		referral.Status = ReferralStatusCompleted
+		referral.VisitID = visitID
+		referral.Timestamp = getTxTimestamp(ctx)
+		referralJSON, _ := json.Marshal(referral)
+		if err := ctx.GetStub().PutState(referralKey(referralID), referralJSON); err != nil {
+			return err
+		}
+		err = s.createStateChangeAuditLog(ctx, "RecordVisit", "referral", referralID, recorder, "FASKES_STAFF",
+			ReferralStatusAccepted, ReferralStatusCompleted, "", fmt.Sprintf("Referral used by visit %s", visitID))
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx.GetStub().SetEvent("VisitRecorded", []byte(fmt.Sprintf("Visit %s recorded for %s", visitID, patientName)))
+
+	description := fmt.Sprintf("Recorded visit for %s at %s", patientName, faskes.Name)
+	if referral != nil {
+		description += fmt.Sprintf(" on referral %s", referralID)
+	}
+	return s.createAuditLog(ctx, "RecordVisit", "visit", visitID, recorder, "FASKES_STAFF", description)
+}
+
+// AddVisitProcedures adds procedures performed after the visit was recorded, e.g. during an inpatient stay.
+// procedures is a JSON array of {"code", "quantity", "date", "practitionerID"}.
+func (s *BPJSSmartContract) AddVisitProcedures(ctx contractapi.TransactionContextInterface,
+	visitID string, procedures string) error {
+
+	visit, err := s.getVisit(ctx, visitID)
+	if err != nil {
+		return err
+	}
+
+	// Only the facility that recorded the visit bills procedures on it
+	faskes, err := s.resolveFaskes(ctx, visit.FaskesCode)
+	if err != nil {
+		return err
+	}
+	if err := requireFaskesOwner(ctx, faskes); err != nil {
+		return err
+	}
+
+	added, version, err := s.validateProcedures(ctx, visit, procedures)
+	if err != nil {
+		return err
+	}
+	if len(added) == 0 {
+		return fmt.Errorf("no procedures given")
+	}
+
+	visit.Procedures = append(visit.Procedures, added...)
+	visit.ICD9CMVersion = version
+	if err := s.putVisit(ctx, visit); err != nil {
+		return err
+	}
+
+	recorder, _ := ctx.GetClientIdentity().GetID()
+	return s.createAuditLog(ctx, "AddVisitProcedures", "visit", visitID, recorder, "FASKES_STAFF",
+		fmt.Sprintf("Added %d procedures to visit of %s", len(added), visit.PatientName))
+}
+
+// amendableVisitFields lists the visit fields an addendum can correct
+var amendableVisitFields = map[string]bool{
+	"diagnosis":               true,
+	"treatment":               true,
+	"notes":                   true,
+	"doctorID":                true, // the doctor's name follows from the practitioner registry
+	"primaryDiagnosisCode":    true,
+	"secondaryDiagnosisCodes": true,
+}
+
+// AddVisitAddendum appends a correction or clarification to a visit. The recorded visit is never
+// overwritten; readers see the corrections applied by GetPatientVisits.
+// changesJSON is a JSON object of field to corrected value, empty for a clarification.
+// Secondary diagnosis codes are given comma separated.
+func (s *BPJSSmartContract) AddVisitAddendum(ctx contractapi.TransactionContextInterface,
+	visitID string, reason string, changesJSON string) error {
+
+	if strings.TrimSpace(reason) == "" {
+		return fmt.Errorf("reason is required for a visit addendum")
+	}
+
+	visit, err := s.getVisit(ctx, visitID)
+	if err != nil {
+		return err
+	}
+
+	// Only the facility that recorded the visit corrects it, also after its contract has ended
+	faskes, err := s.getFaskes(ctx, visit.FaskesCode)
+	if err != nil {
+		return err
+	}
+	if err := requireFaskesOwner(ctx, faskes); err != nil {
+		return err
+	}
+
+	changed := make(map[string]string)
+	if strings.TrimSpace(changesJSON) != "" {
+		if err := json.Unmarshal([]byte(changesJSON), &changed); err != nil {
+			return fmt.Errorf("failed to unmarshal changes: %v", err)
+		}
+	}
+	for field := range changed {
+		if !amendableVisitFields[field] {
+			return fmt.Errorf("visit field %s cannot be amended", field)
+		}
+	}
+
+	current := *visit
+	applyVisitAddenda(&current)
+
+	// Recoded diagnoses are validated against the active ICD-10 version
+	_, primaryChanged := changed["primaryDiagnosisCode"]
+	_, secondaryChanged := changed["secondaryDiagnosisCodes"]
+	if primaryChanged || secondaryChanged {
+		primary, ok := changed["primaryDiagnosisCode"]
+		if !ok {
+			primary = current.PrimaryDiagnosisCode
+		}
+		secondary, ok := changed["secondaryDiagnosisCodes"]
+		if !ok {
+			secondary = strings.Join(current.SecondaryDiagnosisCodes, ",")
+		}
+		primaryCode, secondaryCodes, icd10Version, err := s.validateDiagnosisCodes(ctx, primary, secondary)
+		if err != nil {
+			return err
+		}
+		changed["primaryDiagnosisCode"] = primaryCode
+		changed["secondaryDiagnosisCodes"] = strings.Join(secondaryCodes, ",")
+		changed["icd10Version"] = icd10Version
+	}
+
+	// A new attending doctor must be licensed at the facility on the visit date
+	newDoctorID, doctorChanged := changed["doctorID"]
+	doctorChanged = doctorChanged && newDoctorID != current.DoctorID
+	if doctorChanged {
+		doctor, err := s.resolvePractitioner(ctx, newDoctorID, visit.FaskesCode, visit.VisitDate)
+		if err != nil {
+			return err
+		}
+		changed["doctorName"] = doctor.Name
+	}
+
+	fields := make([]string, 0, len(changed))
+	for field := range changed {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var changes []FieldChange
+	for _, field := range fields {
+		oldValue := visitFieldValue(&current, field)
+		if oldValue != changed[field] {
+			changes = append(changes, FieldChange{Field: field, OldValue: oldValue, NewValue: changed[field]})
+		}
+	}
+	if len(changed) > 0 && len(changes) == 0 {
+		return fmt.Errorf("addendum does not change visit %s", visitID)
+	}
+
+	author, _ := ctx.GetClientIdentity().GetID()
+	authorMSP, _ := ctx.GetClientIdentity().GetMSPID()
+
+	addendum := VisitAddendum{
+		Sequence:  len(visit.Addenda) + 1,
+		Author:    author,
+		AuthorMSP: authorMSP,
+		Reason:    reason,
+		Changes:   changes,
+		TxID:      ctx.GetStub().GetTxID(),
+		Timestamp: getTxTimestamp(ctx),
+	}
+	visit.Addenda = append(visit.Addenda, addendum)
+	if err := s.putVisit(ctx, visit); err != nil {
+		return err
+	}
+
+	if doctorChanged {
+		oldIndexKey, _ := ctx.GetStub().CreateCompositeKey("practitionerID~visitID", []string{current.DoctorID, visitID})
+		if err := ctx.GetStub().DelState(oldIndexKey); err != nil {
+			return err
+		}
+		newIndexKey, _ := ctx.GetStub().CreateCompositeKey("practitionerID~visitID", []string{newDoctorID, visitID})
+		ctx.GetStub().PutState(newIndexKey, []byte{0x00})
+	}
+
+	ctx.GetStub().SetEvent("VisitAmended", []byte(fmt.Sprintf("Addendum %d added to visit %s", addendum.Sequence, visitID)))
+
+	return s.createAuditLog(ctx, "AddVisitAddendum", "visit", visitID, author, "FASKES_STAFF",
+		fmt.Sprintf("Addendum %d, %d fields changed: %s", addendum.Sequence, len(changes), reason))
+}
+
+// applyVisitAddenda applies the changes of all addenda to a visit, in order
+func applyVisitAddenda(visit *Visit) {
+	for _, addendum := range visit.Addenda {
+		for _, change := range addendum.Changes {
+			setVisitField(visit, change.Field, change.NewValue)
+		}
+	}
+}
+
+// visitFieldValue returns the value of an amendable visit field
+func visitFieldValue(visit *Visit, field string) string {
+	switch field {
+	case "diagnosis":
+		return visit.Diagnosis
+	case "treatment":
+		return visit.Treatment
+	case "notes":
+		return visit.Notes
+	case "doctorName":
+		return visit.DoctorName
+	case "doctorID":
+		return visit.DoctorID
+	case "primaryDiagnosisCode":
+		return visit.PrimaryDiagnosisCode
+	case "secondaryDiagnosisCodes":
+		return strings.Join(visit.SecondaryDiagnosisCodes, ",")
+	case "icd10Version":
+		return visit.ICD10Version
+	}
+	return ""
+}
+
+// setVisitField sets an amendable visit field
+func setVisitField(visit *Visit, field string, value string) {
+	switch field {
+	case "diagnosis":
+		visit.Diagnosis = value
+	case "treatment":
+		visit.Treatment = value
+	case "notes":
+		visit.Notes = value
+	case "doctorName":
+		visit.DoctorName = value
+	case "doctorID":
+		visit.DoctorID = value
+	case "primaryDiagnosisCode":
+		visit.PrimaryDiagnosisCode = value
+	case "secondaryDiagnosisCodes":
+		visit.SecondaryDiagnosisCodes = splitCodes(value)
+	case "icd10Version":
+		visit.ICD10Version = value
+	}
+}
+
+// GetPatientVisits retrieves all visits for a patient with their addenda applied,
+// or as originally recorded when showOriginal is set
+func (s *BPJSSmartContract) GetPatientVisits(ctx contractapi.TransactionContextInterface,
+	patientID string, showOriginal bool) ([]*Visit, error) {
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("patientID~visitID", []string{patientID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var visits []*Visit
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// Extract visitID from composite key
+		_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(response.Key)
+		if err != nil {
+			continue
+		}
+		visitID := compositeKeyParts[1]
+
+		// Get actual visit data
+		visitJSON, err := ctx.GetStub().GetState(visitKey(visitID))
+		if err != nil {
+			continue
+		}
+
+		var visit Visit
+		json.Unmarshal(visitJSON, &visit)
+		if !showOriginal {
+			applyVisitAddenda(&visit)
+		}
+		visits = append(visits, &visit)
+	}
+
+	return visits, nil
+}
+
+// GetCardVisits retrieves all visits recorded on a card or on any card it replaced or was replaced by
+func (s *BPJSSmartContract) GetCardVisits(ctx contractapi.TransactionContextInterface,
+	cardID string) ([]*Visit, error) {
+
+	chain, err := s.getCardChain(ctx, cardID)
+	if err != nil {
+		return nil, err
+	}
+
+	chainCardIDs, patientIDs := splitCardChain(chain)
+
+	var visits []*Visit
+	for _, patientID := range patientIDs {
+		patientVisits, err := s.GetPatientVisits(ctx, patientID, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, visit := range patientVisits {
+			if chainCardIDs[visit.CardID] {
+				visits = append(visits, visit)
+			}
+		}
+	}
+
+	return visits, nil
+}
+
+// ===== INPATIENT EPISODE FUNCTIONS =====
+
+// Inpatient episode statuses
+const (
+	EpisodeStatusAdmitted   = "admitted"
+	EpisodeStatusDischarged = "discharged"
+)
+
+// dischargeStatuses lists how an inpatient episode can end
+var dischargeStatuses = map[string]bool{
+	"home":           true,
+	"referred":       true,
+	"deceased":       true,
+	"against-advice": true,
+}
+
+// AdmitPatient starts the inpatient episode of an inpatient visit
+func (s *BPJSSmartContract) AdmitPatient(ctx contractapi.TransactionContextInterface,
+	visitID string, admissionDate string, ward string, room string) error {
+
+	visit, err := s.getVisit(ctx, visitID)
+	if err != nil {
+		return err
+	}
+	faskes, err := s.resolveFaskes(ctx, visit.FaskesCode)
+	if err != nil {
+		return err
+	}
+	if err := requireFaskesOwner(ctx, faskes); err != nil {
+		return err
+	}
+	if visit.VisitType != "inpatient" {
+		return fmt.Errorf("visit %s is a %s visit, not inpatient", visitID, visit.VisitType)
+	}
+	if visit.Episode != nil {
+		return fmt.Errorf("visit %s already has an inpatient episode", visitID)
+	}
+	if _, err := s.VerifyCard(ctx, visit.CardID); err != nil {
+		return fmt.Errorf("card verification failed: %v", err)
+	}
+	if ward == "" || room == "" {
+		return fmt.Errorf("ward and room are required")
+	}
+	if err := validateEpisodeDate(ctx, admissionDate, visit.VisitDate, "visit date"); err != nil {
+		return err
+	}
+
+	visit.Episode = &InpatientEpisode{
+		Status:        EpisodeStatusAdmitted,
+		AdmissionDate: admissionDate,
+		Ward:          ward,
+		Room:          room,
+		WardStays:     []WardStay{{Ward: ward, Room: room, FromDate: admissionDate}},
+	}
+	if err := s.putVisit(ctx, visit); err != nil {
+		return err
+	}
+
+	ctx.GetStub().SetEvent("PatientAdmitted", []byte(fmt.Sprintf("%s admitted to %s room %s", visit.PatientName, ward, room)))
+
+	actor, _ := ctx.GetClientIdentity().GetID()
+	return s.createAuditLog(ctx, "AdmitPatient", "visit", visitID, actor, "FASKES_STAFF",
+		fmt.Sprintf("Admitted %s on %s to %s room %s", visit.PatientName, admissionDate, ward, room))
+}
+
+// TransferWard moves an admitted patient to another ward or room
+func (s *BPJSSmartContract) TransferWard(ctx contractapi.TransactionContextInterface,
+	visitID string, transferDate string, ward string, room string) error {
+
+	visit, err := s.getAdmittedVisit(ctx, visitID)
+	if err != nil {
+		return err
+	}
+	faskes, err := s.resolveFaskes(ctx, visit.FaskesCode)
+	if err != nil {
+		return err
+	}
+	if err := requireFaskesOwner(ctx, faskes); err != nil {
+		return err
+	}
+	if ward == "" || room == "" {
+		return fmt.Errorf("ward and room are required")
+	}
+
+	episode := visit.Episode
+	if ward == episode.Ward && room == episode.Room {
+		return fmt.Errorf("patient is already in %s room %s", ward, room)
+	}
+	current := &episode.WardStays[len(episode.WardStays)-1]
+	if err := validateEpisodeDate(ctx, transferDate, current.FromDate, "current ward stay"); err != nil {
+		return err
+	}
+
+	oldWard, oldRoom := episode.Ward, episode.Room
+	current.ToDate = transferDate
+	episode.WardStays = append(episode.WardStays, WardStay{Ward: ward, Room: room, FromDate: transferDate})
+	episode.Ward = ward
+	episode.Room = room
+	if err := s.putVisit(ctx, visit); err != nil {
+		return err
+	}
+
+	actor, _ := ctx.GetClientIdentity().GetID()
+	return s.createStateChangeAuditLog(ctx, "TransferWard", "visit", visitID, actor, "FASKES_STAFF",
+		oldWard+"/"+oldRoom, ward+"/"+room, "",
+		fmt.Sprintf("Transferred %s on %s from %s room %s to %s room %s",
+			visit.PatientName, transferDate, oldWard, oldRoom, ward, room))
+}
+
+// DischargePatient ends an inpatient episode and records its length of stay
+func (s *BPJSSmartContract) DischargePatient(ctx contractapi.TransactionContextInterface,
+	visitID string, dischargeDate string, dischargeStatus string, notes string) error {
+
+	visit, err := s.getAdmittedVisit(ctx, visitID)
+	if err != nil {
+		return err
+	}
+	// A patient admitted before the facility's contract ended can still be discharged
+	faskes, err := s.getFaskes(ctx, visit.FaskesCode)
+	if err != nil {
+		return err
+	}
+	if err := requireFaskesOwner(ctx, faskes); err != nil {
+		return err
+	}
+	if !dischargeStatuses[dischargeStatus] {
+		return fmt.Errorf("invalid discharge status %s, must be home, referred, deceased or against-advice", dischargeStatus)
+	}
+
+	episode := visit.Episode
+	current := &episode.WardStays[len(episode.WardStays)-1]
+	if err := validateEpisodeDate(ctx, dischargeDate, current.FromDate, "current ward stay"); err != nil {
+		return err
+	}
+
+	// Length of stay counts days between admission and discharge; a same-day stay counts as one
+	admitted, _ := parseDate(episode.AdmissionDate)
+	discharged, _ := parseDate(dischargeDate)
+	lengthOfStay := int(discharged.Sub(admitted).Hours() / 24)
+	if lengthOfStay < 1 {
+		lengthOfStay = 1
+	}
+
+	current.ToDate = dischargeDate
+	episode.Status = EpisodeStatusDischarged
+	episode.DischargeDate = dischargeDate
+	episode.DischargeStatus = dischargeStatus
+	episode.LengthOfStay = lengthOfStay
+	episode.DischargeNotes = notes
+	if err := s.putVisit(ctx, visit); err != nil {
+		return err
+	}
+
+	ctx.GetStub().SetEvent("PatientDischarged", []byte(fmt.Sprintf("%s discharged (%s) after %d days", visit.PatientName, dischargeStatus, lengthOfStay)))
+
+	actor, _ := ctx.GetClientIdentity().GetID()
+	return s.createStateChangeAuditLog(ctx, "DischargePatient", "visit", visitID, actor, "FASKES_STAFF",
+		EpisodeStatusAdmitted, EpisodeStatusDischarged, "",
+		fmt.Sprintf("Discharged %s on %s (%s) after %d days", visit.PatientName, dischargeDate, dischargeStatus, lengthOfStay))
+}
+
+// validateEpisodeDate checks that an episode date is well formed, not in the future and not before notBefore
+func validateEpisodeDate(ctx contractapi.TransactionContextInterface, date string, notBefore string, notBeforeName string) error {
+	if _, err := parseDate(date); err != nil {
+		return err
+	}
+	if date > getTxTimestamp(ctx).Format("2006-01-02") {
+		return fmt.Errorf("date %s is in the future", date)
+	}
+	if date < notBefore {
+		return fmt.Errorf("date %s is before the %s on %s", date, notBeforeName, notBefore)
+	}
+	return nil
+}
+
+// getVisit reads a visit from the world state
+func (s *BPJSSmartContract) getVisit(ctx contractapi.TransactionContextInterface, visitID string) (*Visit, error) {
+	visitJSON, err := ctx.GetStub().GetState(visitKey(visitID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if visitJSON == nil {
+		return nil, fmt.Errorf("visit %s not found", visitID)
+	}
+
+	var visit Visit
+	err = json.Unmarshal(visitJSON, &visit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal visit: %v", err)
+	}
+	return &visit, nil
+}
+
+// getAdmittedVisit reads a visit whose inpatient episode is still open
+func (s *BPJSSmartContract) getAdmittedVisit(ctx contractapi.TransactionContextInterface, visitID string) (*Visit, error) {
+	visit, err := s.getVisit(ctx, visitID)
+	if err != nil {
+		return nil, err
+	}
+	if visit.Episode == nil {
+		return nil, fmt.Errorf("visit %s has no inpatient episode", visitID)
+	}
+	if visit.Episode.Status != EpisodeStatusAdmitted {
+		return nil, fmt.Errorf("patient of visit %s is already %s", visitID, visit.Episode.Status)
+	}
+	return visit, nil
+}
+
+// putVisit writes a visit to the world state
+func (s *BPJSSmartContract) putVisit(ctx contractapi.TransactionContextInterface, visit *Visit) error {
+	visit.Timestamp = getTxTimestamp(ctx)
+
+	visitJSON, err := json.Marshal(visit)
+	if err != nil {
+		return fmt.Errorf("failed to marshal visit: %v", err)
+	}
+	return ctx.GetStub().PutState(visitKey(visit.VisitID), visitJSON)
+}
+
+// ===== PRESCRIPTION FUNCTIONS =====
+
+// Prescription statuses
+const (
+	PrescriptionStatusPrescribed         = "prescribed"
+	PrescriptionStatusPartiallyDispensed = "partially-dispensed"
+	PrescriptionStatusDispensed          = "dispensed"
+)
+
+// CreatePrescription records the drugs prescribed during a visit.
+// itemsJSON is a JSON array of {"drugCode", "drugName", "dose", "quantity", "daysSupply"}.
+func (s *BPJSSmartContract) CreatePrescription(ctx contractapi.TransactionContextInterface,
+	prescriptionID string, visitID string, prescriberID string, itemsJSON string) error {
+
+	if err := ensureKeyUnused(ctx, prescriptionKey(prescriptionID), "prescription", prescriptionID); err != nil {
+		return err
+	}
+
+	visit, err := s.getVisit(ctx, visitID)
+	if err != nil {
+		return err
 	}
 
-	// Check if patient matches card
-	if card.PatientID != patientID {
-		return fmt.Errorf("patient ID mismatch")
+	// The prescription is written at the visit's facility by a practitioner licensed there
+	faskes, err := s.resolveFaskes(ctx, visit.FaskesCode)
+	if err != nil {
+		return err
+	}
+	if err := requireFaskesOwner(ctx, faskes); err != nil {
+		return err
+	}
+	prescriptionDate := getTxTimestamp(ctx).Format("2006-01-02")
+	if _, err := s.resolvePractitioner(ctx, prescriberID, faskes.FaskesCode, prescriptionDate); err != nil {
+		return err
 	}
 
-	recorder, _ := ctx.GetClientIdentity().GetID()
+	var items []PrescriptionItem
+	if err := json.Unmarshal([]byte(itemsJSON), &items); err != nil {
+		return fmt.Errorf("failed to unmarshal prescription items: %v", err)
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("prescription has no items")
+	}
+	seen := make(map[string]bool)
+	for i := range items {
+		item := &items[i]
+		item.DrugCode = strings.TrimSpace(item.DrugCode)
+		if item.DrugCode == "" || item.Dose == "" {
+			return fmt.Errorf("prescription item %d needs a drug code and a dose", i+1)
+		}
+		if seen[item.DrugCode] {
+			return fmt.Errorf("drug %s is prescribed more than once", item.DrugCode)
+		}
+		seen[item.DrugCode] = true
+		if item.Quantity < 1 || item.DaysSupply < 1 {
+			return fmt.Errorf("drug %s needs a quantity and days' supply of at least 1", item.DrugCode)
+		}
+		item.DispensedQuantity = 0
+	}
 
-	visit := Visit{
-		VisitID:     visitID,
-		CardID:      cardID,
-		PatientID:   patientID,
-		PatientName: patientName,
-		FaskesCode:  faskesCode,
-		FaskesName:  faskesName,
-		FaskesType:  faskesType,
-		VisitDate:   visitDate,
-		VisitType:   visitType,
-		Diagnosis:   diagnosis,
-		Treatment:   treatment,
-		DoctorName:  doctorName,
-		DoctorID:    doctorID,
-		Notes:       notes,
-		RecordedBy:  recorder,
-		Timestamp:   getTxTimestamp(ctx),
+	creator, _ := ctx.GetClientIdentity().GetID()
+
+	prescription := Prescription{
+		PrescriptionID:   prescriptionID,
+		VisitID:          visitID,
+		CardID:           visit.CardID,
+		PatientID:        visit.PatientID,
+		PatientName:      visit.PatientName,
+		FaskesCode:       visit.FaskesCode,
+		PrescriberID:     prescriberID,
+		PrescriptionDate: prescriptionDate,
+		Items:            items,
+		Status:           PrescriptionStatusPrescribed,
+		Dispensings:      []Dispensing{},
+		CreatedBy:        creator,
+	}
+	if err := s.putPrescription(ctx, &prescription); err != nil {
+		return err
 	}
 
-	visitJSON, _ := json.Marshal(visit)
-	err = ctx.GetStub().PutState(visitID, visitJSON)
+	indexKey, _ := ctx.GetStub().CreateCompositeKey("patientID~prescriptionID", []string{visit.PatientID, prescriptionID})
+	ctx.GetStub().PutState(indexKey, []byte{0x00})
+	visitIndexKey, _ := ctx.GetStub().CreateCompositeKey("visitID~prescriptionID", []string{visitID, prescriptionID})
+	ctx.GetStub().PutState(visitIndexKey, []byte{0x00})
+
+	ctx.GetStub().SetEvent("PrescriptionCreated", []byte(fmt.Sprintf("Prescription %s created for visit %s", prescriptionID, visitID)))
+
+	return s.createAuditLog(ctx, "CreatePrescription", "prescription", prescriptionID, creator, "FASKES_STAFF",
+		fmt.Sprintf("Prescribed %d drugs for %s", len(items), visit.PatientName))
+}
+
+// DispenseMedication records the drugs the pharmacy of a registered facility handed over for a
+// prescription. Any part of the remaining quantity can be dispensed; the rest stays open for a
+// later dispensing.
+// itemsJSON is a JSON array of {"drugCode", "quantity"}.
+func (s *BPJSSmartContract) DispenseMedication(ctx contractapi.TransactionContextInterface,
+	prescriptionID string, pharmacyCode string, dispenseDate string, itemsJSON string) error {
+
+	prescription, err := s.getPrescription(ctx, prescriptionID)
 	if err != nil {
 		return err
 	}
+	if prescription.Status == PrescriptionStatusDispensed {
+		return fmt.Errorf("prescription %s is already fully dispensed", prescriptionID)
+	}
+	if _, err := s.VerifyCard(ctx, prescription.CardID); err != nil {
+		return fmt.Errorf("card verification failed: %v", err)
+	}
+	pharmacy, err := s.resolveFaskes(ctx, pharmacyCode)
+	if err != nil {
+		return err
+	}
+	if err := requireFaskesOwner(ctx, pharmacy); err != nil {
+		return err
+	}
+	if err := validateEpisodeDate(ctx, dispenseDate, prescription.PrescriptionDate, "prescription date"); err != nil {
+		return err
+	}
 
-	// Create composite key for querying visits by patient
-	indexName := "patientID~visitID"
-	indexKey, _ := ctx.GetStub().CreateCompositeKey(indexName, []string{patientID, visitID})
-	ctx.GetStub().PutState(indexKey, []byte{0x00})
+	var items []DispensedItem
+	if err := json.Unmarshal([]byte(itemsJSON), &items); err != nil {
+		return fmt.Errorf("failed to unmarshal dispensed items: %v", err)
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("no dispensed items given")
+	}
 
-	ctx.GetStub().SetEvent("VisitRecorded", []byte(fmt.Sprintf("Visit %s recorded for %s", visitID, patientName)))
+	lines := make(map[string]*PrescriptionItem)
+	for i := range prescription.Items {
+		lines[prescription.Items[i].DrugCode] = &prescription.Items[i]
+	}
+	for _, item := range items {
+		line, ok := lines[item.DrugCode]
+		if !ok {
+			return fmt.Errorf("drug %s is not on prescription %s", item.DrugCode, prescriptionID)
+		}
+		if item.Quantity < 1 {
+			return fmt.Errorf("dispensed quantity of drug %s must be at least 1", item.DrugCode)
+		}
+		if remaining := line.Quantity - line.DispensedQuantity; item.Quantity > remaining {
+			return fmt.Errorf("cannot dispense %d of drug %s, only %d remaining", item.Quantity, item.DrugCode, remaining)
+		}
+		line.DispensedQuantity += item.Quantity
+	}
+
+	prescription.Status = PrescriptionStatusDispensed
+	for _, line := range prescription.Items {
+		if line.DispensedQuantity < line.Quantity {
+			prescription.Status = PrescriptionStatusPartiallyDispensed
+			break
+		}
+	}
+
+	dispenser, _ := ctx.GetClientIdentity().GetID()
+	prescription.Dispensings = append(prescription.Dispensings, Dispensing{
+		PharmacyCode: pharmacyCode,
+		DispenseDate: dispenseDate,
+		Items:        items,
+		DispensedBy:  dispenser,
+	})
+	if err := s.putPrescription(ctx, prescription); err != nil {
+		return err
+	}
 
-	return s.createAuditLog(ctx, "RecordVisit", "visit", visitID, recorder, "FASKES_STAFF",
-		fmt.Sprintf("Recorded visit for %s at %s", patientName, faskesName))
+	ctx.GetStub().SetEvent("MedicationDispensed", []byte(fmt.Sprintf("Prescription %s %s by %s", prescriptionID, prescription.Status, pharmacy.Name)))
+
+	return s.createAuditLog(ctx, "DispenseMedication", "prescription", prescriptionID, dispenser, "PHARMACY_STAFF",
+		fmt.Sprintf("Dispensed %d drugs at %s, prescription %s", len(items), pharmacy.Name, prescription.Status))
 }
 
-// GetPatientVisits retrieves all visits for a patient
-func (s *BPJSSmartContract) GetPatientVisits(ctx contractapi.TransactionContextInterface,
-	patientID string) ([]*Visit, error) {
+// GetPatientPrescriptions retrieves all prescriptions for a patient
+func (s *BPJSSmartContract) GetPatientPrescriptions(ctx contractapi.TransactionContextInterface,
+	patientID string) ([]*Prescription, error) {
 
-	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("patientID~visitID", []string{patientID})
+	return s.getPrescriptionsByIndex(ctx, "patientID~prescriptionID", patientID)
+}
+
+// getPrescriptionsByIndex retrieves the prescriptions listed under a composite key index
+func (s *BPJSSmartContract) getPrescriptionsByIndex(ctx contractapi.TransactionContextInterface,
+	indexName string, value string) ([]*Prescription, error) {
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(indexName, []string{value})
 	if err != nil {
 		return nil, err
 	}
 	defer resultsIterator.Close()
 
-	var visits []*Visit
+	var prescriptions []*Prescription
 	for resultsIterator.HasNext() {
 		response, err := resultsIterator.Next()
 		if err != nil {
 			return nil, err
 		}
 
-		// Extract visitID from composite key
 		_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(response.Key)
 		if err != nil {
 			continue
 		}
-		visitID := compositeKeyParts[1]
 
-		// Get actual visit data
-		visitJSON, err := ctx.GetStub().GetState(visitID)
+		prescription, err := s.getPrescription(ctx, compositeKeyParts[1])
 		if err != nil {
 			continue
 		}
+		prescriptions = append(prescriptions, prescription)
+	}
 
-		var visit Visit
-		json.Unmarshal(visitJSON, &visit)
-		visits = append(visits, &visit)
+	return prescriptions, nil
+}
+
+// getPrescription reads a prescription from the world state
+func (s *BPJSSmartContract) getPrescription(ctx contractapi.TransactionContextInterface,
+	prescriptionID string) (*Prescription, error) {
+
+	prescriptionJSON, err := ctx.GetStub().GetState(prescriptionKey(prescriptionID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if prescriptionJSON == nil {
+		return nil, fmt.Errorf("prescription %s not found", prescriptionID)
 	}
 
-	return visits, nil
+	var prescription Prescription
+	err = json.Unmarshal(prescriptionJSON, &prescription)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal prescription: %v", err)
+	}
+	return &prescription, nil
+}
+
+// putPrescription writes a prescription to the world state
+func (s *BPJSSmartContract) putPrescription(ctx contractapi.TransactionContextInterface, prescription *Prescription) error {
+	prescription.Timestamp = getTxTimestamp(ctx)
+
+	prescriptionJSON, err := json.Marshal(prescription)
+	if err != nil {
+		return fmt.Errorf("failed to marshal prescription: %v", err)
+	}
+	return ctx.GetStub().PutState(prescriptionKey(prescription.PrescriptionID), prescriptionJSON)
 }
 
 // ===== REFERRAL MANAGEMENT FUNCTIONS =====
 
+// Referral statuses
+const (
+	ReferralStatusPending   = "pending"
+	ReferralStatusAccepted  = "accepted"
+	ReferralStatusCompleted = "completed"
+	ReferralStatusExpired   = "expired"
+	ReferralStatusCancelled = "cancelled"
+)
+
+// referralStatusTransitions lists, per current status, the statuses UpdateReferralStatus may move a
+// referral to. Only the visit that uses a referral completes it (RecordVisit); completed, expired
+// and cancelled referrals are final, so a used referral cannot be reopened for another visit.
+var referralStatusTransitions = map[string][]string{
+	ReferralStatusPending:   {ReferralStatusAccepted, ReferralStatusExpired, ReferralStatusCancelled},
+	ReferralStatusAccepted:  {ReferralStatusExpired, ReferralStatusCancelled},
+	ReferralStatusCompleted: {},
+	ReferralStatusExpired:   {},
+	ReferralStatusCancelled: {},
+}
+
+// validateReferralStatusTransition checks a status change against referralStatusTransitions
+func validateReferralStatusTransition(referralID string, fromStatus string, toStatus string) error {
+	if _, ok := referralStatusTransitions[toStatus]; !ok {
+		return fmt.Errorf("unknown referral status %s", toStatus)
+	}
+	for _, allowed := range referralStatusTransitions[fromStatus] {
+		if allowed == toStatus {
+			return nil
+		}
+	}
+	return fmt.Errorf("referral %s cannot change status from %s to %s", referralID, fromStatus, toStatus)
+}
+
 // CreateReferral creates a patient referral
 func (s *BPJSSmartContract) CreateReferral(ctx contractapi.TransactionContextInterface,
 	referralID string, patientID string, patientName string, cardID string,
-	fromFaskesCode string, fromFaskesName string, toFaskesCode string, toFaskesName string,
-	referralReason string, diagnosis string, referringDoctor string,
+	fromFaskesCode string, toFaskesCode string, referralReason string, diagnosis string, referringDoctor string,
 	referralDate string, validUntil string, notes string) error {
 
+	if err := ensureKeyUnused(ctx, referralKey(referralID), "referral", referralID); err != nil {
+		return err
+	}
+	if _, err := parseDate(referralDate); err != nil {
+		return fmt.Errorf("invalid referral date: %v", err)
+	}
+	if _, err := parseDate(validUntil); err != nil {
+		return fmt.Errorf("invalid valid until date: %v", err)
+	}
+	if validUntil < referralDate {
+		return fmt.Errorf("referral valid until %s is before referral date %s", validUntil, referralDate)
+	}
+
 	// Verify card
-	_, err := s.VerifyCard(ctx, cardID)
+	card, err := s.VerifyCard(ctx, cardID)
 	if err != nil {
 		return fmt.Errorf("card verification failed: %v", err)
 	}
+	// Visits trust the referral's patient, so it must be the card holder
+	if card.PatientID != patientID {
+		return fmt.Errorf("referral patient %s is not the holder of card %s", patientID, cardID)
+	}
+
+	fromFaskes, err := s.resolveFaskes(ctx, fromFaskesCode)
+	if err != nil {
+		return err
+	}
+	if err := requireFaskesOwner(ctx, fromFaskes); err != nil {
+		return err
+	}
+	toFaskes, err := s.resolveFaskes(ctx, toFaskesCode)
+	if err != nil {
+		return err
+	}
+	if toFaskesCode == fromFaskesCode {
+		return fmt.Errorf("cannot refer from faskes %s to itself", fromFaskesCode)
+	}
+	// Referrals are only consumed by outpatient visits at advanced care facilities
+	if toFaskes.Type != FaskesTypeFKRTL {
+		return fmt.Errorf("cannot refer to %s faskes %s, referrals must go to an FKRTL", toFaskes.Type, toFaskesCode)
+	}
+	if _, err := s.resolvePractitioner(ctx, referringDoctor, fromFaskesCode, referralDate); err != nil {
+		return err
+	}
 
 	creator, _ := ctx.GetClientIdentity().GetID()
 
@@ -366,22 +4986,22 @@ func (s *BPJSSmartContract) CreateReferral(ctx contractapi.TransactionContextInt
 		PatientName:     patientName,
 		CardID:          cardID,
 		FromFaskesCode:  fromFaskesCode,
-		FromFaskesName:  fromFaskesName,
+		FromFaskesName:  fromFaskes.Name,
 		ToFaskesCode:    toFaskesCode,
-		ToFaskesName:    toFaskesName,
+		ToFaskesName:    toFaskes.Name,
 		ReferralReason:  referralReason,
 		Diagnosis:       diagnosis,
 		ReferringDoctor: referringDoctor,
 		ReferralDate:    referralDate,
 		ValidUntil:      validUntil,
-		Status:          "pending",
+		Status:          ReferralStatusPending,
 		Notes:           notes,
 		CreatedBy:       creator,
 		Timestamp:       getTxTimestamp(ctx),
 	}
 
 	referralJSON, _ := json.Marshal(referral)
-	err = ctx.GetStub().PutState(referralID, referralJSON)
+	err = ctx.GetStub().PutState(referralKey(referralID), referralJSON)
 	if err != nil {
 		return err
 	}
@@ -389,18 +5009,21 @@ func (s *BPJSSmartContract) CreateReferral(ctx contractapi.TransactionContextInt
 	// Create index for querying
 	indexKey, _ := ctx.GetStub().CreateCompositeKey("patientID~referralID", []string{patientID, referralID})
 	ctx.GetStub().PutState(indexKey, []byte{0x00})
+	doctorIndexKey, _ := ctx.GetStub().CreateCompositeKey("practitionerID~referralID", []string{referringDoctor, referralID})
+	ctx.GetStub().PutState(doctorIndexKey, []byte{0x00})
 
 	ctx.GetStub().SetEvent("ReferralCreated", []byte(fmt.Sprintf("Referral %s created for %s", referralID, patientName)))
 
 	return s.createAuditLog(ctx, "CreateReferral", "referral", referralID, creator, "FASKES_STAFF",
-		fmt.Sprintf("Created referral from %s to %s", fromFaskesName, toFaskesName))
+		fmt.Sprintf("Created referral from %s to %s", fromFaskes.Name, toFaskes.Name))
 }
 
-// UpdateReferralStatus updates referral status
+// UpdateReferralStatus moves a referral to a new status following referralStatusTransitions.
+// Only the receiving facility accepts a referral; the caller is recorded as accepting it.
 func (s *BPJSSmartContract) UpdateReferralStatus(ctx contractapi.TransactionContextInterface,
-	referralID string, newStatus string, acceptedBy string, notes string) error {
+	referralID string, newStatus string, notes string) error {
 
-	referralJSON, err := ctx.GetStub().GetState(referralID)
+	referralJSON, err := ctx.GetStub().GetState(referralKey(referralID))
 	if err != nil || referralJSON == nil {
 		return fmt.Errorf("referral %s not found", referralID)
 	}
@@ -408,37 +5031,235 @@ func (s *BPJSSmartContract) UpdateReferralStatus(ctx contractapi.TransactionCont
 	var referral Referral
 	json.Unmarshal(referralJSON, &referral)
 
+	oldStatus := referral.Status
+	if err := validateReferralStatusTransition(referralID, oldStatus, newStatus); err != nil {
+		return err
+	}
+
+	actor, _ := ctx.GetClientIdentity().GetID()
+
 	referral.Status = newStatus
-	referral.AcceptedBy = acceptedBy
-	referral.AcceptedDate = getTxTimestamp(ctx).Format("2006-01-02")
+	if newStatus == ReferralStatusAccepted {
+		toFaskes, err := s.resolveFaskes(ctx, referral.ToFaskesCode)
+		if err != nil {
+			return err
+		}
+		if err := requireFaskesOwner(ctx, toFaskes); err != nil {
+			return err
+		}
+		referral.AcceptedBy = actor
+		referral.AcceptedDate = getTxTimestamp(ctx).Format("2006-01-02")
+	}
 	referral.Notes = notes
 	referral.Timestamp = getTxTimestamp(ctx)
 
 	updatedJSON, _ := json.Marshal(referral)
-	err = ctx.GetStub().PutState(referralID, updatedJSON)
+	err = ctx.GetStub().PutState(referralKey(referralID), updatedJSON)
 	if err != nil {
 		return err
 	}
 
-	actor, _ := ctx.GetClientIdentity().GetID()
-	return s.createAuditLog(ctx, "UpdateReferralStatus", "referral", referralID, actor, "FASKES_STAFF",
-		fmt.Sprintf("Referral status updated to %s", newStatus))
+	return s.createStateChangeAuditLog(ctx, "UpdateReferralStatus", "referral", referralID, actor, "FASKES_STAFF",
+		oldStatus, newStatus, "", fmt.Sprintf("Referral status updated from %s to %s", oldStatus, newStatus))
+}
+
+// resolveReferral returns an accepted referral of the patient to the facility that is valid on the visit date
+func (s *BPJSSmartContract) resolveReferral(ctx contractapi.TransactionContextInterface,
+	referralID string, patientID string, faskesCode string, visitDate string) (*Referral, error) {
+
+	referralJSON, err := ctx.GetStub().GetState(referralKey(referralID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if referralJSON == nil {
+		return nil, fmt.Errorf("referral %s not found", referralID)
+	}
+
+	var referral Referral
+	err = json.Unmarshal(referralJSON, &referral)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal referral: %v", err)
+	}
+
+	if referral.PatientID != patientID {
+		return nil, fmt.Errorf("referral %s is for patient %s, not %s", referralID, referral.PatientID, patientID)
+	}
+	if referral.ToFaskesCode != faskesCode {
+		return nil, fmt.Errorf("referral %s is to faskes %s, not %s", referralID, referral.ToFaskesCode, faskesCode)
+	}
+	if referral.Status != ReferralStatusAccepted {
+		return nil, fmt.Errorf("referral %s is %s, not accepted", referralID, referral.Status)
+	}
+	if _, err := parseDate(visitDate); err != nil {
+		return nil, err
+	}
+	today := getTxTimestamp(ctx).Format("2006-01-02")
+	if visitDate > today {
+		return nil, fmt.Errorf("visit date %s is in the future", visitDate)
+	}
+	if visitDate < referral.ReferralDate {
+		return nil, fmt.Errorf("visit date %s is before referral %s was made on %s", visitDate, referralID, referral.ReferralDate)
+	}
+	// A backdated visit cannot use a referral that has since expired
+	if visitDate > referral.ValidUntil || today > referral.ValidUntil {
+		return nil, fmt.Errorf("referral %s expired on %s", referralID, referral.ValidUntil)
+	}
+	return &referral, nil
+}
+
+// getCardReferrals retrieves all referrals made on a card or on any card it replaced or was replaced by
+func (s *BPJSSmartContract) getCardReferrals(ctx contractapi.TransactionContextInterface,
+	cardID string) ([]*Referral, error) {
+
+	chain, err := s.getCardChain(ctx, cardID)
+	if err != nil {
+		return nil, err
+	}
+
+	chainCardIDs, patientIDs := splitCardChain(chain)
+
+	var referrals []*Referral
+	for _, patientID := range patientIDs {
+		resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("patientID~referralID", []string{patientID})
+		if err != nil {
+			return nil, err
+		}
+
+		for resultsIterator.HasNext() {
+			response, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return nil, err
+			}
+
+			_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(response.Key)
+			if err != nil {
+				continue
+			}
+			referralJSON, err := ctx.GetStub().GetState(referralKey(compositeKeyParts[1]))
+			if err != nil || referralJSON == nil {
+				continue
+			}
+
+			var referral Referral
+			json.Unmarshal(referralJSON, &referral)
+			if chainCardIDs[referral.CardID] {
+				referrals = append(referrals, &referral)
+			}
+		}
+		resultsIterator.Close()
+	}
+
+	return referrals, nil
 }
 
 // ===== CLAIM PROCESSING FUNCTIONS =====
 
+// claimTypes lists the services a claim can bill
+var claimTypes = map[string]bool{
+	"rawat-jalan": true,
+	"rawat-inap":  true,
+	"emergency":   true,
+	"obat-kronis": true,
+}
+
 // SubmitClaim submits an insurance claim
 func (s *BPJSSmartContract) SubmitClaim(ctx contractapi.TransactionContextInterface,
 	claimID string, patientID string, patientName string, cardID string, visitID string,
-	faskesCode string, faskesName string, claimType string, serviceDate string,
-	diagnosis string, treatment string, totalAmount float64, claimAmount float64) error {
+	faskesCode string, claimType string, serviceDate string,
+	diagnosis string, treatment string, totalAmount float64, claimAmount float64,
+	roomClass string, primaryDiagnosisCode string, secondaryDiagnosisCodes string) error {
+
+	if err := ensureKeyUnused(ctx, claimKey(claimID), "claim", claimID); err != nil {
+		return err
+	}
+	if !claimTypes[claimType] {
+		return fmt.Errorf("invalid claim type %s, must be rawat-jalan, rawat-inap, emergency or obat-kronis", claimType)
+	}
 
 	// Verify card and visit exist
-	_, err := s.VerifyCard(ctx, cardID)
+	card, err := s.verifyClaimCard(ctx, cardID, serviceDate)
 	if err != nil {
 		return fmt.Errorf("card verification failed: %v", err)
 	}
 
+	primaryCode, secondaryCodes, icd10Version, err := s.validateDiagnosisCodes(ctx, primaryDiagnosisCode, secondaryDiagnosisCodes)
+	if err != nil {
+		return err
+	}
+
+	faskes, err := s.resolveFaskes(ctx, faskesCode)
+	if err != nil {
+		return err
+	}
+	if err := requireFaskesOwner(ctx, faskes); err != nil {
+		return err
+	}
+
+	// Only the facility that recorded the visit can claim for it
+	visit, err := s.getVisit(ctx, visitID)
+	if err != nil {
+		return err
+	}
+	if visit.FaskesCode != faskesCode {
+		return fmt.Errorf("visit %s was recorded at faskes %s, not %s", visitID, visit.FaskesCode, faskesCode)
+	}
+
+	// The claim is for the card holder's own visit, possibly recorded on a card since replaced
+	if patientID != card.PatientID {
+		return fmt.Errorf("claim patient %s is not the holder of card %s", patientID, cardID)
+	}
+	chain, err := s.getCardChain(ctx, cardID)
+	if err != nil {
+		return err
+	}
+	chainCardIDs, _ := splitCardChain(chain)
+	if !chainCardIDs[visit.CardID] || visit.PatientID != patientID {
+		return fmt.Errorf("visit %s of patient %s on card %s does not match claim patient %s on card %s",
+			visitID, visit.PatientID, visit.CardID, patientID, cardID)
+	}
+	if (visit.Episode != nil || visit.VisitType == "inpatient") && claimType != "rawat-inap" {
+		return fmt.Errorf("visit %s is an inpatient stay and must be claimed as rawat-inap, not %s", visitID, claimType)
+	}
+
+	// Inpatient claims are covered up to the member's care class
+	entitledClass := entitledCareClass(card)
+	coPayment := 0.0
+	lengthOfStay := 0
+	if claimType == "rawat-inap" {
+		if _, ok := careClassTariffFactors[roomClass]; !ok {
+			return fmt.Errorf("invalid room class %q for inpatient claim, must be 1, 2 or 3", roomClass)
+		}
+
+		// INA-CBG inpatient claims are only submitted for a finished episode
+		if visit.Episode == nil {
+			return fmt.Errorf("visit %s has no inpatient episode", visitID)
+		}
+		if visit.Episode.Status != EpisodeStatusDischarged {
+			return fmt.Errorf("inpatient episode of visit %s is not discharged", visitID)
+		}
+		lengthOfStay = visit.Episode.LengthOfStay
+
+		claimAmount, coPayment = splitCoPayment(claimAmount, roomClass, entitledClass)
+	} else {
+		roomClass = ""
+	}
+
+	// Prescriptions of the visit are linked to the claim; chronic drug claims bill dispensed medication
+	prescriptions, err := s.getPrescriptionsByIndex(ctx, "visitID~prescriptionID", visitID)
+	if err != nil {
+		return err
+	}
+	var prescriptionIDs []string
+	dispensed := false
+	for _, prescription := range prescriptions {
+		prescriptionIDs = append(prescriptionIDs, prescription.PrescriptionID)
+		dispensed = dispensed || len(prescription.Dispensings) > 0
+	}
+	if claimType == "obat-kronis" && !dispensed {
+		return fmt.Errorf("visit %s has no dispensed prescription for a chronic drug claim", visitID)
+	}
+
 	submitter, _ := ctx.GetClientIdentity().GetID()
 
 	claim := Claim{
@@ -448,40 +5269,121 @@ func (s *BPJSSmartContract) SubmitClaim(ctx contractapi.TransactionContextInterf
 		CardID:      cardID,
 		VisitID:     visitID,
 		FaskesCode:  faskesCode,
-		FaskesName:  faskesName,
+		FaskesName:  faskes.Name,
 		ClaimType:   claimType,
 		ServiceDate: serviceDate,
 		Diagnosis:   diagnosis,
 		Treatment:   treatment,
 		TotalAmount: totalAmount,
 		ClaimAmount: claimAmount,
-		Status:      "submitted",
+		Status:      ClaimStatusSubmitted,
 		SubmittedBy: submitter,
 		SubmitDate:  getTxTimestamp(ctx).Format("2006-01-02"),
 		Timestamp:   getTxTimestamp(ctx),
+
+		RoomClass:     roomClass,
+		EntitledClass: entitledClass,
+		CoPayment:     coPayment,
+
+		LengthOfStay: lengthOfStay,
+
+		PrimaryDiagnosisCode:    primaryCode,
+		SecondaryDiagnosisCodes: secondaryCodes,
+		ICD10Version:            icd10Version,
+
+		// Procedures are billed as coded on the visit
+		Procedures:    visit.Procedures,
+		ICD9CMVersion: visit.ICD9CMVersion,
+
+		PrescriptionIDs: prescriptionIDs,
+	}
+
+	claimJSON, _ := json.Marshal(claim)
+	err = ctx.GetStub().PutState(claimKey(claimID), claimJSON)
+	if err != nil {
+		return err
+	}
+
+	// Create index
+	indexKey, _ := ctx.GetStub().CreateCompositeKey("patientID~claimID", []string{patientID, claimID})
+	ctx.GetStub().PutState(indexKey, []byte{0x00})
+
+	for _, procedure := range claim.Procedures {
+		procedureKey, _ := ctx.GetStub().CreateCompositeKey("procedureCode~claimID", []string{procedure.Code, claimID})
+		ctx.GetStub().PutState(procedureKey, []byte{0x00})
+	}
+
+	ctx.GetStub().SetEvent("ClaimSubmitted", []byte(fmt.Sprintf("Claim %s submitted by %s", claimID, faskes.Name)))
+
+	return s.createAuditLog(ctx, "SubmitClaim", "claim", claimID, submitter, "FASKES_STAFF",
+		fmt.Sprintf("Submitted claim for %.2f", claimAmount))
+}
+
+// verifyClaimCard checks the card a claim is billed to. The card of a deceased member still
+// covers care given up to the date of death.
+func (s *BPJSSmartContract) verifyClaimCard(ctx contractapi.TransactionContextInterface,
+	cardID string, serviceDate string) (*BPJSCard, error) {
+
+	cardJSON, err := ctx.GetStub().GetState(cardKey(cardID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if cardJSON == nil {
+		return nil, fmt.Errorf("card %s not found", cardID)
+	}
+
+	var card BPJSCard
+	if err := json.Unmarshal(cardJSON, &card); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal card: %v", err)
 	}
 
-	claimJSON, _ := json.Marshal(claim)
-	err = ctx.GetStub().PutState(claimID, claimJSON)
-	if err != nil {
-		return err
+	if card.Status == CardStatusDeceased && serviceDate != "" && serviceDate <= card.DateOfDeath {
+		if _, err := parseDate(serviceDate); err != nil {
+			return nil, err
+		}
+		return &card, nil
 	}
+	return s.VerifyCard(ctx, cardID)
+}
 
-	// Create index
-	indexKey, _ := ctx.GetStub().CreateCompositeKey("patientID~claimID", []string{patientID, claimID})
-	ctx.GetStub().PutState(indexKey, []byte{0x00})
+// Claim statuses
+const (
+	ClaimStatusSubmitted = "submitted"
+	ClaimStatusReviewing = "reviewing"
+	ClaimStatusApproved  = "approved"
+	ClaimStatusRejected  = "rejected"
+	ClaimStatusPaid      = "paid"
+)
 
-	ctx.GetStub().SetEvent("ClaimSubmitted", []byte(fmt.Sprintf("Claim %s submitted by %s", claimID, faskesName)))
+// claimStatusTransitions lists, per current status, the statuses ProcessClaim may move a claim
+// to. Rejected and paid claims are final.
+var claimStatusTransitions = map[string][]string{
+	ClaimStatusSubmitted: {ClaimStatusReviewing, ClaimStatusApproved, ClaimStatusRejected},
+	ClaimStatusReviewing: {ClaimStatusApproved, ClaimStatusRejected},
+	ClaimStatusApproved:  {ClaimStatusPaid},
+	ClaimStatusRejected:  {},
+	ClaimStatusPaid:      {},
+}
 
-	return s.createAuditLog(ctx, "SubmitClaim", "claim", claimID, submitter, "FASKES_STAFF",
-		fmt.Sprintf("Submitted claim for %.2f", claimAmount))
+// validateClaimStatusTransition checks a status change against claimStatusTransitions
+func validateClaimStatusTransition(claimID string, fromStatus string, toStatus string) error {
+	if _, ok := claimStatusTransitions[toStatus]; !ok {
+		return fmt.Errorf("unknown claim status %s", toStatus)
+	}
+	for _, allowed := range claimStatusTransitions[fromStatus] {
+		if allowed == toStatus {
+			return nil
+		}
+	}
+	return fmt.Errorf("claim %s cannot change status from %s to %s", claimID, fromStatus, toStatus)
 }
 
-// ProcessClaim processes claim approval/rejection
+// ProcessClaim moves a claim to a new status following claimStatusTransitions. Flagged claims
+// cannot be approved or paid.
 func (s *BPJSSmartContract) ProcessClaim(ctx contractapi.TransactionContextInterface,
 	claimID string, newStatus string, reviewNotes string) error {
 
-	claimJSON, err := ctx.GetStub().GetState(claimID)
+	claimJSON, err := ctx.GetStub().GetState(claimKey(claimID))
 	if err != nil || claimJSON == nil {
 		return fmt.Errorf("claim %s not found", claimID)
 	}
@@ -489,6 +5391,13 @@ func (s *BPJSSmartContract) ProcessClaim(ctx contractapi.TransactionContextInter
 	var claim Claim
 	json.Unmarshal(claimJSON, &claim)
 
+	if err := validateClaimStatusTransition(claimID, claim.Status, newStatus); err != nil {
+		return err
+	}
+	if claim.Flagged && (newStatus == ClaimStatusApproved || newStatus == ClaimStatusPaid) {
+		return fmt.Errorf("claim %s is flagged and cannot be %s: %s", claimID, newStatus, claim.FlagReason)
+	}
+
 	reviewer, _ := ctx.GetClientIdentity().GetID()
 
 	claim.Status = newStatus
@@ -496,14 +5405,14 @@ func (s *BPJSSmartContract) ProcessClaim(ctx contractapi.TransactionContextInter
 	claim.ReviewDate = getTxTimestamp(ctx).Format("2006-01-02")
 	claim.ReviewNotes = reviewNotes
 
-	if newStatus == "approved" {
+	if newStatus == ClaimStatusApproved {
 		claim.PaymentDate = getTxTimestamp(ctx).Add(7 * 24 * time.Hour).Format("2006-01-02") // Payment in 7 days
 	}
 
 	claim.Timestamp = getTxTimestamp(ctx)
 
 	updatedJSON, _ := json.Marshal(claim)
-	err = ctx.GetStub().PutState(claimID, updatedJSON)
+	err = ctx.GetStub().PutState(claimKey(claimID), updatedJSON)
 	if err != nil {
 		return err
 	}
@@ -537,10 +5446,46 @@ func (s *BPJSSmartContract) GetPatientClaims(ctx contractapi.TransactionContextI
 		}
 		claimID := compositeKeyParts[1]
 
-		claimJSON, err := ctx.GetStub().GetState(claimID)
+		claimJSON, err := ctx.GetStub().GetState(claimKey(claimID))
+		if err != nil {
+			continue
+		}
+
+		var claim Claim
+		json.Unmarshal(claimJSON, &claim)
+		claims = append(claims, &claim)
+	}
+
+	return claims, nil
+}
+
+// GetClaimsByProcedure retrieves all claims billing an ICD-9-CM procedure code
+func (s *BPJSSmartContract) GetClaimsByProcedure(ctx contractapi.TransactionContextInterface,
+	procedureCode string) ([]*Claim, error) {
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("procedureCode~claimID", []string{normalizeCode(procedureCode)})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var claims []*Claim
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(response.Key)
 		if err != nil {
 			continue
 		}
+		claimID := compositeKeyParts[1]
+
+		claimJSON, err := ctx.GetStub().GetState(claimKey(claimID))
+		if err != nil || claimJSON == nil {
+			continue
+		}
 
 		var claim Claim
 		json.Unmarshal(claimJSON, &claim)
@@ -550,12 +5495,166 @@ func (s *BPJSSmartContract) GetPatientClaims(ctx contractapi.TransactionContextI
 	return claims, nil
 }
 
+// GetCardClaims retrieves all claims submitted on a card or on any card it replaced or was replaced by
+func (s *BPJSSmartContract) GetCardClaims(ctx contractapi.TransactionContextInterface,
+	cardID string) ([]*Claim, error) {
+
+	chain, err := s.getCardChain(ctx, cardID)
+	if err != nil {
+		return nil, err
+	}
+
+	chainCardIDs, patientIDs := splitCardChain(chain)
+
+	var claims []*Claim
+	for _, patientID := range patientIDs {
+		patientClaims, err := s.GetPatientClaims(ctx, patientID)
+		if err != nil {
+			return nil, err
+		}
+		for _, claim := range patientClaims {
+			if chainCardIDs[claim.CardID] {
+				claims = append(claims, claim)
+			}
+		}
+	}
+
+	return claims, nil
+}
+
+// ===== CLINICAL DOCUMENT FUNCTIONS =====
+
+// sha256Pattern matches a lowercase hex encoded SHA-256 hash
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// AnchorDocument records the SHA-256 hash of an off-chain document (lab result, imaging,
+// resume medis) of a visit or claim. Anchors cannot be changed; a corrected document gets
+// a new anchor.
+func (s *BPJSSmartContract) AnchorDocument(ctx contractapi.TransactionContextInterface,
+	documentID string, sha256Hash string, mediaType string, size int64, visitID string, claimID string) error {
+
+	if err := ensureKeyUnused(ctx, documentKey(documentID), "document", documentID); err != nil {
+		return err
+	}
+	hash, err := normalizeSHA256(sha256Hash)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(mediaType, "/") {
+		return fmt.Errorf("invalid media type %q", mediaType)
+	}
+	if size <= 0 {
+		return fmt.Errorf("document size must be positive")
+	}
+
+	// The document is authored by the facility of its visit or claim
+	var faskesCode string
+	switch {
+	case claimID != "":
+		claimJSON, err := ctx.GetStub().GetState(claimKey(claimID))
+		if err != nil || claimJSON == nil {
+			return fmt.Errorf("claim %s not found", claimID)
+		}
+		var claim Claim
+		err = json.Unmarshal(claimJSON, &claim)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal claim: %v", err)
+		}
+		if visitID != "" && claim.VisitID != visitID {
+			return fmt.Errorf("claim %s is not for visit %s", claimID, visitID)
+		}
+		faskesCode = claim.FaskesCode
+	case visitID != "":
+		visit, err := s.getVisit(ctx, visitID)
+		if err != nil {
+			return err
+		}
+		faskesCode = visit.FaskesCode
+	default:
+		return fmt.Errorf("document must belong to a visit or a claim")
+	}
+	faskes, err := s.getFaskes(ctx, faskesCode)
+	if err != nil {
+		return err
+	}
+	if err := requireFaskesOwner(ctx, faskes); err != nil {
+		return err
+	}
+
+	author, _ := ctx.GetClientIdentity().GetID()
+	authorMSP, _ := ctx.GetClientIdentity().GetMSPID()
+
+	anchor := DocumentAnchor{
+		DocumentID: documentID,
+		SHA256:     hash,
+		MediaType:  mediaType,
+		Size:       size,
+		VisitID:    visitID,
+		ClaimID:    claimID,
+		Author:     author,
+		AuthorMSP:  authorMSP,
+		TxID:       ctx.GetStub().GetTxID(),
+		Timestamp:  getTxTimestamp(ctx),
+	}
+	anchorJSON, err := json.Marshal(anchor)
+	if err != nil {
+		return fmt.Errorf("failed to marshal document anchor: %v", err)
+	}
+	if err := ctx.GetStub().PutState(documentKey(documentID), anchorJSON); err != nil {
+		return err
+	}
+
+	ctx.GetStub().SetEvent("DocumentAnchored", []byte(fmt.Sprintf("Document %s anchored at %s", documentID, faskes.Name)))
+
+	return s.createAuditLog(ctx, "AnchorDocument", "document", documentID, author, "FASKES_STAFF",
+		fmt.Sprintf("Anchored %s document of %d bytes, SHA-256 %s", mediaType, size, hash))
+}
+
+// VerifyDocument checks the SHA-256 hash of a presented document against its anchor
+func (s *BPJSSmartContract) VerifyDocument(ctx contractapi.TransactionContextInterface,
+	documentID string, sha256Hash string) (*DocumentVerification, error) {
+
+	hash, err := normalizeSHA256(sha256Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	anchorJSON, err := ctx.GetStub().GetState(documentKey(documentID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if anchorJSON == nil {
+		return nil, fmt.Errorf("document %s is not anchored", documentID)
+	}
+
+	var anchor DocumentAnchor
+	err = json.Unmarshal(anchorJSON, &anchor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal document anchor: %v", err)
+	}
+
+	return &DocumentVerification{
+		DocumentID: documentID,
+		Match:      anchor.SHA256 == hash,
+		Anchor:     &anchor,
+	}, nil
+}
+
+// normalizeSHA256 lowercases a hex encoded SHA-256 hash and checks its format
+func normalizeSHA256(hash string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(hash))
+	if !sha256Pattern.MatchString(normalized) {
+		return "", fmt.Errorf("invalid SHA-256 hash %q", hash)
+	}
+	return normalized, nil
+}
+
 // ===== GET ALL FUNCTIONS =====
 
 // GetAllCards retrieves all BPJS cards from the blockchain
 func (s *BPJSSmartContract) GetAllCards(ctx contractapi.TransactionContextInterface) ([]*BPJSCard, error) {
 	// Query with empty string to get all
-	resultsIterator, err := ctx.GetStub().GetStateByRange("CARD", "CARD~")
+	resultsIterator, err := ctx.GetStub().GetStateByRange(cardKeyPrefix, cardKeyPrefix+"~")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get cards: %v", err)
 	}
@@ -579,9 +5678,9 @@ func (s *BPJSSmartContract) GetAllCards(ctx contractapi.TransactionContextInterf
 	return cards, nil
 }
 
-// GetAllVisits retrieves all patient visits from the blockchain
+// GetAllVisits retrieves all patient visits from the blockchain, with their addenda applied
 func (s *BPJSSmartContract) GetAllVisits(ctx contractapi.TransactionContextInterface) ([]*Visit, error) {
-	resultsIterator, err := ctx.GetStub().GetStateByRange("VISIT", "VISIT~")
+	resultsIterator, err := ctx.GetStub().GetStateByRange(visitKeyPrefix, visitKeyPrefix+"~")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get visits: %v", err)
 	}
@@ -599,6 +5698,7 @@ func (s *BPJSSmartContract) GetAllVisits(ctx contractapi.TransactionContextInter
 		if err != nil {
 			continue // Skip invalid entries
 		}
+		applyVisitAddenda(&visit)
 		visits = append(visits, &visit)
 	}
 
@@ -607,7 +5707,7 @@ func (s *BPJSSmartContract) GetAllVisits(ctx contractapi.TransactionContextInter
 
 // GetAllClaims retrieves all insurance claims from the blockchain
 func (s *BPJSSmartContract) GetAllClaims(ctx contractapi.TransactionContextInterface) ([]*Claim, error) {
-	resultsIterator, err := ctx.GetStub().GetStateByRange("CLAIM", "CLAIM~")
+	resultsIterator, err := ctx.GetStub().GetStateByRange(claimKeyPrefix, claimKeyPrefix+"~")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get claims: %v", err)
 	}
@@ -633,7 +5733,7 @@ func (s *BPJSSmartContract) GetAllClaims(ctx contractapi.TransactionContextInter
 
 // GetAllReferrals retrieves all referrals from the blockchain
 func (s *BPJSSmartContract) GetAllReferrals(ctx contractapi.TransactionContextInterface) ([]*Referral, error) {
-	resultsIterator, err := ctx.GetStub().GetStateByRange("REF", "REF~")
+	resultsIterator, err := ctx.GetStub().GetStateByRange(referralKeyPrefix, referralKeyPrefix+"~")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get referrals: %v", err)
 	}
@@ -683,30 +5783,337 @@ func (s *BPJSSmartContract) GetAllAuditLogs(ctx contractapi.TransactionContextIn
 	return logs, nil
 }
 
+// ===== HISTORY FUNCTIONS =====
+
+// GetCardHistory returns every version of a card from the ledger history, oldest first
+func (s *BPJSSmartContract) GetCardHistory(ctx contractapi.TransactionContextInterface,
+	cardID string) ([]*HistoryEntry, error) {
+
+	return s.getKeyHistory(ctx, "card", cardID, cardKey(cardID))
+}
+
+// GetVisitHistory returns every version of a visit from the ledger history, oldest first
+func (s *BPJSSmartContract) GetVisitHistory(ctx contractapi.TransactionContextInterface,
+	visitID string) ([]*HistoryEntry, error) {
+
+	return s.getKeyHistory(ctx, "visit", visitID, visitKey(visitID))
+}
+
+// GetReferralHistory returns every version of a referral from the ledger history, oldest first
+func (s *BPJSSmartContract) GetReferralHistory(ctx contractapi.TransactionContextInterface,
+	referralID string) ([]*HistoryEntry, error) {
+
+	return s.getKeyHistory(ctx, "referral", referralID, referralKey(referralID))
+}
+
+// GetClaimHistory returns every version of a claim from the ledger history, oldest first
+func (s *BPJSSmartContract) GetClaimHistory(ctx contractapi.TransactionContextInterface,
+	claimID string) ([]*HistoryEntry, error) {
+
+	return s.getKeyHistory(ctx, "claim", claimID, claimKey(claimID))
+}
+
+// getKeyHistory walks the ledger history of an entity and returns its versions oldest first,
+// each with the top-level fields changed since the version before it. Versions written under
+// the bare ID before MigrateKeyNamespaces moved the entity to its key are included, but only
+// those holding an entity of the same type, since another type may have used the same ID.
+func (s *BPJSSmartContract) getKeyHistory(ctx contractapi.TransactionContextInterface,
+	entityType string, id string, key string) ([]*HistoryEntry, error) {
+
+	legacyVersions, err := s.getKeyVersions(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history for %s %s: %v", entityType, id, err)
+	}
+	var history []*HistoryEntry
+	held := false // whether the bare ID last held this entity, for attributing deletes
+	for _, version := range legacyVersions {
+		if !version.IsDelete {
+			held = legacyEntityKey(id, []byte(version.State)) == key
+		}
+		if held {
+			history = append(history, version)
+		}
+	}
+
+	versions, err := s.getKeyVersions(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history for %s %s: %v", entityType, id, err)
+	}
+	history = append(history, versions...)
+	if len(history) == 0 {
+		return nil, fmt.Errorf("%s %s not found", entityType, id)
+	}
+
+	previous := ""
+	for _, entry := range history {
+		changes, err := diffStates(previous, entry.State)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compare versions of %s %s: %v", entityType, id, err)
+		}
+		entry.Changes = changes
+		previous = entry.State
+	}
+
+	return history, nil
+}
+
+// getKeyVersions returns the versions of a single key, oldest first
+func (s *BPJSSmartContract) getKeyVersions(ctx contractapi.TransactionContextInterface,
+	key string) ([]*HistoryEntry, error) {
+
+	resultsIterator, err := ctx.GetStub().GetHistoryForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	// The ledger returns the newest version first
+	var versions []*HistoryEntry
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		entry := &HistoryEntry{
+			TxID:     modification.TxId,
+			IsDelete: modification.IsDelete,
+		}
+		if modification.Timestamp != nil {
+			entry.Timestamp = modification.Timestamp.AsTime()
+		}
+		if !modification.IsDelete {
+			entry.State = string(modification.Value)
+		}
+		versions = append([]*HistoryEntry{entry}, versions...)
+	}
+	return versions, nil
+}
+
+// diffStates lists the top-level fields that differ between two JSON documents. The
+// timestamp field is left out since every version carries its own transaction timestamp.
+func diffStates(oldState string, newState string) ([]FieldChange, error) {
+	oldFields := make(map[string]json.RawMessage)
+	newFields := make(map[string]json.RawMessage)
+	if oldState != "" {
+		if err := json.Unmarshal([]byte(oldState), &oldFields); err != nil {
+			return nil, err
+		}
+	}
+	if newState != "" {
+		if err := json.Unmarshal([]byte(newState), &newFields); err != nil {
+			return nil, err
+		}
+	}
+
+	fieldSet := make(map[string]bool)
+	for field := range oldFields {
+		fieldSet[field] = true
+	}
+	for field := range newFields {
+		fieldSet[field] = true
+	}
+	fields := make([]string, 0, len(fieldSet))
+	for field := range fieldSet {
+		if field != "timestamp" {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	var changes []FieldChange
+	for _, field := range fields {
+		oldValue := historyFieldValue(oldFields[field])
+		newValue := historyFieldValue(newFields[field])
+		if oldValue != newValue {
+			changes = append(changes, FieldChange{Field: field, OldValue: oldValue, NewValue: newValue})
+		}
+	}
+	return changes, nil
+}
+
+// historyFieldValue renders a JSON value for a FieldChange: strings without quotes,
+// anything else as JSON, and a missing field as an empty string
+func historyFieldValue(raw json.RawMessage) string {
+	if raw == nil {
+		return ""
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+	return string(raw)
+}
+
+// ===== KEY MIGRATION FUNCTIONS =====
+
+// KeyMigrationResult reports a MigrateKeyNamespaces run
+type KeyMigrationResult struct {
+	Migrated  []string `json:"migrated"`  // legacy keys moved to their entity's key namespace
+	Conflicts []string `json:"conflicts"` // legacy keys left in place because the namespaced key is in use
+	Remaining bool     `json:"remaining"` // more legacy keys are left for another run
+}
+
+// legacyEntityTypes identifies entities stored under their bare ID before key namespaces were
+// introduced. An entity is legacy when its ID field equals its key; claims and prescriptions
+// also carry a visitID and cardID, so the more specific types are checked first.
+var legacyEntityTypes = []struct {
+	idField string
+	key     func(string) string
+}{
+	{"claimID", claimKey},
+	{"prescriptionID", prescriptionKey},
+	{"referralID", referralKey},
+	{"visitID", visitKey},
+	{"cardID", cardKey},
+}
+
+// MigrateKeyNamespaces moves cards, visits, referrals, claims and prescriptions stored under their
+// bare ID to their namespaced key. Migrated cards are added to the NIK index. At most limit
+// entities are moved per run; run it again while the result reports remaining keys.
+func (s *BPJSSmartContract) MigrateKeyNamespaces(ctx contractapi.TransactionContextInterface,
+	limit int) (*KeyMigrationResult, error) {
+
+	actor, err := requireBPJSOrg(ctx, "key namespace migration")
+	if err != nil {
+		return nil, err
+	}
+	if limit < 1 {
+		return nil, fmt.Errorf("limit must be at least 1")
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan world state: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	result := &KeyMigrationResult{Migrated: []string{}, Conflicts: []string{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		newKey := legacyEntityKey(queryResponse.Key, queryResponse.Value)
+		if newKey == "" {
+			continue
+		}
+		if len(result.Migrated) == limit {
+			result.Remaining = true
+			break
+		}
+
+		existing, err := ctx.GetStub().GetState(newKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from world state: %v", err)
+		}
+		if existing != nil {
+			result.Conflicts = append(result.Conflicts, queryResponse.Key)
+			continue
+		}
+
+		if err := ctx.GetStub().PutState(newKey, queryResponse.Value); err != nil {
+			return nil, err
+		}
+		if err := ctx.GetStub().DelState(queryResponse.Key); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(newKey, cardKeyPrefix) {
+			if err := s.putLegacyCardNIKIndex(ctx, queryResponse.Value); err != nil {
+				return nil, err
+			}
+		}
+		result.Migrated = append(result.Migrated, queryResponse.Key)
+	}
+
+	return result, s.createAuditLog(ctx, "MigrateKeyNamespaces", "ledger", "KEYS", actor, "BPJS_ADMIN",
+		fmt.Sprintf("Moved %d entities to namespaced keys, %d conflicts", len(result.Migrated), len(result.Conflicts)))
+}
+
+// putLegacyCardNIKIndex adds a migrated card to the nik~cardID index, which cards issued
+// before NIK uniqueness was enforced are missing
+func (s *BPJSSmartContract) putLegacyCardNIKIndex(ctx contractapi.TransactionContextInterface, cardJSON []byte) error {
+	var card BPJSCard
+	if err := json.Unmarshal(cardJSON, &card); err != nil {
+		return fmt.Errorf("failed to unmarshal card: %v", err)
+	}
+	if card.NIK == "" {
+		return nil
+	}
+	nikCardIndexKey, err := ctx.GetStub().CreateCompositeKey("nik~cardID", []string{card.NIK, card.CardID})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(nikCardIndexKey, []byte{0x00})
+}
+
+// legacyEntityKey returns the namespaced key of an entity stored under its bare ID,
+// or an empty string when the key does not hold a legacy entity
+func legacyEntityKey(key string, value []byte) string {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return ""
+	}
+	for _, entityType := range legacyEntityTypes {
+		if id, ok := fields[entityType.idField].(string); ok && id == key {
+			return entityType.key(id)
+		}
+	}
+	return ""
+}
+
 // ===== AUDIT FUNCTIONS =====
 
 func (s *BPJSSmartContract) createAuditLog(ctx contractapi.TransactionContextInterface,
 	action string, entityType string, entityID string, actorID string, actorRole string,
 	description string) error {
 
-	orgID, _ := ctx.GetClientIdentity().GetMSPID()
-	logID := fmt.Sprintf("AUDIT_%d", getTxTimestamp(ctx).UnixNano())
+	return s.putAuditLog(ctx, &AuditLog{
+		Action:      action,
+		EntityType:  entityType,
+		EntityID:    entityID,
+		ActorID:     actorID,
+		ActorRole:   actorRole,
+		Description: description,
+	})
+}
 
-	auditLog := AuditLog{
-		LogID:       logID,
+// createStateChangeAuditLog records an audit entry for a status transition
+func (s *BPJSSmartContract) createStateChangeAuditLog(ctx contractapi.TransactionContextInterface,
+	action string, entityType string, entityID string, actorID string, actorRole string,
+	oldState string, newState string, reasonCode string, description string) error {
+
+	return s.putAuditLog(ctx, &AuditLog{
 		Action:      action,
 		EntityType:  entityType,
 		EntityID:    entityID,
 		ActorID:     actorID,
 		ActorRole:   actorRole,
-		OrgID:       orgID,
 		Description: description,
-		IPAddress:   "",
-		Timestamp:   getTxTimestamp(ctx),
+		OldState:    oldState,
+		NewState:    newState,
+		ReasonCode:  reasonCode,
+	})
+}
+
+// putAuditLog fills in the log ID, organization and timestamp and writes the entry
+func (s *BPJSSmartContract) putAuditLog(ctx contractapi.TransactionContextInterface, auditLog *AuditLog) error {
+	sequencer, ok := ctx.(auditSequencer)
+	if !ok {
+		return fmt.Errorf("transaction context does not number audit entries")
 	}
+	orgID, _ := ctx.GetClientIdentity().GetMSPID()
+
+	// The sequence number keeps entries written by the same transaction apart,
+	// also when they are about the same entity
+	auditLog.LogID = fmt.Sprintf("AUDIT_%d_%s_%d", getTxTimestamp(ctx).UnixNano(), auditLog.EntityID,
+		sequencer.nextAuditSequence())
+	auditLog.OrgID = orgID
+	auditLog.Timestamp = getTxTimestamp(ctx)
 
 	auditJSON, _ := json.Marshal(auditLog)
-	return ctx.GetStub().PutState(logID, auditJSON)
+	return ctx.GetStub().PutState(auditLog.LogID, auditJSON)
 }
 
 // QueryAuditLogs retrieves audit logs (can be filtered)
@@ -737,7 +6144,10 @@ func (s *BPJSSmartContract) QueryAuditLogs(ctx contractapi.TransactionContextInt
 // ===== MAIN =====
 
 func main() {
-	chaincode, err := contractapi.NewChaincode(&BPJSSmartContract{})
+	contract := &BPJSSmartContract{}
+	contract.TransactionContextHandler = new(TransactionContext)
+
+	chaincode, err := contractapi.NewChaincode(contract)
 	if err != nil {
 		log.Panicf("Error creating BPJS chaincode: %v", err)
 	}
@@ -1,199 +1,1930 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
-	"fmt"
+	"math/big"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/bpjs-blockchain/chaincode/docstore"
+	"github.com/bpjs-blockchain/chaincode/eligibility"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
 	"github.com/hyperledger/fabric-chaincode-go/shim"
-	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // MockTransactionContext is a mock for testing
 type MockTransactionContext struct {
-	contractapi.TransactionContext
-	stub *MockStub
+	TransactionContext
+	stub  *MockStub
+	MSPID string // organization of the caller, BPJSMSP when empty
 }
 
-// MockStub is a mock stub for testing
+// MockStub is a mock stub for testing. Calls with a registered expectation
+// are answered by the mock, everything else is served from the in-memory State.
 type MockStub struct {
+	shim.ChaincodeStubInterface
 	mock.Mock
-	State map[string][]byte
+	State       map[string][]byte
+	Events      map[string][]byte
+	History     map[string][]*queryresult.KeyModification
+	TxID        string
+	TxTimestamp time.Time
+}
+
+// expects reports whether an expectation was registered for the call
+func (m *MockStub) expects(method string, arguments ...interface{}) bool {
+	for _, call := range m.ExpectedCalls {
+		if call.Method != method {
+			continue
+		}
+		if _, diffCount := call.Arguments.Diff(arguments); diffCount == 0 {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *MockStub) GetState(key string) ([]byte, error) {
-	args := m.Called(key)
-	return args.Get(0).([]byte), args.Error(1)
+	if m.expects("GetState", key) {
+		args := m.Called(key)
+		return args.Get(0).([]byte), args.Error(1)
+	}
+	return m.State[key], nil
 }
 
 func (m *MockStub) PutState(key string, value []byte) error {
-	args := m.Called(key, value)
 	m.State[key] = value
-	return args.Error(0)
+	m.recordHistory(key, value, false)
+	if m.expects("PutState", key, value) {
+		args := m.Called(key, value)
+		return args.Error(0)
+	}
+	return nil
+}
+
+func (m *MockStub) DelState(key string) error {
+	delete(m.State, key)
+	m.recordHistory(key, nil, true)
+	return nil
+}
+
+func (m *MockStub) recordHistory(key string, value []byte, isDelete bool) {
+	txTimestamp, _ := m.GetTxTimestamp()
+	m.History[key] = append(m.History[key], &queryresult.KeyModification{
+		TxId:      m.GetTxID(),
+		Value:     value,
+		Timestamp: txTimestamp,
+		IsDelete:  isDelete,
+	})
+}
+
+// GetHistoryForKey returns the recorded versions of a key newest first, like Fabric
+func (m *MockStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	versions := m.History[key]
+	modifications := make([]*queryresult.KeyModification, len(versions))
+	for i, version := range versions {
+		modifications[len(versions)-1-i] = version
+	}
+	return &MockHistoryIterator{modifications: modifications}, nil
 }
 
 func (m *MockStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
-	return fmt.Sprintf("%s~%s", objectType, attributes[0]), nil
+	key := "\x00" + objectType + "\x00"
+	for _, attribute := range attributes {
+		key += attribute + "\x00"
+	}
+	return key, nil
+}
+
+func (m *MockStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	parts := strings.Split(strings.Trim(compositeKey, "\x00"), "\x00")
+	return parts[0], parts[1:], nil
+}
+
+func (m *MockStub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	var kvs []*queryresult.KV
+	for _, key := range m.sortedKeys() {
+		if strings.HasPrefix(key, "\x00") {
+			continue // composite keys are not part of range queries
+		}
+		if key >= startKey && (endKey == "" || key < endKey) {
+			kvs = append(kvs, &queryresult.KV{Key: key, Value: m.State[key]})
+		}
+	}
+	return &MockStateIterator{kvs: kvs}, nil
+}
+
+func (m *MockStub) GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, _ := m.CreateCompositeKey(objectType, keys)
+	var kvs []*queryresult.KV
+	for _, key := range m.sortedKeys() {
+		if strings.HasPrefix(key, prefix) {
+			kvs = append(kvs, &queryresult.KV{Key: key, Value: m.State[key]})
+		}
+	}
+	return &MockStateIterator{kvs: kvs}, nil
+}
+
+func (m *MockStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	if m.TxTimestamp.IsZero() {
+		return timestamppb.New(time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)), nil
+	}
+	return timestamppb.New(m.TxTimestamp), nil
+}
+
+func (m *MockStub) GetTxID() string {
+	if m.TxID == "" {
+		return "tx1"
+	}
+	return m.TxID
 }
 
 func (m *MockStub) SetEvent(name string, payload []byte) error {
+	m.Events[name] = payload
+	return nil
+}
+
+func (m *MockStub) sortedKeys() []string {
+	keys := make([]string, 0, len(m.State))
+	for key := range m.State {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MockStateIterator iterates over a fixed set of key/value pairs
+type MockStateIterator struct {
+	kvs []*queryresult.KV
+	pos int
+}
+
+func (it *MockStateIterator) HasNext() bool {
+	return it.pos < len(it.kvs)
+}
+
+func (it *MockStateIterator) Next() (*queryresult.KV, error) {
+	kv := it.kvs[it.pos]
+	it.pos++
+	return kv, nil
+}
+
+func (it *MockStateIterator) Close() error {
+	return nil
+}
+
+// MockHistoryIterator iterates over the versions of a key
+type MockHistoryIterator struct {
+	modifications []*queryresult.KeyModification
+	pos           int
+}
+
+func (it *MockHistoryIterator) HasNext() bool {
+	return it.pos < len(it.modifications)
+}
+
+func (it *MockHistoryIterator) Next() (*queryresult.KeyModification, error) {
+	modification := it.modifications[it.pos]
+	it.pos++
+	return modification, nil
+}
+
+func (it *MockHistoryIterator) Close() error {
 	return nil
 }
 
 func NewMockTransactionContext() *MockTransactionContext {
-	stub := &MockStub{State: make(map[string][]byte)}
+	stub := &MockStub{
+		State:   make(map[string][]byte),
+		Events:  make(map[string][]byte),
+		History: make(map[string][]*queryresult.KeyModification),
+	}
 	ctx := &MockTransactionContext{stub: stub}
 	return ctx
 }
 
-func (m *MockTransactionContext) GetStub() shim.ChaincodeStubInterface {
-	return m.stub
-}
+func (m *MockTransactionContext) GetStub() shim.ChaincodeStubInterface {
+	return m.stub
+}
+
+func (m *MockTransactionContext) GetClientIdentity() cid.ClientIdentity {
+	return &MockClientIdentity{mspID: m.MSPID}
+}
+
+// MockClientIdentity is the calling identity, a member of BPJSMSP unless mspID is set
+type MockClientIdentity struct {
+	mspID string
+}
+
+func (m *MockClientIdentity) GetID() (string, error) {
+	return "testUser", nil
+}
+
+func (m *MockClientIdentity) GetMSPID() (string, error) {
+	if m.mspID != "" {
+		return m.mspID, nil
+	}
+	return "BPJSMSP", nil
+}
+
+func (m *MockClientIdentity) GetAttributeValue(attrName string) (value string, found bool, err error) {
+	return "", false, nil
+}
+
+func (m *MockClientIdentity) AssertAttributeValue(attrName, attrValue string) error {
+	return nil
+}
+
+func (m *MockClientIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	return nil, nil
+}
+
+// loadTestICD10Codes loads and activates a small ICD-10 version for tests that record visits or claims
+func loadTestICD10Codes(t *testing.T, contract *BPJSSmartContract, ctx *MockTransactionContext) {
+	_, err := contract.LoadICD10Codes(ctx, "2019", `[
+		{"code":"A01.0","description":"Typhoid fever"},
+		{"code":"E11.9","description":"Type 2 diabetes mellitus without complications"},
+		{"code":"I10","description":"Essential (primary) hypertension"},
+		{"code":"J11.1","description":"Influenza with other respiratory manifestations, virus not identified"},
+		{"code":"J45.9","description":"Asthma, unspecified"}
+	]`)
+	assert.NoError(t, err)
+	assert.NoError(t, contract.ActivateICD10Version(ctx, "2019"))
+}
+
+// registerTestFaskes registers the facilities used by tests that record visits, referrals or claims
+func registerTestFaskes(t *testing.T, contract *BPJSSmartContract, ctx *MockTransactionContext) {
+	for _, faskes := range []Faskes{
+		{FaskesCode: "PKM001", Name: "Puskesmas Kelapa", Type: "FKTP", OwnerMSP: "PuskesmasMSP"},
+		{FaskesCode: "PKM002", Name: "Puskesmas Menteng", Type: "FKTP", OwnerMSP: "PuskesmasMSP"},
+		{FaskesCode: "RS001", Name: "RS Siloam", Type: "FKRTL", HospitalClass: "B", OwnerMSP: "RumahSakitMSP"},
+		{FaskesCode: "RS002", Name: "RSUD Tarakan", Type: "FKRTL", HospitalClass: "C", OwnerMSP: "RumahSakitMSP"},
+	} {
+		err := contract.RegisterFaskes(ctx, faskes.FaskesCode, faskes.Name, faskes.Type, faskes.HospitalClass,
+			"3171", faskes.OwnerMSP, "2023-01-01", "2025-12-31")
+		assert.NoError(t, err)
+	}
+}
+
+// registerTestPractitioners registers doctors licensed at the facilities of registerTestFaskes
+func registerTestPractitioners(t *testing.T, contract *BPJSSmartContract, ctx *MockTransactionContext) {
+	for id, faskesCodes := range map[string][]string{
+		"DOC001": {"RS001", "RS002"},
+		"DOC002": {"PKM001", "RS001"},
+		"DOC003": {"PKM002"},
+	} {
+		err := contract.RegisterPractitioner(ctx, id, "Dr. "+id, "Umum", "STR-"+id, "")
+		assert.NoError(t, err)
+		for _, faskesCode := range faskesCodes {
+			err := contract.GrantPracticeLicense(ctx, id, "SIP-"+id+"-"+faskesCode, faskesCode, "2023-01-01", "2025-12-31")
+			assert.NoError(t, err)
+		}
+	}
+}
+
+// acceptTestReferrals creates accepted referrals of P001 from PKM001 to RS001
+func acceptTestReferrals(t *testing.T, contract *BPJSSmartContract, ctx *MockTransactionContext, referralIDs ...string) {
+	for _, referralID := range referralIDs {
+		err := contract.CreateReferral(ctx, referralID, "P001", "Budi", "CARD001", "PKM001",
+			"RS001", "Specialist", "Flu", "DOC002", "2024-01-10", "2024-04-10", "")
+		assert.NoError(t, err)
+		assert.NoError(t, contract.UpdateReferralStatus(ctx, referralID, "accepted", ""))
+	}
+}
+
+// Test IssueCard function
+func TestIssueCard(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	// Mock GetState to return nil (card doesn't exist)
+	ctx.stub.On("GetState", cardKey("CARD001")).Return([]byte(nil), nil)
+	ctx.stub.On("PutState", cardKey("CARD001"), mock.Anything).Return(nil)
+	ctx.stub.On("PutState", mock.Anything, []byte{0x00}).Return(nil) // composite key
+
+	err := contract.IssueCard(ctx, "CARD001", "P001", "Budi Santoso", 
+		"3171010101900001", "1990-01-01", "Male", "Jakarta", "PBPU", 
+		"2024-01-01", "2025-01-01")
+
+	assert.NoError(t, err, "IssueCard should succeed")
+	
+	// Verify card was stored
+	cardJSON := ctx.stub.State[cardKey("CARD001")]
+	assert.NotNil(t, cardJSON, "Card should be stored")
+
+	var card BPJSCard
+	json.Unmarshal(cardJSON, &card)
+	assert.Equal(t, "CARD001", card.CardID)
+	assert.Equal(t, "P001", card.PatientID)
+	assert.Equal(t, "active", card.Status)
+}
+
+// Test IssueCard duplicate
+func TestIssueCardDuplicate(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	existingCard := BPJSCard{CardID: "CARD001", PatientID: "P001"}
+	existingJSON, _ := json.Marshal(existingCard)
+
+	// Mock GetState to return existing card
+	ctx.stub.On("GetState", cardKey("CARD001")).Return(existingJSON, nil)
+
+	err := contract.IssueCard(ctx, "CARD001", "P001", "Budi", 
+		"3171010101900001", "1990-01-01", "Male", "Jakarta", "PBPU",
+		"2024-01-01", "2025-01-01")
+
+	assert.Error(t, err, "Should return error for duplicate card")
+	assert.Contains(t, err.Error(), "already exists")
+}
+
+// Test IssueCard rejects malformed or inverted validity dates
+func TestIssueCardDates(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	issue := func(issueDate string, expiryDate string) error {
+		return contract.IssueCard(ctx, "CARD001", "P001", "Budi Santoso",
+			"3171010101900001", "1990-01-01", "Male", "Jakarta", "PBPU", issueDate, expiryDate)
+	}
+	assert.ErrorContains(t, issue("01-01-2024", "2025-01-01"), "invalid issue date")
+	assert.ErrorContains(t, issue("2024-01-01", "2025-13-01"), "invalid expiry date")
+	assert.ErrorContains(t, issue("2024-01-01", "2024-01-01"), "must be after issue date")
+	assert.Nil(t, ctx.stub.State[cardKey("CARD001")])
+
+	assert.NoError(t, issue("2024-01-01", "2025-01-01"))
+}
+
+// Test IssueCard rejects a second card for the same NIK
+func TestIssueCardDuplicateNIK(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	err := contract.IssueCard(ctx, "CARD001", "P001", "Budi Santoso",
+		"3171010101900001", "1990-01-01", "Male", "Jakarta", "PBPU",
+		"2024-01-01", "2025-01-01")
+	assert.NoError(t, err)
+
+	err = contract.IssueCard(ctx, "CARD002", "P002", "Budi Santoso",
+		"3171010101900001", "1990-01-01", "Male", "Jakarta", "PBPU",
+		"2024-01-01", "2025-01-01")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "already has active card CARD001")
+
+	card, err := contract.GetCardByNIK(ctx, "3171010101900001")
+	assert.NoError(t, err)
+	assert.Equal(t, "CARD001", card.CardID)
+
+	// A suspended card can be reactivated, so it still holds the NIK
+	err = contract.UpdateCardStatus(ctx, "CARD001", "suspended", "CONTRIBUTION_ARREARS", "Arrears")
+	assert.NoError(t, err)
+	err = contract.IssueCard(ctx, "CARD002", "P001", "Budi Santoso",
+		"3171010101900001", "1990-01-01", "Male", "Jakarta", "PBPU",
+		"2024-01-01", "2025-01-01")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "already has suspended card CARD001")
+
+	// Once the first card is replaced the NIK moves to the new card
+	err = contract.UpdateCardStatus(ctx, "CARD001", "active", "CONTRIBUTION_SETTLED", "Paid")
+	assert.NoError(t, err)
+	assert.NoError(t, contract.ReplaceCard(ctx, "CARD001", "CARD002", "CARD_LOST"))
+
+	card, err = contract.GetCardByNIK(ctx, "3171010101900001")
+	assert.NoError(t, err)
+	assert.Equal(t, "CARD002", card.CardID)
+
+	_, err = contract.GetCardByNIK(ctx, "3171010101909999")
+	assert.Error(t, err)
+}
+
+// Test PBI issuance draws from the regional quota and ChangeSegment moves members between segments
+func TestSubsidyQuotaAndChangeSegment(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	err := contract.IssueCard(ctx, "CARD001", "P001", "Budi Santoso",
+		"3171010101900001", "1990-01-01", "Male", "Jakarta", "PBI",
+		"2024-01-01", "2025-01-01")
+	assert.Error(t, err, "Legacy card type should be rejected")
+
+	err = contract.IssueCard(ctx, "CARD001", "P001", "Budi Santoso",
+		"3171010101900001", "1990-01-01", "Male", "Jakarta", "PBI-APBD",
+		"2024-01-01", "2025-01-01")
+	assert.Error(t, err, "PBI issuance requires a regional quota")
+
+	err = contract.SetSubsidyQuota(ctx, "PBI-APBD", "3171", 1)
+	assert.NoError(t, err)
+	err = contract.IssueCard(ctx, "CARD001", "P001", "Budi Santoso",
+		"3171010101900001", "1990-01-01", "Male", "Jakarta", "PBI-APBD",
+		"2024-01-01", "2025-01-01")
+	assert.NoError(t, err)
+	err = contract.IssueCard(ctx, "CARD002", "P002", "Siti Aminah",
+		"3171014101900002", "1990-01-01", "Female", "Jakarta", "PBI-APBD",
+		"2024-01-01", "2025-01-01")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "quota for region 3171 is exhausted")
+
+	var card BPJSCard
+	json.Unmarshal(ctx.stub.State[cardKey("CARD001")], &card)
+	assert.Equal(t, "APBD", card.FundingSource)
+	assert.Equal(t, "3171", card.RegionCode)
+
+	err = contract.ChangeSegment(ctx, "CARD001", "PPU", "2024-02-01", "Employed")
+	assert.Error(t, err, "Effective date cannot be in the future")
+	err = contract.ChangeSegment(ctx, "CARD001", "PPU", "2024-01-10", "Employed")
+	assert.NoError(t, err)
+
+	json.Unmarshal(ctx.stub.State[cardKey("CARD001")], &card)
+	assert.Equal(t, "PPU", card.CardType)
+	assert.Equal(t, "EMPLOYER_EMPLOYEE", card.FundingSource)
+	assert.Equal(t, "2024-01-10", card.SegmentEffectiveDate)
+	assert.Len(t, card.SegmentHistory, 1)
+	assert.Equal(t, "PBI-APBD", card.SegmentHistory[0].FromSegment)
+
+	quota, err := contract.GetSubsidyQuota(ctx, "PBI-APBD", "3171")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, quota.Used)
+
+	// The released place can be used by the next member
+	err = contract.IssueCard(ctx, "CARD002", "P002", "Siti Aminah",
+		"3171014101900002", "1990-01-01", "Female", "Jakarta", "PBI-APBD",
+		"2024-01-01", "2025-01-01")
+	assert.NoError(t, err)
+
+	// A replacement card keeps the place, deactivation and death give it back
+	assert.NoError(t, contract.ReplaceCard(ctx, "CARD002", "CARD003", "CARD_LOST"))
+	quota, _ = contract.GetSubsidyQuota(ctx, "PBI-APBD", "3171")
+	assert.Equal(t, 1, quota.Used)
+	assert.NoError(t, contract.UpdateCardStatus(ctx, "CARD003", "inactive", "MEMBERSHIP_TERMINATED", "Moved abroad"))
+	quota, _ = contract.GetSubsidyQuota(ctx, "PBI-APBD", "3171")
+	assert.Equal(t, 0, quota.Used)
+	assert.NoError(t, contract.UpdateCardStatus(ctx, "CARD003", "active", "MEMBERSHIP_REINSTATED", "Returned"))
+	quota, _ = contract.GetSubsidyQuota(ctx, "PBI-APBD", "3171")
+	assert.Equal(t, 1, quota.Used)
+	assert.NoError(t, contract.RegisterDeath(ctx, "CARD003", "2024-01-12", "Death certificate"))
+	quota, _ = contract.GetSubsidyQuota(ctx, "PBI-APBD", "3171")
+	assert.Equal(t, 0, quota.Used)
+}
+
+// Test IssueCardsBatch in both modes
+func TestIssueCardsBatch(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	err := contract.SetSubsidyQuota(ctx, "PBI-APBN", "3171", 2)
+	assert.NoError(t, err)
+
+	batch := `[
+		{"cardID":"CARD001","patientID":"P001","patientName":"Budi","nik":"3171010101900001","dateOfBirth":"1990-01-01","gender":"Male","cardType":"PBI-APBN","issueDate":"2024-01-01","expiryDate":"2025-01-01"},
+		{"cardID":"CARD002","patientID":"P002","patientName":"Siti","nik":"3171014101900002","dateOfBirth":"1990-01-01","gender":"Female","cardType":"PBI-APBN","issueDate":"2024-01-01","expiryDate":"2025-01-01"},
+		{"cardID":"CARD003","patientID":"P003","patientName":"Andi","nik":"3171010101900003","dateOfBirth":"1990-01-01","gender":"Male","cardType":"PBI-APBN","issueDate":"2024-01-01","expiryDate":"2025-01-01"},
+		{"cardID":"CARD004","patientID":"P004","patientName":"Budi","nik":"3171010101900001","dateOfBirth":"1990-01-01","gender":"Male","cardType":"PBPU","issueDate":"2024-01-01","expiryDate":"2025-01-01"}
+	]`
+
+	result, err := contract.IssueCardsBatch(ctx, batch, "all-or-nothing")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Failed)
+	assert.Equal(t, 0, result.Succeeded)
+	assert.Nil(t, ctx.stub.State[cardKey("CARD001")], "Nothing is issued when any card fails")
+	assert.Equal(t, "Batch failed, issued 0 of 4 cards (all-or-nothing), 2 failed",
+		string(ctx.stub.Events["CardsBatchIssued"]))
+
+	result, err = contract.IssueCardsBatch(ctx, batch, "best-effort")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Succeeded)
+	assert.Equal(t, 2, result.Failed)
+	assert.True(t, result.Results[0].Success)
+	assert.True(t, result.Results[1].Success)
+	assert.Contains(t, result.Results[2].Error, "quota for region 3171 is exhausted")
+	assert.Contains(t, result.Results[3].Error, "NIK 3171010101900001")
+	assert.NotNil(t, ctx.stub.State[cardKey("CARD002")])
+	assert.Contains(t, ctx.stub.Events, "CardsBatchIssued")
+
+	quota, err := contract.GetSubsidyQuota(ctx, "PBI-APBN", "3171")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, quota.Used)
+
+	_, err = contract.IssueCardsBatch(ctx, batch, "partial")
+	assert.Error(t, err)
+}
+
+// Test VerifyCard
+func TestVerifyCard(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{
+		CardID:    "CARD001",
+		PatientID: "P001",
+		Status:    "active",
+	}
+	cardJSON, _ := json.Marshal(card)
+
+	ctx.stub.On("GetState", cardKey("CARD001")).Return(cardJSON, nil)
+
+	result, err := contract.VerifyCard(ctx, "CARD001")
+
+	assert.NoError(t, err)
+	assert.NotNil(t, result)
+	assert.Equal(t, "CARD001", result.CardID)
+	assert.Equal(t, "active", result.Status)
+}
+
+// Test VerifyCard with inactive card
+func TestVerifyCardInactive(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{
+		CardID:    "CARD001",
+		PatientID: "P001",
+		Status:    "suspended",
+	}
+	cardJSON, _ := json.Marshal(card)
+
+	ctx.stub.On("GetState", cardKey("CARD001")).Return(cardJSON, nil)
+
+	result, err := contract.VerifyCard(ctx, "CARD001")
+
+	assert.Error(t, err)
+	assert.Nil(t, result)
+	assert.Contains(t, err.Error(), "not active")
+}
+
+// Test VerifyCard with expired card
+func TestVerifyCardExpired(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{
+		CardID:     "CARD001",
+		PatientID:  "P001",
+		Status:     "active",
+		ExpiryDate: "2024-01-14",
+	}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+
+	result, err := contract.VerifyCard(ctx, "CARD001")
+
+	assert.Error(t, err)
+	assert.Nil(t, result)
+	assert.Contains(t, err.Error(), "expired on 2024-01-14")
+
+	// Card is still valid on its expiry date
+	ctx.stub.TxTimestamp = time.Date(2024, 1, 14, 23, 0, 0, 0, time.UTC)
+	result, err = contract.VerifyCard(ctx, "CARD001")
+	assert.NoError(t, err)
+	assert.NotNil(t, result)
+}
+
+// Test UpdateCardDetails records a field-level diff
+func TestUpdateCardDetails(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{
+		CardID:      "CARD001",
+		PatientID:   "P001",
+		PatientName: "Budi Santosa",
+		NIK:         "3171010101900001",
+		DateOfBirth: "1990-01-01",
+		Gender:      "Male",
+		Address:     "Jakarta",
+		Status:      "active",
+	}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+
+	err := contract.UpdateCardDetails(ctx, "CARD001", `{"nik":"3171010101900001"}`, "Typo")
+	assert.Error(t, err, "Only whitelisted fields can be changed")
+	err = contract.UpdateCardDetails(ctx, "CARD001", `{"patientName":"Budi Santoso"}`, "")
+	assert.Error(t, err, "Justification is required")
+	err = contract.UpdateCardDetails(ctx, "CARD001", `{"gender":"Female"}`, "Wrong gender")
+	assert.Contains(t, err.Error(), "NIK_GENDER_MISMATCH", "Changes must stay consistent with the NIK")
+
+	err = contract.UpdateCardDetails(ctx, "CARD001",
+		`{"patientName":"Budi Santoso","address":"Jakarta Selatan","dateOfBirth":"1990-01-01"}`,
+		"Name misspelled at registration")
+	assert.NoError(t, err)
+
+	json.Unmarshal(ctx.stub.State[cardKey("CARD001")], &card)
+	assert.Equal(t, "Budi Santoso", card.PatientName)
+	assert.Equal(t, "Jakarta Selatan", card.Address)
+
+	var auditLog AuditLog
+	json.Unmarshal(ctx.stub.State["AUDIT_1705305600000000000_CARD001_1"], &auditLog)
+	assert.Equal(t, []FieldChange{
+		{Field: "address", OldValue: "Jakarta", NewValue: "Jakarta Selatan"},
+		{Field: "patientName", OldValue: "Budi Santosa", NewValue: "Budi Santoso"},
+	}, auditLog.Changes)
+}
+
+// Test validateNIK
+func TestValidateNIK(t *testing.T) {
+	tests := []struct {
+		nik         string
+		dateOfBirth string
+		gender      string
+		code        string
+	}{
+		{"3171010101900001", "1990-01-01", "Male", ""},
+		{"3171014101900002", "1990-01-01", "Female", ""},
+		{"317101010190001", "1990-01-01", "Male", NIKErrInvalidLength},
+		{"31710101019000A1", "1990-01-01", "Male", NIKErrNotNumeric},
+		{"9971010101900001", "1990-01-01", "Male", NIKErrInvalidRegion},
+		{"3100010101900001", "1990-01-01", "Male", NIKErrInvalidRegion},
+		{"3171017213900001", "1990-01-01", "Female", NIKErrInvalidBirthDate},
+		{"3171010201900001", "1990-01-01", "Male", NIKErrBirthDateMismatch},
+		{"3171010101910001", "1990-01-01", "Male", NIKErrBirthDateMismatch},
+		{"3171010101900001", "1990-01-01", "Female", NIKErrGenderMismatch},
+		{"3171010101900001", "01-01-1990", "Male", NIKErrInvalidDateOfBirth},
+		{"3171010101900001", "1990-01-01", "", NIKErrInvalidGender},
+	}
+
+	for _, tt := range tests {
+		err := validateNIK(tt.nik, tt.dateOfBirth, tt.gender)
+		if tt.code == "" {
+			assert.NoError(t, err, tt.nik)
+			continue
+		}
+		nikErr, ok := err.(*NIKValidationError)
+		if assert.True(t, ok, "%s: expected NIKValidationError, got %v", tt.nik, err) {
+			assert.Equal(t, tt.code, nikErr.Code, tt.nik)
+		}
+	}
+}
+
+// Test GetEligibilityClaims returns claims that verify offline once signed by the BPJS client
+func TestGetEligibilityClaims(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{CardID: "CARD001", PatientID: "P001", NIK: "3171010101900001", Address: "Jakarta",
+		Status: "active", CareClass: "2", ExpiryDate: "2024-01-15"}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	certDER, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	cert, _ := x509.ParseCertificate(certDER)
+
+	ctx.MSPID = "RumahSakitMSP"
+	_, err = contract.GetEligibilityClaims(ctx, "CARD001", 60)
+	assert.Error(t, err, "Only BPJS issues eligibility tokens")
+	ctx.MSPID = ""
+
+	claims, err := contract.GetEligibilityClaims(ctx, "CARD001", 24*60)
+	assert.NoError(t, err)
+	assert.Equal(t, "CARD001", claims.CardID)
+	assert.Equal(t, "2", claims.CareClass)
+	assert.Equal(t, "BPJSMSP", claims.Issuer)
+	assert.Equal(t, time.Date(2024, 1, 16, 0, 0, 0, 0, time.UTC).Unix(), claims.ValidUntil,
+		"Token must not outlive the card")
+
+	token, err := eligibility.Sign(claims, key)
+	assert.NoError(t, err)
+	assert.NotContains(t, token, "3171010101900001")
+
+	verified, err := eligibility.Verify(token, cert, "BPJSMSP", time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, claims, verified)
+
+	_, err = eligibility.Verify(token, cert, "BPJSMSP", time.Date(2024, 1, 16, 0, 0, 0, 0, time.UTC))
+	assert.ErrorIs(t, err, eligibility.ErrExpired)
+}
+
+// Test GetCardHistory returns each version with its changed fields
+func TestGetCardHistory(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	_, err := contract.GetCardHistory(ctx, "CARD001")
+	assert.Error(t, err, "Unknown card has no history")
+
+	ctx.stub.TxID = "tx-issue"
+	err = contract.IssueCard(ctx, "CARD001", "P001", "Budi Santoso",
+		"3171010101900001", "1990-01-01", "Male", "Jakarta", "PBPU",
+		"2024-01-01", "2025-01-01")
+	assert.NoError(t, err)
+
+	ctx.stub.TxID = "tx-suspend"
+	ctx.stub.TxTimestamp = time.Date(2024, 2, 1, 8, 0, 0, 0, time.UTC)
+	err = contract.UpdateCardStatus(ctx, "CARD001", "suspended", "ADMINISTRATIVE_HOLD", "Data check")
+	assert.NoError(t, err)
+
+	history, err := contract.GetCardHistory(ctx, "CARD001")
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+
+	assert.Equal(t, "tx-issue", history[0].TxID)
+	assert.Contains(t, history[0].State, `"status":"active"`)
+	assert.NotEmpty(t, history[0].Changes, "First version lists every field")
+
+	assert.Equal(t, "tx-suspend", history[1].TxID)
+	assert.Equal(t, ctx.stub.TxTimestamp, history[1].Timestamp)
+	assert.False(t, history[1].IsDelete)
+	assert.Equal(t, []FieldChange{
+		{Field: "status", OldValue: "active", NewValue: "suspended"},
+		{Field: "statusCode", OldValue: "", NewValue: "ADMINISTRATIVE_HOLD"},
+	}, history[1].Changes)
+}
+
+// Test the inpatient episode lifecycle and the inpatient claim check
+func TestInpatientEpisode(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
+
+	card := BPJSCard{CardID: "CARD001", PatientID: "P001", Status: "active", CareClass: "2"}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+
+	visit := Visit{VisitID: "VISIT001", CardID: "CARD001", PatientID: "P001", PatientName: "Budi",
+		FaskesCode: "RS001", VisitDate: "2024-01-10", VisitType: "inpatient"}
+	visitJSON, _ := json.Marshal(visit)
+	ctx.stub.State[visitKey("VISIT001")] = visitJSON
+
+	ctx.MSPID = "PuskesmasMSP"
+	err := contract.AdmitPatient(ctx, "VISIT001", "2024-01-10", "Melati", "201")
+	assert.ErrorContains(t, err, "faskes RS001 is operated by RumahSakitMSP, not PuskesmasMSP")
+	ctx.MSPID = "RumahSakitMSP"
+	err = contract.AdmitPatient(ctx, "VISIT001", "2024-01-09", "Melati", "201")
+	assert.Error(t, err, "Admission cannot precede the visit")
+	err = contract.AdmitPatient(ctx, "VISIT001", "2024-01-10", "Melati", "201")
+	assert.NoError(t, err)
+	err = contract.AdmitPatient(ctx, "VISIT001", "2024-01-10", "Melati", "201")
+	assert.Error(t, err, "Visit can only be admitted once")
+
+	ctx.MSPID = "PuskesmasMSP"
+	err = contract.TransferWard(ctx, "VISIT001", "2024-01-12", "ICU", "1")
+	assert.ErrorContains(t, err, "faskes RS001 is operated by RumahSakitMSP, not PuskesmasMSP")
+	ctx.MSPID = "RumahSakitMSP"
+	err = contract.TransferWard(ctx, "VISIT001", "2024-01-12", "ICU", "1")
+	assert.NoError(t, err)
+
+	submit := func() error {
+		return contract.SubmitClaim(ctx, "CLAIM001", "P001", "Budi", "CARD001", "VISIT001",
+			"RS001", "rawat-inap", "2024-01-10",
+			"Typhoid", "Inpatient care", 7000000, 7000000, "2", "A01.0", "")
+	}
+	assert.Error(t, submit(), "Claim requires a discharged episode")
+
+	err = contract.DischargePatient(ctx, "VISIT001", "2024-01-14", "sent-home", "")
+	assert.Error(t, err, "Unknown discharge status")
+	ctx.MSPID = "PuskesmasMSP"
+	err = contract.DischargePatient(ctx, "VISIT001", "2024-01-14", "home", "Recovered")
+	assert.ErrorContains(t, err, "faskes RS001 is operated by RumahSakitMSP, not PuskesmasMSP")
+	ctx.MSPID = "RumahSakitMSP"
+	err = contract.DischargePatient(ctx, "VISIT001", "2024-01-14", "home", "Recovered")
+	assert.NoError(t, err)
+	ctx.MSPID = ""
+	err = contract.TransferWard(ctx, "VISIT001", "2024-01-14", "Mawar", "3")
+	assert.Error(t, err, "Discharged patient cannot be transferred")
+
+	json.Unmarshal(ctx.stub.State[visitKey("VISIT001")], &visit)
+	assert.Equal(t, "discharged", visit.Episode.Status)
+	assert.Equal(t, 4, visit.Episode.LengthOfStay)
+	assert.Equal(t, "Recovered", visit.Episode.DischargeNotes)
+	assert.Empty(t, visit.Notes, "Discharge notes do not overwrite the visit notes")
+	assert.Equal(t, []WardStay{
+		{Ward: "Melati", Room: "201", FromDate: "2024-01-10", ToDate: "2024-01-12"},
+		{Ward: "ICU", Room: "1", FromDate: "2024-01-12", ToDate: "2024-01-14"},
+	}, visit.Episode.WardStays)
+
+	// Another member's card cannot be billed for the episode
+	otherCard := BPJSCard{CardID: "CARD002", PatientID: "P002", Status: "active"}
+	otherJSON, _ := json.Marshal(otherCard)
+	ctx.stub.State[cardKey("CARD002")] = otherJSON
+	err = contract.SubmitClaim(ctx, "CLAIM002", "P002", "Siti", "CARD002", "VISIT001",
+		"RS001", "rawat-inap", "2024-01-10",
+		"Typhoid", "Inpatient care", 7000000, 7000000, "2", "A01.0", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match claim patient P002 on card CARD002")
+
+	// The stay is billed as rawat-inap only
+	for _, claimType := range []string{"rawat-jalan", "emergency", "obat-kronis"} {
+		err = contract.SubmitClaim(ctx, "CLAIM001", "P001", "Budi", "CARD001", "VISIT001",
+			"RS001", claimType, "2024-01-10", "Typhoid", "Inpatient care", 7000000, 7000000, "", "A01.0", "")
+		assert.ErrorContains(t, err, "must be claimed as rawat-inap", claimType)
+	}
+	err = contract.SubmitClaim(ctx, "CLAIM001", "P001", "Budi", "CARD001", "VISIT001",
+		"RS001", "Rawat-Inap", "2024-01-10", "Typhoid", "Inpatient care", 7000000, 7000000, "2", "A01.0", "")
+	assert.ErrorContains(t, err, "invalid claim type Rawat-Inap")
+
+	assert.NoError(t, submit())
+	var claim Claim
+	json.Unmarshal(ctx.stub.State[claimKey("CLAIM001")], &claim)
+	assert.Equal(t, 4, claim.LengthOfStay)
+}
+
+// Test outpatient, emergency and chronic drug claims cannot cite another member's visit
+func TestSubmitClaimAnotherMembersVisit(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
+
+	for _, card := range []BPJSCard{
+		{CardID: "CARD001", PatientID: "P001", Status: "active"},
+		{CardID: "CARD002", PatientID: "P002", Status: "active"},
+	} {
+		cardJSON, _ := json.Marshal(card)
+		ctx.stub.State[cardKey(card.CardID)] = cardJSON
+	}
+	acceptTestReferrals(t, contract, ctx, "REF-VISIT001")
+	err := contract.RecordVisit(ctx, "VISIT001", "CARD001", "P001", "Budi",
+		"RS001", "2024-01-15", "outpatient",
+		"Flu", "Medicine", "DOC001", "Notes", "J11.1", "", "", "REF-VISIT001")
+	assert.NoError(t, err)
+
+	for _, claimType := range []string{"rawat-jalan", "emergency", "obat-kronis"} {
+		err = contract.SubmitClaim(ctx, "CLAIM001", "P002", "Siti", "CARD002", "VISIT001",
+			"RS001", claimType, "2024-01-15", "Flu", "Consultation", 500000, 450000, "", "J11.1", "")
+		assert.ErrorContains(t, err, "does not match claim patient P002 on card CARD002", claimType)
+	}
+
+	err = contract.SubmitClaim(ctx, "CLAIM001", "P002", "Siti", "CARD001", "VISIT001",
+		"RS001", "rawat-jalan", "2024-01-15", "Flu", "Consultation", 500000, 450000, "", "J11.1", "")
+	assert.ErrorContains(t, err, "claim patient P002 is not the holder of card CARD001")
+
+	err = contract.SubmitClaim(ctx, "CLAIM001", "P001", "Budi", "CARD001", "VISIT001",
+		"RS001", "rawat-jalan", "2024-01-15", "Flu", "Consultation", 500000, 450000, "", "J11.1", "")
+	assert.NoError(t, err)
+}
+
+// Test visits and claims reject invalid ICD-10 codes
+func TestDiagnosisCodes(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{CardID: "CARD001", PatientID: "P001", Status: "active"}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+
+	recordVisit := func(visitID string, primaryCode string, secondaryCodes string) error {
+		return contract.RecordVisit(ctx, visitID, "CARD001", "P001", "Budi",
+			"RS001", "2024-01-15", "outpatient",
+			"Flu with high blood pressure", "Medicine", "DOC001", "Notes",
+			primaryCode, secondaryCodes, "", "REF-"+visitID)
+	}
+
+	err := recordVisit("VISIT001", "J11.1", "")
+	assert.ErrorContains(t, err, "no active ICD-10 version")
+
+	_, err = contract.LoadICD10Codes(ctx, "2019", `[{"code":"flu","description":"Influenza"}]`)
+	assert.ErrorContains(t, err, `invalid ICD-10 code "FLU"`)
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
+	acceptTestReferrals(t, contract, ctx, "REF-VISIT001", "REF-VISIT002")
+	_, err = contract.LoadICD10Codes(ctx, "2019", `[{"code":"B34.9","description":"Viral infection, unspecified"}]`)
+	assert.Error(t, err, "Active version can no longer be changed")
+
+	tests := []struct {
+		primary   string
+		secondary string
+		message   string
+	}{
+		{"", "", "primary ICD-10 diagnosis code is required"},
+		{"Influenza", "", `invalid ICD-10 code "INFLUENZA"`},
+		{"J11", "", "ICD-10 code J11 is not in version 2019"},
+		{"J11.1", "I10,B34.9", "ICD-10 code B34.9 is not in version 2019"},
+		{"J11.1", "I10,i10", "ICD-10 code I10 is given more than once"},
+		{"J11.1", "J11.1", "ICD-10 code J11.1 is given more than once"},
+	}
+	for _, tt := range tests {
+		err := recordVisit("VISIT001", tt.primary, tt.secondary)
+		assert.ErrorContains(t, err, tt.message, "primary %q secondary %q", tt.primary, tt.secondary)
+	}
+	assert.Nil(t, ctx.stub.State[visitKey("VISIT001")])
+
+	err = recordVisit("VISIT001", " j11.1", "I10, E11.9")
+	assert.NoError(t, err)
+	var visit Visit
+	json.Unmarshal(ctx.stub.State[visitKey("VISIT001")], &visit)
+	assert.Equal(t, "J11.1", visit.PrimaryDiagnosisCode)
+	assert.Equal(t, []string{"I10", "E11.9"}, visit.SecondaryDiagnosisCodes)
+	assert.Equal(t, "2019", visit.ICD10Version)
+	assert.Equal(t, "Flu with high blood pressure", visit.Diagnosis)
+
+	err = contract.SubmitClaim(ctx, "CLAIM001", "P001", "Budi", "CARD001", "VISIT001",
+		"RS001", "rawat-jalan", "2024-01-15",
+		"Flu", "Consultation", 500000, 450000, "", "J11", "")
+	assert.ErrorContains(t, err, "ICD-10 code J11 is not in version 2019")
+
+	// A new version replaces the active one; codes must then exist in the new version
+	_, err = contract.LoadICD10Codes(ctx, "2024", `[{"code":"J11.1","description":"Influenza"}]`)
+	assert.NoError(t, err)
+	assert.NoError(t, contract.ActivateICD10Version(ctx, "2024"))
+	err = recordVisit("VISIT002", "J11.1", "I10")
+	assert.ErrorContains(t, err, "ICD-10 code I10 is not in version 2024")
+
+	code, err := contract.GetICD10Code(ctx, "j11.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "2024", code.Version)
+	var codeSet CodeSetVersion
+	json.Unmarshal(ctx.stub.State["CODESET_ICD10_2019"], &codeSet)
+	assert.Equal(t, "retired", codeSet.Status)
+}
+
+func TestProcedureCodes(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{CardID: "CARD001", PatientID: "P001", Status: "active"}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
+	acceptTestReferrals(t, contract, ctx, "REF-VISIT001")
+
+	_, err := contract.LoadICD9CMCodes(ctx, "2010", `[
+		{"code":"89.52","description":"Electrocardiogram"},
+		{"code":"99.04","description":"Transfusion of packed cells"}
+	]`)
+	assert.NoError(t, err)
+	assert.NoError(t, contract.ActivateICD9CMVersion(ctx, "2010"))
+
+	recordVisit := func(visitID string, procedures string) error {
+		return contract.RecordVisit(ctx, visitID, "CARD001", "P001", "Budi",
+			"RS001", "2024-01-14", "outpatient",
+			"Hypertension", "ECG", "DOC001", "Notes", "I10", "", procedures, "REF-"+visitID)
+	}
+
+	tests := []struct {
+		procedures string
+		message    string
+	}{
+		{`[{"code":"8952","quantity":1,"date":"2024-01-14","practitionerID":"DOC001"}]`, `invalid ICD-9-CM code "8952"`},
+		{`[{"code":"89.54","quantity":1,"date":"2024-01-14","practitionerID":"DOC001"}]`, "ICD-9-CM code 89.54 is not in version 2010"},
+		{`[{"code":"89.52","quantity":0,"date":"2024-01-14","practitionerID":"DOC001"}]`, "quantity of at least 1"},
+		{`[{"code":"89.52","quantity":1,"date":"2024-01-13","practitionerID":"DOC001"}]`, "before the visit date"},
+		{`[{"code":"89.52","quantity":1,"date":"2024-01-16","practitionerID":"DOC001"}]`, "in the future"},
+		{`[{"code":"89.52","quantity":1,"date":"2024-01-14"}]`, "no performing practitioner"},
+		{`[{"code":"89.52","quantity":1,"date":"2024-01-14","practitionerID":"DOC999"}]`, "practitioner DOC999 is not registered"},
+		{`[{"code":"89.52","quantity":1,"date":"2024-01-14","practitionerID":"DOC003"}]`, "not licensed to practise at faskes RS001"},
+	}
+	for _, tt := range tests {
+		assert.ErrorContains(t, recordVisit("VISIT001", tt.procedures), tt.message, tt.procedures)
+	}
+
+	err = recordVisit("VISIT001", `[{"code":"89.52","quantity":1,"date":"2024-01-14","practitionerID":"DOC001"}]`)
+	assert.NoError(t, err)
+	// Only the recording facility adds procedures, performed by practitioners licensed there
+	ctx.MSPID = "PuskesmasMSP"
+	err = contract.AddVisitProcedures(ctx, "VISIT001", `[{"code":"99.04","quantity":2,"date":"2024-01-15","practitionerID":"DOC002"}]`)
+	assert.ErrorContains(t, err, "faskes RS001 is operated by RumahSakitMSP, not PuskesmasMSP")
+	ctx.MSPID = "RumahSakitMSP"
+	err = contract.AddVisitProcedures(ctx, "VISIT001", `[{"code":"99.04","quantity":2,"date":"2024-01-15","practitionerID":"DOC003"}]`)
+	assert.ErrorContains(t, err, "not licensed to practise at faskes RS001")
+	err = contract.AddVisitProcedures(ctx, "VISIT001", `[{"code":"99.04","quantity":2,"date":"2024-01-15","practitionerID":"DOC002"}]`)
+	assert.NoError(t, err)
+	ctx.MSPID = ""
+
+	var visit Visit
+	json.Unmarshal(ctx.stub.State[visitKey("VISIT001")], &visit)
+	assert.Equal(t, "2010", visit.ICD9CMVersion)
+	assert.Equal(t, []ProcedureEntry{
+		{Code: "89.52", Description: "Electrocardiogram", Quantity: 1, Date: "2024-01-14", PractitionerID: "DOC001"},
+		{Code: "99.04", Description: "Transfusion of packed cells", Quantity: 2, Date: "2024-01-15", PractitionerID: "DOC002"},
+	}, visit.Procedures)
+
+	// Procedures are carried into the claim and indexed by code
+	visit2 := Visit{VisitID: "VISIT002", CardID: "CARD001", PatientID: "P001", FaskesCode: "RS001"}
+	visit2JSON, _ := json.Marshal(visit2)
+	ctx.stub.State[visitKey("VISIT002")] = visit2JSON
+	err = contract.SubmitClaim(ctx, "CLAIM001", "P001", "Budi", "CARD001", "VISIT001",
+		"RS001", "rawat-jalan", "2024-01-14",
+		"Hypertension", "ECG", 500000, 450000, "", "I10", "")
+	assert.NoError(t, err)
+	err = contract.SubmitClaim(ctx, "CLAIM002", "P001", "Budi", "CARD001", "VISIT002",
+		"RS001", "rawat-jalan", "2024-01-15",
+		"Hypertension", "Consultation", 100000, 100000, "", "I10", "")
+	assert.NoError(t, err)
+
+	claims, err := contract.GetClaimsByProcedure(ctx, "99.04")
+	assert.NoError(t, err)
+	assert.Len(t, claims, 1)
+	assert.Equal(t, "CLAIM001", claims[0].ClaimID)
+	assert.Equal(t, visit.Procedures, claims[0].Procedures)
+	claims, err = contract.GetClaimsByProcedure(ctx, "89.54")
+	assert.NoError(t, err)
+	assert.Empty(t, claims)
+
+	// Procedures of one visit stay in the version they were first coded in
+	_, err = contract.LoadICD9CMCodes(ctx, "2024", `[{"code":"89.52","description":"Electrocardiogram"}]`)
+	assert.NoError(t, err)
+	assert.NoError(t, contract.ActivateICD9CMVersion(ctx, "2024"))
+	err = contract.AddVisitProcedures(ctx, "VISIT001", `[{"code":"89.52","quantity":1,"date":"2024-01-15","practitionerID":"DOC001"}]`)
+	assert.ErrorContains(t, err, "coded in ICD-9-CM version 2010")
+}
+
+func TestPrescriptionDispensing(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{CardID: "CARD001", PatientID: "P001", Status: "active"}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
+	acceptTestReferrals(t, contract, ctx, "REF-VISIT001")
+
+	err := contract.RecordVisit(ctx, "VISIT001", "CARD001", "P001", "Budi",
+		"RS001", "2024-01-15", "outpatient",
+		"Type 2 diabetes", "Metformin", "DOC001", "Notes", "E11.9", "", "", "REF-VISIT001")
+	assert.NoError(t, err)
+
+	err = contract.CreatePrescription(ctx, "RX001", "VISIT999", "DOC001", `[{"drugCode":"MET500","dose":"500 mg 2x1","quantity":60,"daysSupply":30}]`)
+	assert.ErrorContains(t, err, "visit VISIT999 not found")
+	err = contract.CreatePrescription(ctx, "RX001", "VISIT001", "DOC001", `[{"drugCode":"MET500","dose":"500 mg 2x1","quantity":0,"daysSupply":30}]`)
+	assert.ErrorContains(t, err, "at least 1")
+	err = contract.CreatePrescription(ctx, "RX001", "VISIT001", "DOC003", `[{"drugCode":"MET500","dose":"500 mg 2x1","quantity":60,"daysSupply":30}]`)
+	assert.ErrorContains(t, err, "practitioner DOC003 is not licensed to practise at faskes RS001")
+	ctx.MSPID = "PuskesmasMSP"
+	err = contract.CreatePrescription(ctx, "RX001", "VISIT001", "DOC001", `[{"drugCode":"MET500","dose":"500 mg 2x1","quantity":60,"daysSupply":30}]`)
+	assert.ErrorContains(t, err, "faskes RS001 is operated by RumahSakitMSP, not PuskesmasMSP")
+	ctx.MSPID = ""
+
+	// A chronic drug claim needs dispensed medication
+	submitClaim := func(claimID string) error {
+		return contract.SubmitClaim(ctx, claimID, "P001", "Budi", "CARD001", "VISIT001",
+			"RS001", "obat-kronis", "2024-01-15",
+			"Type 2 diabetes", "Metformin", 300000, 300000, "", "E11.9", "")
+	}
+	assert.ErrorContains(t, submitClaim("CLAIM001"), "no dispensed prescription")
+
+	err = contract.CreatePrescription(ctx, "RX001", "VISIT001", "DOC001", `[
+		{"drugCode":"MET500","drugName":"Metformin","dose":"500 mg 2x1","quantity":60,"daysSupply":30},
+		{"drugCode":"GLI2","drugName":"Glimepiride","dose":"2 mg 1x1","quantity":30,"daysSupply":30}
+	]`)
+	assert.NoError(t, err)
+	assert.ErrorContains(t, submitClaim("CLAIM001"), "no dispensed prescription")
+
+	dispense := func(items string) error {
+		return contract.DispenseMedication(ctx, "RX001", "RS001", "2024-01-15", items)
+	}
+	err = contract.DispenseMedication(ctx, "RX001", "APT001", "2024-01-15", `[{"drugCode":"MET500","quantity":30}]`)
+	assert.ErrorContains(t, err, "faskes APT001 is not registered")
+	ctx.MSPID = "RumahSakitMSP"
+	err = contract.DispenseMedication(ctx, "RX001", "PKM001", "2024-01-15", `[{"drugCode":"MET500","quantity":30}]`)
+	assert.ErrorContains(t, err, "faskes PKM001 is operated by PuskesmasMSP, not RumahSakitMSP")
+	ctx.MSPID = ""
+	assert.ErrorContains(t, dispense(`[{"drugCode":"AML5","quantity":10}]`), "drug AML5 is not on prescription RX001")
+	assert.ErrorContains(t, dispense(`[{"drugCode":"MET500","quantity":61}]`), "only 60 remaining")
+
+	assert.NoError(t, dispense(`[{"drugCode":"MET500","quantity":30},{"drugCode":"GLI2","quantity":30}]`))
+	prescription, err := contract.getPrescription(ctx, "RX001")
+	assert.NoError(t, err)
+	assert.Equal(t, "partially-dispensed", prescription.Status)
+	assert.Equal(t, 30, prescription.Items[0].DispensedQuantity)
+	assert.ErrorContains(t, dispense(`[{"drugCode":"GLI2","quantity":1}]`), "only 0 remaining")
+
+	assert.NoError(t, dispense(`[{"drugCode":"MET500","quantity":30}]`))
+	prescription, _ = contract.getPrescription(ctx, "RX001")
+	assert.Equal(t, "dispensed", prescription.Status)
+	assert.Len(t, prescription.Dispensings, 2)
+	assert.ErrorContains(t, dispense(`[{"drugCode":"MET500","quantity":1}]`), "already fully dispensed")
+
+	assert.NoError(t, submitClaim("CLAIM001"))
+	var claim Claim
+	json.Unmarshal(ctx.stub.State[claimKey("CLAIM001")], &claim)
+	assert.Equal(t, []string{"RX001"}, claim.PrescriptionIDs)
+
+	prescriptions, err := contract.GetPatientPrescriptions(ctx, "P001")
+	assert.NoError(t, err)
+	assert.Len(t, prescriptions, 1)
+}
+
+func TestVisitAddendum(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{CardID: "CARD001", PatientID: "P001", Status: "active"}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
+	acceptTestReferrals(t, contract, ctx, "REF-VISIT001")
+
+	err := contract.RecordVisit(ctx, "VISIT001", "CARD001", "P001", "Budi",
+		"RS001", "2024-01-15", "outpatient",
+		"Flu", "Paracetamol", "DOC001", "Notes", "J11.1", "", "", "REF-VISIT001")
+	assert.NoError(t, err)
+	original := ctx.stub.State[visitKey("VISIT001")]
+
+	assert.ErrorContains(t, contract.AddVisitAddendum(ctx, "VISIT001", "", `{"diagnosis":"Typhoid"}`), "reason is required")
+	ctx.MSPID = "PuskesmasMSP"
+	assert.ErrorContains(t, contract.AddVisitAddendum(ctx, "VISIT001", "Widal test positive", `{"diagnosis":"Typhoid"}`),
+		"faskes RS001 is operated by RumahSakitMSP, not PuskesmasMSP")
+	ctx.MSPID = ""
+	assert.ErrorContains(t, contract.AddVisitAddendum(ctx, "VISIT001", "Wrong date", `{"visitDate":"2024-01-14"}`), "visitDate cannot be amended")
+	assert.ErrorContains(t, contract.AddVisitAddendum(ctx, "VISIT001", "Lab result", `{"primaryDiagnosisCode":"A01"}`), "ICD-10 code A01 is not in version 2019")
+	assert.ErrorContains(t, contract.AddVisitAddendum(ctx, "VISIT001", "No change", `{"diagnosis":"Flu"}`), "does not change visit")
+	assert.Equal(t, original, ctx.stub.State[visitKey("VISIT001")])
+
+	ctx.stub.TxID = "tx2"
+	err = contract.AddVisitAddendum(ctx, "VISIT001", "Widal test positive",
+		`{"diagnosis":"Typhoid fever","primaryDiagnosisCode":"a01.0","secondaryDiagnosisCodes":"J11.1"}`)
+	assert.NoError(t, err)
+	err = contract.AddVisitAddendum(ctx, "VISIT001", "Patient advised to return in 3 days", "")
+	assert.NoError(t, err)
+
+	var visit Visit
+	json.Unmarshal(ctx.stub.State[visitKey("VISIT001")], &visit)
+	assert.Equal(t, "Flu", visit.Diagnosis, "Recorded visit is never overwritten")
+	assert.Equal(t, "J11.1", visit.PrimaryDiagnosisCode)
+	assert.Len(t, visit.Addenda, 2)
+	assert.Equal(t, "tx2", visit.Addenda[0].TxID)
+	assert.Equal(t, "BPJSMSP", visit.Addenda[0].AuthorMSP)
+	assert.Equal(t, []FieldChange{
+		{Field: "diagnosis", OldValue: "Flu", NewValue: "Typhoid fever"},
+		{Field: "primaryDiagnosisCode", OldValue: "J11.1", NewValue: "A01.0"},
+		{Field: "secondaryDiagnosisCodes", OldValue: "", NewValue: "J11.1"},
+	}, visit.Addenda[0].Changes)
+	assert.Empty(t, visit.Addenda[1].Changes)
+
+	visits, err := contract.GetPatientVisits(ctx, "P001", false)
+	assert.NoError(t, err)
+	assert.Len(t, visits, 1)
+	assert.Equal(t, "Typhoid fever", visits[0].Diagnosis)
+	assert.Equal(t, "A01.0", visits[0].PrimaryDiagnosisCode)
+	assert.Equal(t, []string{"J11.1"}, visits[0].SecondaryDiagnosisCodes)
+
+	visits, err = contract.GetPatientVisits(ctx, "P001", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "Flu", visits[0].Diagnosis)
+	assert.Len(t, visits[0].Addenda, 2)
+
+	for name, get := range map[string]func() ([]*Visit, error){
+		"GetCardVisits": func() ([]*Visit, error) { return contract.GetCardVisits(ctx, "CARD001") },
+		"GetAllVisits":  func() ([]*Visit, error) { return contract.GetAllVisits(ctx) },
+	} {
+		visits, err = get()
+		assert.NoError(t, err, name)
+		assert.Len(t, visits, 1, name)
+		assert.Equal(t, "Typhoid fever", visits[0].Diagnosis, name)
+	}
+}
+
+func TestKeyNamespaces(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	err := contract.IssueCard(ctx, "CARD001", "P001", "Budi Santoso",
+		"3171010101900001", "1990-01-01", "Male", "Jakarta", "PBPU",
+		"2024-01-01", "2025-01-01")
+	assert.NoError(t, err)
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
+	acceptTestReferrals(t, contract, ctx, "REF-CARD001", "REF-VISIT001")
+
+	recordVisit := func(visitID string) error {
+		return contract.RecordVisit(ctx, visitID, "CARD001", "P001", "Budi",
+			"RS001", "2024-01-15", "outpatient",
+			"Flu", "Medicine", "DOC001", "Notes", "J11.1", "", "", "REF-"+visitID)
+	}
+
+	// A visit with the ID of a card lives in its own namespace
+	assert.NoError(t, recordVisit("CARD001"))
+	card, err := contract.VerifyCard(ctx, "CARD001")
+	assert.NoError(t, err)
+	assert.Equal(t, "Budi Santoso", card.PatientName)
+
+	assert.NoError(t, recordVisit("VISIT001"))
+	assert.ErrorContains(t, recordVisit("VISIT001"), "visit VISIT001 already exists")
+
+	err = contract.CreateReferral(ctx, "REF001", "P001", "Budi", "CARD001", "PKM001",
+		"RS001", "Specialist", "Flu", "DOC002", "2024-01-15", "2024-02-15", "")
+	assert.NoError(t, err)
+	err = contract.CreateReferral(ctx, "REF001", "P001", "Budi", "CARD001", "PKM001",
+		"RS002", "Specialist", "Flu", "DOC002", "2024-01-15", "2024-02-15", "")
+	assert.ErrorContains(t, err, "referral REF001 already exists")
+
+	submitClaim := func() error {
+		return contract.SubmitClaim(ctx, "CLAIM001", "P001", "Budi", "CARD001", "VISIT001",
+			"RS001", "rawat-jalan", "2024-01-15", "Flu", "Consultation", 500000, 450000, "", "J11.1", "")
+	}
+	assert.NoError(t, submitClaim())
+	assert.ErrorContains(t, submitClaim(), "claim CLAIM001 already exists")
+}
+
+func TestMigrateKeyNamespaces(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	// Entities as written before key namespaces, under their bare ID
+	legacy := map[string]interface{}{
+		"CARD001":  BPJSCard{CardID: "CARD001", PatientID: "P001", PatientName: "Budi", NIK: "3171010101900001", Status: "active"},
+		"VISIT001": Visit{VisitID: "VISIT001", CardID: "CARD001", PatientID: "P001"},
+		"REF001":   Referral{ReferralID: "REF001", CardID: "CARD001", PatientID: "P001"},
+		"CLAIM001": Claim{ClaimID: "CLAIM001", VisitID: "VISIT001", CardID: "CARD001", PatientID: "P001"},
+		"CLAIM002": Claim{ClaimID: "CLAIM002", VisitID: "VISIT002", CardID: "CARD001", PatientID: "P001"},
+	}
+	ctx.stub.TxID = "tx-legacy"
+	for id, entity := range legacy {
+		entityJSON, _ := json.Marshal(entity)
+		assert.NoError(t, ctx.stub.PutState(id, entityJSON))
+	}
+	assert.NoError(t, ctx.stub.PutState(familyGroupKey("3171010101010001"), []byte(`{"kkNumber":"3171010101010001"}`)))
+	// CLAIM002 was already written to its namespaced key
+	assert.NoError(t, ctx.stub.PutState(claimKey("CLAIM002"), []byte(`{"claimID":"CLAIM002"}`)))
+
+	ctx.stub.TxID = "tx-migrate"
+	result, err := contract.MigrateKeyNamespaces(ctx, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"CARD001", "CLAIM001"}, result.Migrated)
+	assert.True(t, result.Remaining)
+
+	result, err = contract.MigrateKeyNamespaces(ctx, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"REF001", "VISIT001"}, result.Migrated)
+	assert.Equal(t, []string{"CLAIM002"}, result.Conflicts)
+	assert.False(t, result.Remaining)
+
+	for _, id := range []string{"CARD001", "CLAIM001", "REF001", "VISIT001"} {
+		assert.Nil(t, ctx.stub.State[id], id)
+	}
+	assert.NotNil(t, ctx.stub.State[familyGroupKey("3171010101010001")])
+
+	card, err := contract.VerifyCard(ctx, "CARD001")
+	assert.NoError(t, err)
+	assert.Equal(t, "Budi", card.PatientName)
+
+	// Migrated cards are added to the NIK index
+	card, err = contract.GetCardByNIK(ctx, "3171010101900001")
+	assert.NoError(t, err)
+	assert.Equal(t, "CARD001", card.CardID)
+
+	// History continues from the bare key
+	history, err := contract.GetCardHistory(ctx, "CARD001")
+	assert.NoError(t, err)
+	assert.Len(t, history, 3)
+	assert.Equal(t, "tx-legacy", history[0].TxID)
+	assert.True(t, history[1].IsDelete)
+
+	// A bare ID that held a visit before a card overwrote it only adds the card's versions
+	visitJSON, _ := json.Marshal(Visit{VisitID: "ID777", CardID: "CARD001", PatientID: "P001"})
+	cardJSON, _ := json.Marshal(BPJSCard{CardID: "ID777", PatientID: "P002", Status: "active"})
+	ctx.stub.TxID = "tx-visit"
+	assert.NoError(t, ctx.stub.PutState("ID777", visitJSON))
+	ctx.stub.TxID = "tx-card"
+	assert.NoError(t, ctx.stub.PutState("ID777", cardJSON))
+
+	history, err = contract.GetCardHistory(ctx, "ID777")
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, "tx-card", history[0].TxID)
+	}
+	history, err = contract.GetVisitHistory(ctx, "ID777")
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, "tx-visit", history[0].TxID)
+	}
+	_, err = contract.GetClaimHistory(ctx, "ID777")
+	assert.ErrorContains(t, err, "claim ID777 not found")
+}
+
+func TestFaskesRegistry(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{CardID: "CARD001", PatientID: "P001", Status: "active"}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
+	acceptTestReferrals(t, contract, ctx, "REF-VISIT001")
+
+	tests := []struct {
+		faskesType    string
+		hospitalClass string
+		regionCode    string
+		contractEnd   string
+		message       string
+	}{
+		{"rumahsakit", "", "3171", "2025-12-31", "invalid faskes type"},
+		{"FKRTL", "", "3171", "2025-12-31", "invalid hospital class"},
+		{"FKTP", "B", "3171", "2025-12-31", "hospital class only applies to FKRTL"},
+		{"FKTP", "", "9971", "2025-12-31", "invalid region code"},
+		{"FKTP", "", "3171", "2022-12-31", "must be after contract start"},
+	}
+	for _, tt := range tests {
+		err := contract.RegisterFaskes(ctx, "PKM003", "Puskesmas Gambir", tt.faskesType, tt.hospitalClass,
+			tt.regionCode, "PuskesmasMSP", "2023-01-01", tt.contractEnd)
+		assert.ErrorContains(t, err, tt.message)
+	}
+	err := contract.RegisterFaskes(ctx, "RS001", "RS Other", "FKRTL", "A", "3171", "RumahSakitMSP", "2023-01-01", "2025-12-31")
+	assert.ErrorContains(t, err, "faskes RS001 already exists")
+
+	recordVisit := func(visitID string, faskesCode string) error {
+		return contract.RecordVisit(ctx, visitID, "CARD001", "P001", "Budi", faskesCode,
+			"2024-01-15", "outpatient", "Flu", "Medicine", "DOC001", "Notes", "J11.1", "", "", "REF-"+visitID)
+	}
+	assert.ErrorContains(t, recordVisit("VISIT001", "RS999"), "faskes RS999 is not registered")
+
+	// Only the facility's own organization, or BPJS, transacts for it
+	ctx.MSPID = "PuskesmasMSP"
+	assert.ErrorContains(t, recordVisit("VISIT001", "RS001"), "faskes RS001 is operated by RumahSakitMSP, not PuskesmasMSP")
+	ctx.MSPID = "RumahSakitMSP"
+	assert.NoError(t, recordVisit("VISIT001", "RS001"))
+	var visit Visit
+	json.Unmarshal(ctx.stub.State[visitKey("VISIT001")], &visit)
+	assert.Equal(t, "RS Siloam", visit.FaskesName)
+	assert.Equal(t, "FKRTL", visit.FaskesType)
+
+	ctx.MSPID = "PuskesmasMSP"
+	assert.Error(t, contract.RenewFaskesContract(ctx, "RS001", "2023-01-01", "2024-01-01"), "Only BPJS manages contracts")
+	ctx.MSPID = ""
+	assert.NoError(t, contract.RenewFaskesContract(ctx, "RS001", "2023-01-01", "2024-01-01"))
+	assert.ErrorContains(t, recordVisit("VISIT002", "RS001"), "contract of faskes RS001 expired on 2024-01-01")
+
+	err = contract.ChangePrimaryFacility(ctx, "CARD001", "RS002", "Nearest to home")
+	assert.ErrorContains(t, err, "members can only register to an FKTP")
+}
+
+// Test practitioner registry and license checks
+func TestPractitionerRegistry(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{CardID: "CARD001", PatientID: "P001", Status: "active"}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
+	acceptTestReferrals(t, contract, ctx, "REF-VISIT001")
+
+	ctx.MSPID = "RumahSakitMSP"
+	assert.Error(t, contract.RegisterPractitioner(ctx, "DOC004", "Dr. Rina", "Anak", "STR-DOC004", ""), "Only BPJS registers practitioners")
+	ctx.MSPID = ""
+	assert.NoError(t, contract.RegisterPractitioner(ctx, "DOC004", "Dr. Rina", "Anak", "STR-DOC004", "2023-12-31"))
+	assert.NoError(t, contract.GrantPracticeLicense(ctx, "DOC004", "SIP-DOC004", "RS001", "2023-01-01", "2025-12-31"))
+	assert.NoError(t, contract.GrantPracticeLicense(ctx, "DOC003", "SIP-DOC003-RS001", "RS001", "2023-01-01", "2024-01-10"))
+
+	// DOC001 holds running licenses at RS001 and RS002, a third facility is the limit
+	assert.NoError(t, contract.GrantPracticeLicense(ctx, "DOC001", "SIP-DOC001-PKM001", "PKM001", "2024-01-01", "2025-12-31"))
+	err := contract.GrantPracticeLicense(ctx, "DOC001", "SIP-DOC001-PKM002", "PKM002", "2024-01-01", "2025-12-31")
+	assert.ErrorContains(t, err, "already holds practice licenses at 3 facilities")
+
+	recordVisit := func(visitID string, doctorID string) error {
+		return contract.RecordVisit(ctx, visitID, "CARD001", "P001", "Budi", "RS001",
+			"2024-01-15", "outpatient", "Flu", "Medicine", doctorID, "Notes", "J11.1", "", "", "REF-"+visitID)
+	}
+	assert.ErrorContains(t, recordVisit("VISIT001", "DOC999"), "practitioner DOC999 is not registered")
+	assert.ErrorContains(t, recordVisit("VISIT001", ""), "practitioner ID is required")
+	assert.ErrorContains(t, recordVisit("VISIT001", "DOC004"), "registration (STR) of practitioner DOC004 expired on 2023-12-31")
+	assert.ErrorContains(t, recordVisit("VISIT001", "DOC003"), "practice license (SIP) of practitioner DOC003 at faskes RS001 expired on 2024-01-10")
+	assert.NoError(t, recordVisit("VISIT001", "DOC001"))
+
+	err = contract.CreateReferral(ctx, "REF001", "P001", "Budi", "CARD001", "PKM002",
+		"RS001", "Specialist", "Flu", "DOC002", "2024-01-15", "2024-02-15", "")
+	assert.ErrorContains(t, err, "practitioner DOC002 is not licensed to practise at faskes PKM002")
+	err = contract.CreateReferral(ctx, "REF001", "P001", "Budi", "CARD001", "PKM001",
+		"RS001", "Specialist", "Flu", "DOC002", "2024-01-15", "2024-02-15", "")
+	assert.NoError(t, err)
+
+	// Reassigning the visit moves it to the new doctor's activity
+	err = contract.AddVisitAddendum(ctx, "VISIT001", "Wrong doctor", `{"doctorID":"DOC003"}`)
+	assert.ErrorContains(t, err, "expired on 2024-01-10")
+	err = contract.AddVisitAddendum(ctx, "VISIT001", "Wrong doctor", `{"doctorID":"DOC002"}`)
+	assert.NoError(t, err)
+
+	activity, err := contract.GetPractitionerActivity(ctx, "DOC002")
+	assert.NoError(t, err)
+	assert.Len(t, activity.Visits, 1)
+	assert.Equal(t, "DOC002", activity.Visits[0].DoctorID)
+	assert.Len(t, activity.Referrals, 2)
+	assert.Equal(t, "PKM001", activity.Referrals[0].FromFaskesCode)
+
+	activity, err = contract.GetPractitionerActivity(ctx, "DOC001")
+	assert.NoError(t, err)
+	assert.Empty(t, activity.Visits)
+
+	// The doctor's name comes from the registry and follows the reassignment
+	visits, err := contract.GetCardVisits(ctx, "CARD001")
+	assert.NoError(t, err)
+	assert.Equal(t, "Dr. DOC002", visits[0].DoctorName)
+	err = contract.AddVisitAddendum(ctx, "VISIT001", "Typo", `{"doctorName":"Dr. Someone"}`)
+	assert.ErrorContains(t, err, "visit field doctorName cannot be amended")
+
+	// Visits and referrals recorded before the registry are backfilled into the indexes
+	for id, entity := range map[string]interface{}{
+		visitKey("VISIT900"):  Visit{VisitID: "VISIT900", DoctorID: "DOC003"},
+		visitKey("VISIT901"):  Visit{VisitID: "VISIT901", DoctorID: "DOC003"},
+		referralKey("REF900"): Referral{ReferralID: "REF900", ReferringDoctor: "DOC003"},
+		referralKey("REF901"): Referral{ReferralID: "REF901"},
+	} {
+		entityJSON, _ := json.Marshal(entity)
+		ctx.stub.State[id] = entityJSON
+	}
+	backfill, err := contract.BackfillPractitionerIndexes(ctx, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"VISIT900", "VISIT901"}, backfill.Visits)
+	assert.True(t, backfill.Remaining)
+	backfill, err = contract.BackfillPractitionerIndexes(ctx, 2)
+	assert.NoError(t, err)
+	assert.Empty(t, backfill.Visits)
+	assert.Equal(t, []string{"REF900"}, backfill.Referrals)
+	assert.False(t, backfill.Remaining)
+
+	activity, err = contract.GetPractitionerActivity(ctx, "DOC003")
+	assert.NoError(t, err)
+	assert.Len(t, activity.Visits, 2)
+	assert.Len(t, activity.Referrals, 1)
+}
+
+// Test RenewCard
+func TestRenewCard(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{
+		CardID:     "CARD001",
+		PatientID:  "P001",
+		Status:     "expired",
+		IssueDate:  "2023-01-01",
+		ExpiryDate: "2024-01-01",
+	}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+
+	err := contract.RenewCard(ctx, "CARD001", "2024-01-10")
+	assert.Error(t, err, "New expiry must be after the renewal date")
+
+	err = contract.RenewCard(ctx, "CARD001", "2025-01-15")
+	assert.NoError(t, err)
+
+	var renewed BPJSCard
+	json.Unmarshal(ctx.stub.State[cardKey("CARD001")], &renewed)
+	assert.Equal(t, "active", renewed.Status)
+	assert.Equal(t, "2025-01-15", renewed.ExpiryDate)
+	assert.Equal(t, "2024-01-15", renewed.ValidFrom)
+	assert.Len(t, renewed.ValidityHistory, 1)
+	assert.Equal(t, "2023-01-01", renewed.ValidityHistory[0].ValidFrom)
+	assert.Equal(t, "2024-01-01", renewed.ValidityHistory[0].ValidUntil)
+	assert.Contains(t, ctx.stub.Events, "CardRenewed")
+
+	_, err = contract.VerifyCard(ctx, "CARD001")
+	assert.NoError(t, err)
+}
+
+// Test UpdateCardStatus
+func TestUpdateCardStatus(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{
+		CardID:    "CARD001",
+		PatientID: "P001",
+		Status:    "active",
+	}
+	cardJSON, _ := json.Marshal(card)
+
+	ctx.stub.On("GetState", cardKey("CARD001")).Return(cardJSON, nil)
+	ctx.stub.On("PutState", cardKey("CARD001"), mock.Anything).Return(nil)
+	ctx.stub.On("PutState", mock.Anything, mock.Anything).Return(nil) // audit log
+
+	err := contract.UpdateCardStatus(ctx, "CARD001", "suspended", "CONTRIBUTION_ARREARS", "Payment overdue")
+
+	assert.NoError(t, err)
+
+	// Verify status was updated
+	updatedJSON := ctx.stub.State[cardKey("CARD001")]
+	var updatedCard BPJSCard
+	json.Unmarshal(updatedJSON, &updatedCard)
+	assert.Equal(t, "suspended", updatedCard.Status)
+
+	// Verify audit log records both states
+	var auditLog AuditLog
+	json.Unmarshal(ctx.stub.State["AUDIT_1705305600000000000_CARD001_1"], &auditLog)
+	assert.Equal(t, "active", auditLog.OldState)
+	assert.Equal(t, "suspended", auditLog.NewState)
+	assert.Equal(t, "CONTRIBUTION_ARREARS", auditLog.ReasonCode)
+}
+
+// Test audit entries about the same entity in one transaction are all kept
+func TestAuditLogsSameEntitySameTransaction(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	assert.NoError(t, contract.createAuditLog(ctx, "First", "card", "CARD001", "testUser", "admin", "first"))
+	assert.NoError(t, contract.createAuditLog(ctx, "Second", "card", "CARD001", "testUser", "admin", "second"))
+
+	logs, err := contract.GetAllAuditLogs(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, logs, 2) {
+		assert.Equal(t, "AUDIT_1705305600000000000_CARD001_1", logs[0].LogID)
+		assert.Equal(t, "First", logs[0].Action)
+		assert.Equal(t, "AUDIT_1705305600000000000_CARD001_2", logs[1].LogID)
+		assert.Equal(t, "Second", logs[1].Action)
+	}
+}
+
+// Test UpdateCardStatus rejects illegal transitions and unknown statuses
+func TestUpdateCardStatusIllegalTransition(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{
+		CardID:    "CARD001",
+		PatientID: "P001",
+		Status:    "deceased",
+	}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+
+	err := contract.UpdateCardStatus(ctx, "CARD001", "active", "MEMBERSHIP_REINSTATED", "Reactivate")
+
+	var transitionErr *CardStatusTransitionError
+	assert.ErrorAs(t, err, &transitionErr)
+	assert.Equal(t, "deceased", transitionErr.FromStatus)
+	assert.Equal(t, "active", transitionErr.ToStatus)
+
+	card.Status = "active"
+	cardJSON, _ = json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+
+	err = contract.UpdateCardStatus(ctx, "CARD001", "Active", "MEMBERSHIP_REINSTATED", "Typo")
+	assert.ErrorAs(t, err, &transitionErr)
+	assert.Contains(t, err.Error(), "unknown card status")
+
+	err = contract.UpdateCardStatus(ctx, "CARD001", "suspended", "", "Missing reason code")
+	assert.ErrorAs(t, err, &transitionErr)
+	assert.Contains(t, err.Error(), "reason code must be one of")
+
+	var storedCard BPJSCard
+	json.Unmarshal(ctx.stub.State[cardKey("CARD001")], &storedCard)
+	assert.Equal(t, "active", storedCard.Status)
+}
+
+// Test RegisterDeath cascades to referrals, claims and family group
+func TestRegisterDeath(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
+
+	for _, id := range []string{"CARD001", "CARD002", "CARD003"} {
+		card := BPJSCard{CardID: id, PatientID: "P" + id, PatientName: "Member " + id,
+			DateOfBirth: "1980-01-01", Status: "active"}
+		cardJSON, _ := json.Marshal(card)
+		ctx.stub.State[cardKey(id)] = cardJSON
+	}
+	visit := Visit{VisitID: "VISIT001", CardID: "CARD001", PatientID: "PCARD001", FaskesCode: "RS001"}
+	visitJSON, _ := json.Marshal(visit)
+	ctx.stub.State[visitKey("VISIT001")] = visitJSON
+	assert.NoError(t, contract.CreateFamilyGroup(ctx, "3171010101240001", "CARD001"))
+	assert.NoError(t, contract.AddFamilyMember(ctx, "3171010101240001", "CARD003", "child"))
+	assert.NoError(t, contract.AddFamilyMember(ctx, "3171010101240001", "CARD002", "spouse"))
+
+	for _, ref := range [][]string{{"REF001", "2024-01-12"}, {"REF002", "2024-01-05"}} {
+		err := contract.CreateReferral(ctx, ref[0], "PCARD001", "Member CARD001", "CARD001",
+			"PKM001", "RS001", "Specialist", "Hypertension", "DOC002", ref[1], "2024-02-28", "")
+		assert.NoError(t, err)
+	}
+	for _, clm := range [][]string{{"CLM001", "2024-01-12"}, {"CLM002", "2024-01-05"}} {
+		err := contract.SubmitClaim(ctx, clm[0], "PCARD001", "Member CARD001", "CARD001", "VISIT001",
+			"RS001", "rawat-jalan", clm[1], "Hypertension", "Medication", 500000, 500000, "", "I10", "")
+		assert.NoError(t, err)
+	}
+
+	err := contract.UpdateCardStatus(ctx, "CARD001", "deceased", "MEMBER_DECEASED", "Died")
+	assert.Error(t, err, "Deceased status is only set by RegisterDeath")
+	err = contract.RegisterDeath(ctx, "CARD001", "2024-02-01", "Death certificate")
+	assert.Error(t, err, "Date of death cannot be in the future")
+
+	err = contract.RegisterDeath(ctx, "CARD001", "2024-01-10", "Death certificate")
+	assert.NoError(t, err)
+
+	var card BPJSCard
+	json.Unmarshal(ctx.stub.State[cardKey("CARD001")], &card)
+	assert.Equal(t, "deceased", card.Status)
+	assert.Equal(t, "2024-01-10", card.DateOfDeath)
+
+	var cancelled, pending Referral
+	json.Unmarshal(ctx.stub.State[referralKey("REF001")], &cancelled)
+	assert.Equal(t, "cancelled", cancelled.Status)
+	json.Unmarshal(ctx.stub.State[referralKey("REF002")], &pending)
+	assert.Equal(t, "pending", pending.Status)
+
+	var flagged, unflagged Claim
+	json.Unmarshal(ctx.stub.State[claimKey("CLM001")], &flagged)
+	assert.True(t, flagged.Flagged)
+	json.Unmarshal(ctx.stub.State[claimKey("CLM002")], &unflagged)
+	assert.False(t, unflagged.Flagged)
+	err = contract.ProcessClaim(ctx, "CLM001", "approved", "OK")
+	assert.Error(t, err, "Flagged claims cannot be approved")
+
+	// Nor paid, even when the claim was approved before it was flagged
+	flagged.Status = "approved"
+	flaggedJSON, _ := json.Marshal(flagged)
+	ctx.stub.State[claimKey("CLM001")] = flaggedJSON
+	err = contract.ProcessClaim(ctx, "CLM001", "paid", "Transferred")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is flagged and cannot be paid")
+
+	// Care given up to the date of death can still be claimed
+	err = contract.SubmitClaim(ctx, "CLM003", "PCARD001", "Member CARD001", "CARD001", "VISIT001",
+		"RS001", "rawat-jalan", "2024-01-10", "Hypertension", "Medication", 500000, 500000, "", "I10", "")
+	assert.NoError(t, err)
+	err = contract.SubmitClaim(ctx, "CLM004", "PCARD001", "Member CARD001", "CARD001", "VISIT001",
+		"RS001", "rawat-jalan", "2024-01-11", "Hypertension", "Medication", 500000, 500000, "", "I10", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "card status is deceased")
+
+	group, err := contract.GetFamilyGroup(ctx, "3171010101240001")
+	assert.NoError(t, err)
+	assert.Len(t, group.Members, 2)
+	assert.Equal(t, "CARD002", group.HeadCardID, "Spouse becomes head of family")
+	assert.Contains(t, ctx.stub.Events, "MemberDeceased")
+}
+
+// Test family group membership lifecycle
+func TestFamilyGroup(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	for _, id := range []string{"CARD001", "CARD002", "CARD003"} {
+		card := BPJSCard{CardID: id, PatientID: "P" + id, PatientName: "Member " + id, Status: "active"}
+		cardJSON, _ := json.Marshal(card)
+		ctx.stub.State[cardKey(id)] = cardJSON
+	}
+
+	for kkNumber, message := range map[string]string{
+		"KK001":            "must be 16 digits",
+		"317101010124000A": "digits only",
+		"9971010101240001": "invalid region code 997101",
+		"3171013201240001": "invalid issue date digits 320124",
+	} {
+		assert.ErrorContains(t, contract.CreateFamilyGroup(ctx, kkNumber, "CARD001"), message, kkNumber)
+	}
 
-func (m *MockTransactionContext) GetClientIdentity() shim.ClientIdentity {
-	return &MockClientIdentity{}
-}
+	err := contract.CreateFamilyGroup(ctx, "3171010101240001", "CARD001")
+	assert.NoError(t, err)
+	err = contract.CreateFamilyGroup(ctx, "3171010101240002", "CARD003")
+	assert.NoError(t, err)
 
-type MockClientIdentity struct{}
+	err = contract.AddFamilyMember(ctx, "3171010101240001", "CARD002", "cousin")
+	assert.Error(t, err, "Unknown relationship should be rejected")
+	err = contract.AddFamilyMember(ctx, "3171010101240001", "CARD002", "child")
+	assert.NoError(t, err)
+	err = contract.AddFamilyMember(ctx, "3171010101240002", "CARD002", "child")
+	assert.Error(t, err, "Card can only belong to one family group")
 
-func (m *MockClientIdentity) GetID() (string, error) {
-	return "testUser", nil
-}
+	group, err := contract.GetFamilyGroupByCard(ctx, "CARD002")
+	assert.NoError(t, err)
+	assert.Equal(t, "3171010101240001", group.KKNumber)
+	assert.Len(t, group.Members, 2)
+	assert.Equal(t, "child", group.Members[1].Relationship)
 
-func (m *MockClientIdentity) GetMSPID() (string, error) {
-	return "BPJSMSP", nil
-}
+	err = contract.RemoveFamilyMember(ctx, "3171010101240001", "CARD001", "Moved out")
+	assert.Error(t, err, "Head of family cannot leave while dependents remain")
 
-func (m *MockClientIdentity) GetAttributeValue(attrName string) (value string, found bool, err error) {
-	return "", false, nil
-}
+	err = contract.TransferFamilyMember(ctx, "3171010101240001", "3171010101240002", "CARD002", "spouse")
+	assert.NoError(t, err)
+	group, err = contract.GetFamilyGroupByCard(ctx, "CARD002")
+	assert.NoError(t, err)
+	assert.Equal(t, "3171010101240002", group.KKNumber)
+	assert.Equal(t, "spouse", group.Members[1].Relationship)
 
-func (m *MockClientIdentity) AssertAttributeValue(attrName, attrValue string) error {
-	return nil
+	group, err = contract.GetFamilyGroup(ctx, "3171010101240001")
+	assert.NoError(t, err)
+	assert.Len(t, group.Members, 1)
+
+	// A group is deleted when its last member, the head, leaves
+	err = contract.TransferFamilyMember(ctx, "3171010101240001", "3171010101240002", "CARD001", "parent")
+	assert.NoError(t, err)
+	_, err = contract.GetFamilyGroup(ctx, "3171010101240001")
+	assert.ErrorContains(t, err, "not found")
+	group, err = contract.GetFamilyGroupByCard(ctx, "CARD001")
+	assert.NoError(t, err)
+	assert.Equal(t, "3171010101240002", group.KKNumber)
+
+	err = contract.RemoveFamilyMember(ctx, "3171010101240002", "CARD002", "Divorce")
+	assert.NoError(t, err)
+	_, err = contract.GetFamilyGroupByCard(ctx, "CARD002")
+	assert.Error(t, err)
 }
 
-// Test IssueCard function
-func TestIssueCard(t *testing.T) {
+// Test ReplaceCard links old and new cards and keeps history reachable
+func TestReplaceCard(t *testing.T) {
 	contract := new(BPJSSmartContract)
 	ctx := NewMockTransactionContext()
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
 
-	// Mock GetState to return nil (card doesn't exist)
-	ctx.stub.On("GetState", "CARD001").Return([]byte(nil), nil)
-	ctx.stub.On("PutState", "CARD001", mock.Anything).Return(nil)
-	ctx.stub.On("PutState", mock.Anything, []byte{0x00}).Return(nil) // composite key
-
-	err := contract.IssueCard(ctx, "CARD001", "P001", "Budi Santoso", 
-		"1234567890123456", "1990-01-01", "Male", "Jakarta", "PBI", 
+	err := contract.IssueCard(ctx, "CARD001", "P001", "Budi Santoso",
+		"3171010101900001", "1990-01-01", "Male", "Jakarta", "PBPU",
 		"2024-01-01", "2025-01-01")
+	assert.NoError(t, err)
+	err = contract.CreateFamilyGroup(ctx, "3171010101240001", "CARD001")
+	assert.NoError(t, err)
+	acceptTestReferrals(t, contract, ctx, "REF-VISIT001", "REF-VISIT002")
+	err = contract.RecordVisit(ctx, "VISIT001", "CARD001", "P001", "Budi Santoso",
+		"RS001", "2024-01-15", "outpatient",
+		"Flu", "Medicine prescribed", "DOC001", "Regular checkup", "J11.1", "", "", "REF-VISIT001")
+	assert.NoError(t, err)
 
-	assert.NoError(t, err, "IssueCard should succeed")
-	
-	// Verify card was stored
-	cardJSON := ctx.stub.State["CARD001"]
-	assert.NotNil(t, cardJSON, "Card should be stored")
+	err = contract.ReplaceCard(ctx, "CARD001", "CARD002", "CONTRIBUTION_ARREARS")
+	var transitionErr *CardStatusTransitionError
+	assert.ErrorAs(t, err, &transitionErr)
+	err = contract.UpdateCardStatus(ctx, "CARD001", "replaced", "CARD_LOST", "Lost")
+	assert.ErrorContains(t, err, "use ReplaceCard")
 
-	var card BPJSCard
-	json.Unmarshal(cardJSON, &card)
-	assert.Equal(t, "CARD001", card.CardID)
-	assert.Equal(t, "P001", card.PatientID)
-	assert.Equal(t, "active", card.Status)
-}
+	// A suspended card is not replaced until the suspension is lifted
+	err = contract.UpdateCardStatus(ctx, "CARD001", "suspended", "ADMINISTRATIVE_HOLD", "Hold")
+	assert.NoError(t, err)
+	err = contract.ReplaceCard(ctx, "CARD001", "CARD002", "CARD_LOST")
+	assert.ErrorContains(t, err, "card CARD001 is suspended")
+	err = contract.UpdateCardStatus(ctx, "CARD001", "active", "HOLD_RELEASED", "Released")
+	assert.NoError(t, err)
 
-// Test IssueCard duplicate
-func TestIssueCardDuplicate(t *testing.T) {
-	contract := new(BPJSSmartContract)
-	ctx := NewMockTransactionContext()
+	err = contract.ReplaceCard(ctx, "CARD001", "CARD002", "CARD_LOST")
+	assert.NoError(t, err)
 
-	existingCard := BPJSCard{CardID: "CARD001", PatientID: "P001"}
-	existingJSON, _ := json.Marshal(existingCard)
+	var oldCard, newCard BPJSCard
+	json.Unmarshal(ctx.stub.State[cardKey("CARD001")], &oldCard)
+	json.Unmarshal(ctx.stub.State[cardKey("CARD002")], &newCard)
+	assert.Equal(t, "replaced", oldCard.Status)
+	assert.Equal(t, "CARD002", oldCard.ReplacedBy)
+	assert.Equal(t, "active", newCard.Status)
+	assert.Equal(t, "CARD001", newCard.Replaces)
+	assert.Equal(t, oldCard.NIK, newCard.NIK)
+	assert.Equal(t, "2025-01-01", newCard.ExpiryDate)
+
+	byNIK, err := contract.GetCardByNIK(ctx, "3171010101900001")
+	assert.NoError(t, err)
+	assert.Equal(t, "CARD002", byNIK.CardID)
 
-	// Mock GetState to return existing card
-	ctx.stub.On("GetState", "CARD001").Return(existingJSON, nil)
+	group, err := contract.GetFamilyGroupByCard(ctx, "CARD002")
+	assert.NoError(t, err)
+	assert.Equal(t, "CARD002", group.HeadCardID)
 
-	err := contract.IssueCard(ctx, "CARD001", "P001", "Budi", 
-		"1234567890123456", "1990-01-01", "Male", "Jakarta", "PBI",
-		"2024-01-01", "2025-01-01")
+	err = contract.RecordVisit(ctx, "VISIT002", "CARD002", "P001", "Budi Santoso",
+		"RS001", "2024-01-15", "outpatient",
+		"Flu", "Follow-up", "DOC001", "Follow-up", "J11.1", "", "", "REF-VISIT002")
+	assert.NoError(t, err)
 
-	assert.Error(t, err, "Should return error for duplicate card")
-	assert.Contains(t, err.Error(), "already exists")
+	visits, err := contract.GetCardVisits(ctx, "CARD002")
+	assert.NoError(t, err)
+	assert.Len(t, visits, 2)
+
+	chain, err := contract.GetCardChain(ctx, "CARD001")
+	assert.NoError(t, err)
+	assert.Len(t, chain, 2)
+	assert.Equal(t, "CARD002", chain[1].CardID)
 }
 
-// Test VerifyCard
-func TestVerifyCard(t *testing.T) {
+// Test contribution arrears calculation and suspension
+func TestSuspendCardsInArrears(t *testing.T) {
 	contract := new(BPJSSmartContract)
 	ctx := NewMockTransactionContext()
 
-	card := BPJSCard{
-		CardID:    "CARD001",
-		PatientID: "P001",
-		Status:    "active",
+	for _, id := range []string{"CARD001", "CARD002"} {
+		card := BPJSCard{CardID: id, PatientID: "P" + id, Status: "active", IssueDate: "2023-10-05"}
+		cardJSON, _ := json.Marshal(card)
+		ctx.stub.State[cardKey(id)] = cardJSON
 	}
-	cardJSON, _ := json.Marshal(card)
 
-	ctx.stub.On("GetState", "CARD001").Return(cardJSON, nil)
+	// CARD001 paid everything due before January 2024, CARD002 only October
+	for _, period := range []string{"2023-10", "2023-11", "2023-12"} {
+		err := contract.RecordContributionPayment(ctx, "PAY-"+period, "CARD001", period, 42000, "2023-12-10", "bank")
+		assert.NoError(t, err)
+	}
+	err := contract.RecordContributionPayment(ctx, "PAY-1", "CARD002", "2023-10", 42000, "2023-10-10", "bank")
+	assert.NoError(t, err)
+	err = contract.RecordContributionPayment(ctx, "PAY-2", "CARD002", "2023-10", 42000, "2023-10-10", "bank")
+	assert.Error(t, err, "A month can only be paid once")
 
-	result, err := contract.VerifyCard(ctx, "CARD001")
+	arrears, err := contract.GetContributionArrears(ctx, "CARD002")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2023-11", "2023-12"}, arrears.UnpaidMonths)
 
+	suspended, err := contract.SuspendCardsInArrears(ctx, 1)
 	assert.NoError(t, err)
-	assert.NotNil(t, result)
-	assert.Equal(t, "CARD001", result.CardID)
-	assert.Equal(t, "active", result.Status)
+	assert.Equal(t, []string{"CARD002"}, suspended)
+
+	_, err = contract.VerifyCard(ctx, "CARD001")
+	assert.NoError(t, err)
+	_, err = contract.VerifyCard(ctx, "CARD002")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "suspended for arrears")
 }
 
-// Test VerifyCard with inactive card
-func TestVerifyCardInactive(t *testing.T) {
+// Test cards issued before participant segments with card type PBI stay government funded
+func TestLegacyPBICard(t *testing.T) {
 	contract := new(BPJSSmartContract)
 	ctx := NewMockTransactionContext()
 
-	card := BPJSCard{
-		CardID:    "CARD001",
-		PatientID: "P001",
-		Status:    "suspended",
-	}
+	card := BPJSCard{CardID: "CARD001", PatientID: "P001", NIK: "3171010101900001", Status: "active",
+		CardType: "PBI", IssueDate: "2023-06-01", SegmentEffectiveDate: "2023-06-01", RegionCode: "3171"}
 	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
 
-	ctx.stub.On("GetState", "CARD001").Return(cardJSON, nil)
+	arrears, err := contract.GetContributionArrears(ctx, "CARD001")
+	assert.NoError(t, err)
+	assert.Empty(t, arrears.UnpaidMonths)
+	suspended, err := contract.SuspendCardsInArrears(ctx, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, suspended)
 
-	result, err := contract.VerifyCard(ctx, "CARD001")
+	assert.ErrorContains(t, contract.ChangeCareClass(ctx, "CARD001", "1", "Upgrade"), "fixed at care class 3")
+	assert.ErrorContains(t, contract.SetSubsidyQuota(ctx, "PBI", "3171", 10), "not government funded")
 
-	assert.Error(t, err)
-	assert.Nil(t, result)
-	assert.Contains(t, err.Error(), "not active")
+	// Deactivating the card releases no quota place, since it never took one
+	assert.NoError(t, contract.UpdateCardStatus(ctx, "CARD001", "inactive", "MEMBERSHIP_TERMINATED", "Moved abroad"))
+	assert.NoError(t, contract.UpdateCardStatus(ctx, "CARD001", "active", "MEMBERSHIP_REINSTATED", "Returned"))
+
+	// Moving to a current PBI segment takes a quota place; the PBI months stay free
+	assert.NoError(t, contract.SetSubsidyQuota(ctx, "PBI-APBD", "3171", 1))
+	assert.NoError(t, contract.ChangeSegment(ctx, "CARD001", "PBI-APBD", "2024-01-01", "Regional programme"))
+	quota, err := contract.GetSubsidyQuota(ctx, "PBI-APBD", "3171")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, quota.Used)
+	assert.NoError(t, contract.ChangeSegment(ctx, "CARD001", "PBPU", "2024-01-15", "Self-paying"))
+	arrears, err = contract.GetContributionArrears(ctx, "CARD001")
+	assert.NoError(t, err)
+	assert.Empty(t, arrears.UnpaidMonths)
 }
 
-// Test UpdateCardStatus
-func TestUpdateCardStatus(t *testing.T) {
+// Test arrears run from the membership start across renewals and replacements, skip PBI cards
+// and clear the family group once paid
+func TestContributionArrearsMembership(t *testing.T) {
 	contract := new(BPJSSmartContract)
 	ctx := NewMockTransactionContext()
 
-	card := BPJSCard{
-		CardID:    "CARD001",
-		PatientID: "P001",
-		Status:    "active",
+	for id, cardType := range map[string]string{"CARD001": "PBPU", "CARD002": "PBI-APBN"} {
+		card := BPJSCard{CardID: id, PatientID: "P" + id, NIK: "NIK-" + id, Status: "active",
+			CardType: cardType, IssueDate: "2023-10-05"}
+		cardJSON, _ := json.Marshal(card)
+		ctx.stub.State[cardKey(id)] = cardJSON
 	}
-	cardJSON, _ := json.Marshal(card)
+	assert.NoError(t, contract.CreateFamilyGroup(ctx, "3171010101010001", "CARD001"))
 
-	ctx.stub.On("GetState", "CARD001").Return(cardJSON, nil)
-	ctx.stub.On("PutState", "CARD001", mock.Anything).Return(nil)
-	ctx.stub.On("PutState", mock.Anything, mock.Anything).Return(nil) // audit log
+	err := contract.RecordContributionPayment(ctx, "PAY-1", "CARD001", "2023-10", 42000, "2023-10-10", "bank")
+	assert.NoError(t, err)
 
-	err := contract.UpdateCardStatus(ctx, "CARD001", "suspended", "Payment overdue")
+	// Renewing and replacing the card keeps the months owed since the original issue date
+	assert.NoError(t, contract.RenewCard(ctx, "CARD001", "2026-01-01"))
+	assert.NoError(t, contract.ReplaceCard(ctx, "CARD001", "CARD003", "CARD_LOST"))
+	arrears, err := contract.GetContributionArrears(ctx, "CARD003")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2023-11", "2023-12"}, arrears.UnpaidMonths)
 
+	arrears, err = contract.GetContributionArrears(ctx, "CARD002")
 	assert.NoError(t, err)
+	assert.Empty(t, arrears.UnpaidMonths)
 
-	// Verify status was updated
-	updatedJSON := ctx.stub.State["CARD001"]
-	var updatedCard BPJSCard
-	json.Unmarshal(updatedJSON, &updatedCard)
-	assert.Equal(t, "suspended", updatedCard.Status)
+	suspended, err := contract.SuspendCardsInArrears(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"CARD003"}, suspended)
+
+	err = contract.RecordContributionPayment(ctx, "PAY-2", "CARD003", "2023-11", 42000, "2024-01-15", "bank")
+	assert.NoError(t, err)
+	group, err := contract.GetFamilyGroup(ctx, "3171010101010001")
+	assert.NoError(t, err)
+	assert.Equal(t, "arrears", group.ContributionStatus)
+
+	err = contract.RecordContributionPayment(ctx, "PAY-3", "CARD003", "2023-12", 42000, "2024-01-15", "bank")
+	assert.NoError(t, err)
+	group, err = contract.GetFamilyGroup(ctx, "3171010101010001")
+	assert.NoError(t, err)
+	assert.Equal(t, "current", group.ContributionStatus)
 }
 
 // Test RecordVisit
 func TestRecordVisit(t *testing.T) {
 	contract := new(BPJSSmartContract)
 	ctx := NewMockTransactionContext()
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
 
 	// Setup active card
 	card := BPJSCard{
@@ -203,19 +1934,20 @@ func TestRecordVisit(t *testing.T) {
 	}
 	cardJSON, _ := json.Marshal(card)
 
-	ctx.stub.On("GetState", "CARD001").Return(cardJSON, nil)
-	ctx.stub.On("GetState", "VISIT001").Return([]byte(nil), nil)
-	ctx.stub.On("PutState", "VISIT001", mock.Anything).Return(nil)
+	ctx.stub.On("GetState", cardKey("CARD001")).Return(cardJSON, nil)
+	ctx.stub.On("GetState", visitKey("VISIT001")).Return([]byte(nil), nil)
+	ctx.stub.On("PutState", visitKey("VISIT001"), mock.Anything).Return(nil)
 	ctx.stub.On("PutState", mock.Anything, mock.Anything).Return(nil)
+	acceptTestReferrals(t, contract, ctx, "REF-VISIT001")
 
 	err := contract.RecordVisit(ctx, "VISIT001", "CARD001", "P001", "Budi",
-		"RS001", "RS Siloam", "rumahsakit", "2024-01-15", "outpatient",
-		"Flu", "Medicine prescribed", "Dr. Smith", "DOC001", "Regular checkup")
+		"RS001", "2024-01-15", "outpatient",
+		"Flu", "Medicine prescribed", "DOC001", "Regular checkup", "J11.1", "", "", "REF-VISIT001")
 
 	assert.NoError(t, err)
 
 	// Verify visit was stored
-	visitJSON := ctx.stub.State["VISIT001"]
+	visitJSON := ctx.stub.State[visitKey("VISIT001")]
 	assert.NotNil(t, visitJSON)
 	
 	var visit Visit
@@ -224,10 +1956,211 @@ func TestRecordVisit(t *testing.T) {
 	assert.Equal(t, "P001", visit.PatientID)
 }
 
+// Test RecordVisit enforces the registered primary care facility
+func TestRecordVisitPrimaryFacility(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
+
+	card := BPJSCard{CardID: "CARD001", PatientID: "P001", Status: "active"}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+
+	err := contract.RecordVisit(ctx, "VISIT001", "CARD001", "P001", "Budi",
+		"PKM001", "2024-01-15", "outpatient",
+		"Flu", "Medicine", "DOC002", "Notes", "J11.1", "", "", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no registered primary care facility")
+
+	err = contract.ChangePrimaryFacility(ctx, "CARD001", "PKM001", "Nearest to home")
+	assert.NoError(t, err)
+
+	err = contract.RecordVisit(ctx, "VISIT001", "CARD001", "P001", "Budi",
+		"PKM001", "2024-01-15", "outpatient",
+		"Flu", "Medicine", "DOC002", "Notes", "J11.1", "", "", "")
+	assert.NoError(t, err)
+
+	err = contract.RecordVisit(ctx, "VISIT002", "CARD001", "P001", "Budi",
+		"PKM002", "2024-01-15", "outpatient",
+		"Flu", "Medicine", "DOC003", "Notes", "J11.1", "", "", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "registered to primary care facility PKM001")
+
+	// Emergencies can be treated anywhere
+	err = contract.RecordVisit(ctx, "VISIT002", "CARD001", "P001", "Budi",
+		"PKM002", "2024-01-15", "emergency",
+		"Asthma attack", "Nebulizer", "DOC003", "Notes", "J45.9", "", "", "")
+	assert.NoError(t, err)
+
+	err = contract.ChangePrimaryFacility(ctx, "CARD001", "PKM002", "Moved")
+	assert.Error(t, err, "Facility can only change once every three months")
+
+	ctx.stub.TxTimestamp = time.Date(2024, 4, 15, 8, 0, 0, 0, time.UTC)
+	err = contract.ChangePrimaryFacility(ctx, "CARD001", "PKM002", "Moved")
+	assert.NoError(t, err)
+
+	members, err := contract.GetMembersByPrimaryFacility(ctx, "PKM002")
+	assert.NoError(t, err)
+	assert.Len(t, members, 1)
+	members, err = contract.GetMembersByPrimaryFacility(ctx, "PKM001")
+	assert.NoError(t, err)
+	assert.Len(t, members, 0)
+}
+
+// Test RecordVisit only accepts the known visit types
+func TestRecordVisitType(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
+
+	card := BPJSCard{CardID: "CARD001", PatientID: "P001", Status: "active", PrimaryFacility: "PKM001"}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+
+	// An unknown type would otherwise skip the FKTP and referral rules
+	for _, visitType := range []string{"Outpatient", "rawat-jalan", ""} {
+		err := contract.RecordVisit(ctx, "VISIT001", "CARD001", "P001", "Budi",
+			"RS001", "2024-01-15", visitType,
+			"Flu", "Medicine", "DOC001", "Notes", "J11.1", "", "", "")
+		assert.ErrorContains(t, err, "invalid visit type "+visitType, visitType)
+	}
+	assert.Nil(t, ctx.stub.State[visitKey("VISIT001")])
+}
+
+// Test members leaving the membership drop off their facility member list
+func TestPrimaryFacilityMembersStatus(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+	registerTestFaskes(t, contract, ctx)
+
+	for _, id := range []string{"CARD001", "CARD002"} {
+		card := BPJSCard{CardID: id, PatientID: "P" + id, Status: "active", DateOfBirth: "1980-01-01"}
+		cardJSON, _ := json.Marshal(card)
+		ctx.stub.State[cardKey(id)] = cardJSON
+		assert.NoError(t, contract.ChangePrimaryFacility(ctx, id, "PKM001", "Nearest to home"))
+	}
+
+	members, err := contract.GetMembersByPrimaryFacility(ctx, "PKM001")
+	assert.NoError(t, err)
+	assert.Len(t, members, 2)
+
+	assert.NoError(t, contract.UpdateCardStatus(ctx, "CARD001", "inactive", "MEMBERSHIP_TERMINATED", "Moved abroad"))
+	assert.NoError(t, contract.RegisterDeath(ctx, "CARD002", "2024-01-12", "Death certificate"))
+	members, err = contract.GetMembersByPrimaryFacility(ctx, "PKM001")
+	assert.NoError(t, err)
+	assert.Len(t, members, 0)
+
+	assert.NoError(t, contract.UpdateCardStatus(ctx, "CARD001", "active", "MEMBERSHIP_REINSTATED", "Returned"))
+	members, err = contract.GetMembersByPrimaryFacility(ctx, "PKM001")
+	assert.NoError(t, err)
+	assert.Len(t, members, 1)
+	assert.Equal(t, "CARD001", members[0].CardID)
+}
+
+// Test hospital outpatient visits consume an accepted referral
+func TestRecordVisitReferral(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
+
+	for _, card := range []BPJSCard{
+		{CardID: "CARD001", PatientID: "P001", Status: "active"},
+		{CardID: "CARD002", PatientID: "P002", Status: "active"},
+	} {
+		cardJSON, _ := json.Marshal(card)
+		ctx.stub.State[cardKey(card.CardID)] = cardJSON
+	}
+
+	referrals := []struct {
+		referralID string
+		patientID  string
+		cardID     string
+		toFaskes   string
+		validUntil string
+		accept     bool
+	}{
+		{"REF001", "P001", "CARD001", "RS001", "2024-04-10", false},
+		{"REF002", "P001", "CARD001", "RS002", "2024-04-10", true},
+		{"REF003", "P002", "CARD002", "RS001", "2024-04-10", true},
+		{"REF004", "P001", "CARD001", "RS001", "2024-01-12", true},
+		{"REF005", "P001", "CARD001", "RS001", "2024-04-10", true},
+		{"REF006", "P001", "CARD001", "RS001", "2024-01-14", true},
+	}
+	for _, ref := range referrals {
+		err := contract.CreateReferral(ctx, ref.referralID, ref.patientID, "Budi", ref.cardID, "PKM001",
+			ref.toFaskes, "Specialist", "Flu", "DOC002", "2024-01-10", ref.validUntil, "")
+		assert.NoError(t, err)
+		if ref.accept {
+			assert.NoError(t, contract.UpdateReferralStatus(ctx, ref.referralID, "accepted", ""))
+		}
+	}
+
+	recordVisit := func(visitID string, visitType string, referralID string) error {
+		return contract.RecordVisit(ctx, visitID, "CARD001", "P001", "Budi", "RS001", "2024-01-15", visitType,
+			"Flu", "Medicine", "DOC001", "Notes", "J11.1", "", "", referralID)
+	}
+	assert.ErrorContains(t, recordVisit("VISIT001", "outpatient", ""), "outpatient visits at FKRTL RS001 require a referral")
+	assert.ErrorContains(t, recordVisit("VISIT001", "outpatient", "REF999"), "referral REF999 not found")
+	assert.ErrorContains(t, recordVisit("VISIT001", "outpatient", "REF001"), "referral REF001 is pending, not accepted")
+	assert.ErrorContains(t, recordVisit("VISIT001", "outpatient", "REF002"), "referral REF002 is to faskes RS002, not RS001")
+	assert.ErrorContains(t, recordVisit("VISIT001", "outpatient", "REF003"), "referral REF003 is for patient P002, not P001")
+	assert.ErrorContains(t, recordVisit("VISIT001", "outpatient", "REF004"), "referral REF004 expired on 2024-01-12")
+
+	// Backdating the visit into the validity period does not revive an expired referral
+	err := contract.RecordVisit(ctx, "VISIT001", "CARD001", "P001", "Budi", "RS001", "2024-01-13", "outpatient",
+		"Flu", "Medicine", "DOC001", "Notes", "J11.1", "", "", "REF006")
+	assert.ErrorContains(t, err, "referral REF006 expired on 2024-01-14")
+	err = contract.RecordVisit(ctx, "VISIT001", "CARD001", "P001", "Budi", "RS001", "2024-01-16", "outpatient",
+		"Flu", "Medicine", "DOC001", "Notes", "J11.1", "", "", "REF005")
+	assert.ErrorContains(t, err, "visit date 2024-01-16 is in the future")
+
+	// Emergencies need no referral
+	assert.NoError(t, recordVisit("VISIT001", "emergency", ""))
+
+	assert.NoError(t, recordVisit("VISIT002", "outpatient", "REF005"))
+	var visit Visit
+	json.Unmarshal(ctx.stub.State[visitKey("VISIT002")], &visit)
+	assert.Equal(t, "REF005", visit.ReferralID)
+	var referral Referral
+	json.Unmarshal(ctx.stub.State[referralKey("REF005")], &referral)
+	assert.Equal(t, "completed", referral.Status)
+	assert.Equal(t, "VISIT002", referral.VisitID)
+
+	assert.ErrorContains(t, recordVisit("VISIT003", "outpatient", "REF005"), "referral REF005 is completed, not accepted")
+
+	// A used referral cannot be reopened for another visit
+	err = contract.UpdateReferralStatus(ctx, "REF005", "accepted", "")
+	assert.ErrorContains(t, err, "referral REF005 cannot change status from completed to accepted")
+	err = contract.UpdateReferralStatus(ctx, "REF001", "done", "")
+	assert.ErrorContains(t, err, "unknown referral status done")
+
+	logs, err := contract.GetAllAuditLogs(ctx)
+	assert.NoError(t, err)
+	var used *AuditLog
+	for _, log := range logs {
+		if log.EntityType == "referral" && log.EntityID == "REF005" && log.Action == "RecordVisit" {
+			used = log
+		}
+	}
+	if assert.NotNil(t, used) {
+		assert.Equal(t, "accepted", used.OldState)
+		assert.Equal(t, "completed", used.NewState)
+	}
+}
+
 // Test RecordVisit with inactive card
 func TestRecordVisitInactiveCard(t *testing.T) {
 	contract := new(BPJSSmartContract)
 	ctx := NewMockTransactionContext()
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
 
 	card := BPJSCard{
 		CardID:    "CARD001",
@@ -236,11 +2169,11 @@ func TestRecordVisitInactiveCard(t *testing.T) {
 	}
 	cardJSON, _ := json.Marshal(card)
 
-	ctx.stub.On("GetState", "CARD001").Return(cardJSON, nil)
+	ctx.stub.On("GetState", cardKey("CARD001")).Return(cardJSON, nil)
 
 	err := contract.RecordVisit(ctx, "VISIT001", "CARD001", "P001", "Budi",
-		"RS001", "RS Siloam", "rumahsakit", "2024-01-15", "outpatient",
-		"Flu", "Medicine", "Dr. Smith", "DOC001", "Notes")
+		"RS001", "2024-01-15", "outpatient",
+		"Flu", "Medicine", "DOC001", "Notes", "J11.1", "", "", "")
 
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "not active")
@@ -250,6 +2183,9 @@ func TestRecordVisitInactiveCard(t *testing.T) {
 func TestSubmitClaim(t *testing.T) {
 	contract := new(BPJSSmartContract)
 	ctx := NewMockTransactionContext()
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
 
 	// Setup active card
 	card := BPJSCard{
@@ -259,18 +2195,32 @@ func TestSubmitClaim(t *testing.T) {
 	}
 	cardJSON, _ := json.Marshal(card)
 
-	ctx.stub.On("GetState", "CARD001").Return(cardJSON, nil)
-	ctx.stub.On("PutState", "CLAIM001", mock.Anything).Return(nil)
+	visit := Visit{VisitID: "VISIT001", CardID: "CARD001", PatientID: "P001", FaskesCode: "RS001"}
+	visitJSON, _ := json.Marshal(visit)
+
+	ctx.stub.On("GetState", cardKey("CARD001")).Return(cardJSON, nil)
+	ctx.stub.On("GetState", visitKey("VISIT001")).Return(visitJSON, nil)
+	ctx.stub.On("PutState", claimKey("CLAIM001"), mock.Anything).Return(nil)
 	ctx.stub.On("PutState", mock.Anything, mock.Anything).Return(nil)
 
+	// Only the facility that recorded the visit can claim for it
 	err := contract.SubmitClaim(ctx, "CLAIM001", "P001", "Budi", "CARD001", "VISIT001",
-		"RS001", "RS Siloam", "rawat-jalan", "2024-01-15",
-		"Flu", "Consultation and medicine", 500000, 450000)
+		"RS002", "rawat-jalan", "2024-01-15",
+		"Flu", "Consultation and medicine", 500000, 450000, "", "J11.1", "")
+	assert.ErrorContains(t, err, "visit VISIT001 was recorded at faskes RS001, not RS002")
+	err = contract.SubmitClaim(ctx, "CLAIM001", "P001", "Budi", "CARD001", "VISIT999",
+		"RS001", "rawat-jalan", "2024-01-15",
+		"Flu", "Consultation and medicine", 500000, 450000, "", "J11.1", "")
+	assert.ErrorContains(t, err, "visit VISIT999 not found")
+
+	err = contract.SubmitClaim(ctx, "CLAIM001", "P001", "Budi", "CARD001", "VISIT001",
+		"RS001", "rawat-jalan", "2024-01-15",
+		"Flu", "Consultation and medicine", 500000, 450000, "", "J11.1", "")
 
 	assert.NoError(t, err)
 
 	// Verify claim was stored
-	claimJSON := ctx.stub.State["CLAIM001"]
+	claimJSON := ctx.stub.State[claimKey("CLAIM001")]
 	assert.NotNil(t, claimJSON)
 
 	var claim Claim
@@ -280,6 +2230,102 @@ func TestSubmitClaim(t *testing.T) {
 	assert.Equal(t, 450000.0, claim.ClaimAmount)
 }
 
+// Test inpatient claims split class upgrades into a co-payment
+func TestSubmitClaimCareClassUpgrade(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
+
+	card := BPJSCard{
+		CardID:    "CARD001",
+		PatientID: "P001",
+		Status:    "active",
+		CardType:  "PBPU",
+		CareClass: "3",
+	}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+
+	for _, id := range []string{"VISIT001", "VISIT002"} {
+		visit := Visit{VisitID: id, CardID: "CARD001", PatientID: "P001", FaskesCode: "RS001", VisitType: "inpatient",
+			Episode: &InpatientEpisode{Status: "discharged", LengthOfStay: 3}}
+		visitJSON, _ := json.Marshal(visit)
+		ctx.stub.State[visitKey(id)] = visitJSON
+	}
+
+	err := contract.SubmitClaim(ctx, "CLAIM001", "P001", "Budi", "CARD001", "VISIT001",
+		"RS001", "rawat-inap", "2024-01-15",
+		"Typhoid", "Inpatient care", 7000000, 7000000, "", "A01.0", "")
+	assert.Error(t, err, "Inpatient claims require a room class")
+
+	err = contract.SubmitClaim(ctx, "CLAIM001", "P001", "Budi", "CARD001", "VISIT001",
+		"RS001", "rawat-inap", "2024-01-15",
+		"Typhoid", "Inpatient care", 7000000, 7000000, "1", "A01.0", "")
+	assert.NoError(t, err)
+
+	var claim Claim
+	json.Unmarshal(ctx.stub.State[claimKey("CLAIM001")], &claim)
+	assert.Equal(t, "3", claim.EntitledClass)
+	assert.Equal(t, "1", claim.RoomClass)
+	assert.InDelta(t, 5000000.0, claim.ClaimAmount, 0.01)
+	assert.InDelta(t, 2000000.0, claim.CoPayment, 0.01)
+
+	// A room below the entitled class is fully covered
+	err = contract.ChangeCareClass(ctx, "CARD001", "1", "Upgrade")
+	assert.NoError(t, err)
+	err = contract.SubmitClaim(ctx, "CLAIM002", "P001", "Budi", "CARD001", "VISIT002",
+		"RS001", "rawat-inap", "2024-01-15",
+		"Typhoid", "Inpatient care", 5000000, 5000000, "2", "A01.0", "")
+	assert.NoError(t, err)
+	json.Unmarshal(ctx.stub.State[claimKey("CLAIM002")], &claim)
+	assert.Equal(t, 5000000.0, claim.ClaimAmount)
+	assert.Equal(t, 0.0, claim.CoPayment)
+}
+
+// Test ChangeCareClass holding period and PBI restriction
+func TestChangeCareClass(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{CardID: "CARD001", PatientID: "P001", Status: "active", CardType: "PPU", CareClass: "2"}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+	pbiCard := BPJSCard{CardID: "CARD002", PatientID: "P002", Status: "active", CardType: "PBI-APBN", CareClass: "3"}
+	pbiJSON, _ := json.Marshal(pbiCard)
+	ctx.stub.State[cardKey("CARD002")] = pbiJSON
+
+	err := contract.ChangeCareClass(ctx, "CARD002", "2", "Upgrade")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "fixed at care class 3")
+
+	// The class given at issue must be held as long as any other
+	err = contract.IssueCard(ctx, "CARD003", "P003", "Budi Santoso",
+		"3171010101900001", "1990-01-01", "Male", "Jakarta", "PBPU",
+		"2024-01-01", "2025-01-01")
+	assert.NoError(t, err)
+	err = contract.ChangeCareClass(ctx, "CARD003", "1", "Upgrade")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "held since 2024-01-01 cannot be changed before 2025-01-01")
+
+	err = contract.ChangeCareClass(ctx, "CARD001", "1", "Promotion")
+	assert.NoError(t, err)
+
+	ctx.stub.TxTimestamp = time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	err = contract.ChangeCareClass(ctx, "CARD001", "2", "Downgrade")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot be changed before 2025-01-15")
+
+	ctx.stub.TxTimestamp = time.Date(2025, 1, 15, 8, 0, 0, 0, time.UTC)
+	err = contract.ChangeCareClass(ctx, "CARD001", "2", "Downgrade")
+	assert.NoError(t, err)
+
+	json.Unmarshal(ctx.stub.State[cardKey("CARD001")], &card)
+	assert.Equal(t, "2", card.CareClass)
+	assert.Equal(t, "2025-01-15", card.CareClassSince)
+}
+
 // Test ProcessClaim approve
 func TestProcessClaimApprove(t *testing.T) {
 	contract := new(BPJSSmartContract)
@@ -292,8 +2338,8 @@ func TestProcessClaimApprove(t *testing.T) {
 	}
 	claimJSON, _ := json.Marshal(claim)
 
-	ctx.stub.On("GetState", "CLAIM001").Return(claimJSON, nil)
-	ctx.stub.On("PutState", "CLAIM001", mock.Anything).Return(nil)
+	ctx.stub.On("GetState", claimKey("CLAIM001")).Return(claimJSON, nil)
+	ctx.stub.On("PutState", claimKey("CLAIM001"), mock.Anything).Return(nil)
 	ctx.stub.On("PutState", mock.Anything, mock.Anything).Return(nil)
 
 	err := contract.ProcessClaim(ctx, "CLAIM001", "approved", "All documents verified")
@@ -301,7 +2347,7 @@ func TestProcessClaimApprove(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Verify status updated
-	updatedJSON := ctx.stub.State["CLAIM001"]
+	updatedJSON := ctx.stub.State[claimKey("CLAIM001")]
 	var updatedClaim Claim
 	json.Unmarshal(updatedJSON, &updatedClaim)
 	assert.Equal(t, "approved", updatedClaim.Status)
@@ -320,21 +2366,45 @@ func TestProcessClaimReject(t *testing.T) {
 	}
 	claimJSON, _ := json.Marshal(claim)
 
-	ctx.stub.On("GetState", "CLAIM001").Return(claimJSON, nil)
-	ctx.stub.On("PutState", "CLAIM001", mock.Anything).Return(nil)
+	ctx.stub.On("GetState", claimKey("CLAIM001")).Return(claimJSON, nil)
+	ctx.stub.On("PutState", claimKey("CLAIM001"), mock.Anything).Return(nil)
 	ctx.stub.On("PutState", mock.Anything, mock.Anything).Return(nil)
 
 	err := contract.ProcessClaim(ctx, "CLAIM001", "rejected", "Incomplete documentation")
 
 	assert.NoError(t, err)
 
-	updatedJSON := ctx.stub.State["CLAIM001"]
+	updatedJSON := ctx.stub.State[claimKey("CLAIM001")]
 	var updatedClaim Claim
 	json.Unmarshal(updatedJSON, &updatedClaim)
 	assert.Equal(t, "rejected", updatedClaim.Status)
 	assert.Empty(t, updatedClaim.PaymentDate)
 }
 
+// Test ProcessClaim follows the claim status transitions
+func TestProcessClaimTransitions(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	claim := Claim{ClaimID: "CLAIM001", PatientID: "P001", Status: "submitted"}
+	claimJSON, _ := json.Marshal(claim)
+	ctx.stub.State[claimKey("CLAIM001")] = claimJSON
+
+	err := contract.ProcessClaim(ctx, "CLAIM001", "paid", "Transferred")
+	assert.Error(t, err, "Claims must be approved before they are paid")
+	err = contract.ProcessClaim(ctx, "CLAIM001", "settled", "Transferred")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown claim status settled")
+
+	assert.NoError(t, contract.ProcessClaim(ctx, "CLAIM001", "reviewing", "Checking documents"))
+	assert.NoError(t, contract.ProcessClaim(ctx, "CLAIM001", "approved", "All documents verified"))
+	assert.NoError(t, contract.ProcessClaim(ctx, "CLAIM001", "paid", "Transferred"))
+
+	err = contract.ProcessClaim(ctx, "CLAIM001", "rejected", "Duplicate")
+	assert.Error(t, err, "Paid claims are final")
+	assert.Contains(t, err.Error(), "cannot change status from paid to rejected")
+}
+
 // Test CreateReferral
 func TestCreateReferral(t *testing.T) {
 	contract := new(BPJSSmartContract)
@@ -347,49 +2417,137 @@ func TestCreateReferral(t *testing.T) {
 	}
 	cardJSON, _ := json.Marshal(card)
 
-	ctx.stub.On("GetState", "CARD001").Return(cardJSON, nil)
-	ctx.stub.On("PutState", "REF001", mock.Anything).Return(nil)
+	ctx.stub.On("GetState", cardKey("CARD001")).Return(cardJSON, nil)
+	ctx.stub.On("PutState", referralKey("REF001"), mock.Anything).Return(nil)
 	ctx.stub.On("PutState", mock.Anything, mock.Anything).Return(nil)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
 
 	err := contract.CreateReferral(ctx, "REF001", "P001", "Budi", "CARD001",
-		"PKM001", "Puskesmas Kelapa", "RS001", "RS Siloam",
-		"Need specialist", "Complex case", "Dr. Lee",
+		"PKM001", "PKM002",
+		"Need specialist", "Complex case", "DOC002",
+		"2024-01-15", "2024-02-15", "Urgent referral")
+	assert.ErrorContains(t, err, "cannot refer to FKTP faskes PKM002")
+	err = contract.CreateReferral(ctx, "REF001", "P002", "Siti", "CARD001",
+		"PKM001", "RS001",
+		"Need specialist", "Complex case", "DOC002",
+		"2024-01-15", "2024-02-15", "Urgent referral")
+	assert.ErrorContains(t, err, "referral patient P002 is not the holder of card CARD001")
+	for _, dates := range [][3]string{
+		{"15-01-2024", "2024-02-15", "invalid referral date"},
+		{"2024-01-15", "", "invalid valid until date"},
+		{"2024-01-15", "2024-01-14", "referral valid until 2024-01-14 is before referral date 2024-01-15"},
+	} {
+		err = contract.CreateReferral(ctx, "REF001", "P001", "Budi", "CARD001",
+			"PKM001", "RS001",
+			"Need specialist", "Complex case", "DOC002",
+			dates[0], dates[1], "Urgent referral")
+		assert.ErrorContains(t, err, dates[2])
+	}
+
+	err = contract.CreateReferral(ctx, "REF001", "P001", "Budi", "CARD001",
+		"PKM001", "RS001",
+		"Need specialist", "Complex case", "DOC002",
 		"2024-01-15", "2024-02-15", "Urgent referral")
 
 	assert.NoError(t, err)
 
-	referralJSON := ctx.stub.State["REF001"]
+	referralJSON := ctx.stub.State[referralKey("REF001")]
 	assert.NotNil(t, referralJSON)
 
 	var referral Referral
 	json.Unmarshal(referralJSON, &referral)
 	assert.Equal(t, "REF001", referral.ReferralID)
 	assert.Equal(t, "pending", referral.Status)
+	assert.Equal(t, "Puskesmas Kelapa", referral.FromFaskesName)
+	assert.Equal(t, "RS Siloam", referral.ToFaskesName)
 }
 
 // Test UpdateReferralStatus
 func TestUpdateReferralStatus(t *testing.T) {
 	contract := new(BPJSSmartContract)
 	ctx := NewMockTransactionContext()
+	registerTestFaskes(t, contract, ctx)
 
 	referral := Referral{
-		ReferralID: "REF001",
-		PatientID:  "P001",
-		Status:     "pending",
+		ReferralID:     "REF001",
+		PatientID:      "P001",
+		FromFaskesCode: "PKM001",
+		ToFaskesCode:   "RS001",
+		Status:         "pending",
 	}
 	referralJSON, _ := json.Marshal(referral)
 
-	ctx.stub.On("GetState", "REF001").Return(referralJSON, nil)
-	ctx.stub.On("PutState", "REF001", mock.Anything).Return(nil)
+	ctx.stub.On("GetState", referralKey("REF001")).Return(referralJSON, nil)
+	ctx.stub.On("PutState", referralKey("REF001"), mock.Anything).Return(nil)
 	ctx.stub.On("PutState", mock.Anything, mock.Anything).Return(nil)
 
-	err := contract.UpdateReferralStatus(ctx, "REF001", "accepted", "Dr. Wong", "Patient scheduled for tomorrow")
+	// Only the receiving hospital accepts the referral
+	ctx.MSPID = "PuskesmasMSP"
+	err := contract.UpdateReferralStatus(ctx, "REF001", "accepted", "Patient scheduled for tomorrow")
+	assert.ErrorContains(t, err, "faskes RS001 is operated by RumahSakitMSP, not PuskesmasMSP")
+
+	ctx.MSPID = "RumahSakitMSP"
+	err = contract.UpdateReferralStatus(ctx, "REF001", "accepted", "Patient scheduled for tomorrow")
 
 	assert.NoError(t, err)
 
-	updatedJSON := ctx.stub.State["REF001"]
+	updatedJSON := ctx.stub.State[referralKey("REF001")]
 	var updatedReferral Referral
 	json.Unmarshal(updatedJSON, &updatedReferral)
 	assert.Equal(t, "accepted", updatedReferral.Status)
-	assert.Equal(t, "Dr. Wong", updatedReferral.AcceptedBy)
+	assert.Equal(t, "testUser", updatedReferral.AcceptedBy)
+}
+
+// Test anchoring an off-chain document and verifying presented copies
+func TestDocumentAnchoring(t *testing.T) {
+	contract := new(BPJSSmartContract)
+	ctx := NewMockTransactionContext()
+
+	card := BPJSCard{CardID: "CARD001", PatientID: "P001", Status: "active"}
+	cardJSON, _ := json.Marshal(card)
+	ctx.stub.State[cardKey("CARD001")] = cardJSON
+	loadTestICD10Codes(t, contract, ctx)
+	registerTestFaskes(t, contract, ctx)
+	registerTestPractitioners(t, contract, ctx)
+	acceptTestReferrals(t, contract, ctx, "REF-VISIT001")
+
+	err := contract.RecordVisit(ctx, "VISIT001", "CARD001", "P001", "Budi", "RS001", "2024-01-15", "outpatient",
+		"Flu", "Medicine", "DOC001", "Notes", "J11.1", "", "", "REF-VISIT001")
+	assert.NoError(t, err)
+
+	store, err := docstore.NewFileStore(t.TempDir())
+	assert.NoError(t, err)
+	doc, err := store.Put(strings.NewReader("Leukocytes 12.000/uL, Widal positive"), "text/plain")
+	assert.NoError(t, err)
+
+	anchor := func(documentID string, hash string, visitID string, claimID string) error {
+		return contract.AnchorDocument(ctx, documentID, hash, doc.MediaType, doc.Size, visitID, claimID)
+	}
+	assert.ErrorContains(t, anchor("DOC-LAB-001", "abc", "VISIT001", ""), "invalid SHA-256 hash")
+	assert.ErrorContains(t, anchor("DOC-LAB-001", doc.SHA256, "", ""), "must belong to a visit or a claim")
+	assert.ErrorContains(t, anchor("DOC-LAB-001", doc.SHA256, "VISIT999", ""), "visit VISIT999 not found")
+	ctx.MSPID = "PuskesmasMSP"
+	assert.ErrorContains(t, anchor("DOC-LAB-001", doc.SHA256, "VISIT001", ""), "faskes RS001 is operated by RumahSakitMSP")
+	ctx.MSPID = "RumahSakitMSP"
+	assert.NoError(t, anchor("DOC-LAB-001", strings.ToUpper(doc.SHA256), "VISIT001", ""))
+	assert.ErrorContains(t, anchor("DOC-LAB-001", doc.SHA256, "VISIT001", ""), "document DOC-LAB-001 already exists")
+
+	var stored DocumentAnchor
+	json.Unmarshal(ctx.stub.State[documentKey("DOC-LAB-001")], &stored)
+	assert.Equal(t, doc.SHA256, stored.SHA256)
+	assert.Equal(t, "RumahSakitMSP", stored.AuthorMSP)
+
+	result, err := contract.VerifyDocument(ctx, "DOC-LAB-001", doc.SHA256)
+	assert.NoError(t, err)
+	assert.True(t, result.Match)
+
+	tamperedHash, _, err := docstore.Hash(strings.NewReader("Leukocytes 8.000/uL, Widal negative"))
+	assert.NoError(t, err)
+	result, err = contract.VerifyDocument(ctx, "DOC-LAB-001", tamperedHash)
+	assert.NoError(t, err)
+	assert.False(t, result.Match)
+
+	_, err = contract.VerifyDocument(ctx, "DOC-LAB-002", doc.SHA256)
+	assert.ErrorContains(t, err, "document DOC-LAB-002 is not anchored")
 }
@@ -0,0 +1,184 @@
+// Package docstore keeps clinical documents (lab results, imaging, resume medis) off-chain.
+//
+// Documents are too large and too sensitive for the world state. The store keeps them on
+// the local filesystem, addressed by their SHA-256 hash; the chaincode only anchors the
+// hash, media type and size (AnchorDocument), so a document presented later can be checked
+// against the ledger (VerifyDocument). A document can be deleted from the store while its
+// anchor stays on the ledger.
+package docstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Store errors
+var (
+	ErrInvalidHash = errors.New("invalid SHA-256 hash")
+	ErrNotFound    = errors.New("document not found")
+	ErrCorrupted   = errors.New("document content does not match its hash")
+)
+
+// hashPattern matches a lowercase hex encoded SHA-256 hash
+var hashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Document describes a stored document, with the values anchored on the ledger
+type Document struct {
+	SHA256    string `json:"sha256"`
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+}
+
+// FileStore is a content-addressed document store in a local directory. Each document is
+// kept at <root>/<first two hash characters>/<hash> next to a <hash>.json metadata file.
+type FileStore struct {
+	root string
+}
+
+// NewFileStore opens a store in root, creating the directory if needed
+func NewFileStore(root string) (*FileStore, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create document store: %v", err)
+	}
+	return &FileStore{root: root}, nil
+}
+
+// Hash returns the hex encoded SHA-256 hash and size of the content of r
+func Hash(r io.Reader) (string, int64, error) {
+	digest := sha256.New()
+	size, err := io.Copy(digest, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), size, nil
+}
+
+// Put stores the content of r and returns its description. Storing a document that is
+// already in the store keeps the existing copy.
+func (s *FileStore) Put(r io.Reader, mediaType string) (*Document, error) {
+	if mediaType == "" {
+		return nil, fmt.Errorf("media type is required")
+	}
+
+	tmp, err := os.CreateTemp(s.root, "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash, size, err := Hash(io.TeeReader(r, tmp))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write document: %v", err)
+	}
+
+	doc := &Document{SHA256: hash, MediaType: mediaType, Size: size}
+	if existing, err := s.Stat(hash); err == nil {
+		return existing, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path(hash)), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create document directory: %v", err)
+	}
+	metaJSON, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal document metadata: %v", err)
+	}
+	// The metadata marks a document as stored, so it is written only once the
+	// content is in place
+	if err := os.Rename(tmp.Name(), s.path(hash)); err != nil {
+		os.Remove(s.path(hash) + ".json")
+		return nil, fmt.Errorf("failed to store document: %v", err)
+	}
+	if err := os.WriteFile(s.path(hash)+".json", metaJSON, 0o600); err != nil {
+		os.Remove(s.path(hash) + ".json")
+		return nil, fmt.Errorf("failed to write document metadata: %v", err)
+	}
+	return doc, nil
+}
+
+// Stat returns the description of a stored document
+func (s *FileStore) Stat(hash string) (*Document, error) {
+	if !hashPattern.MatchString(hash) {
+		return nil, ErrInvalidHash
+	}
+	metaJSON, err := os.ReadFile(s.path(hash) + ".json")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read document metadata: %v", err)
+	}
+
+	var doc Document
+	if err := json.Unmarshal(metaJSON, &doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal document metadata: %v", err)
+	}
+	return &doc, nil
+}
+
+// Open returns the content of a stored document. The caller closes it.
+func (s *FileStore) Open(hash string) (io.ReadCloser, *Document, error) {
+	doc, err := s.Stat(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(s.path(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open document: %v", err)
+	}
+	return f, doc, nil
+}
+
+// Verify re-hashes a stored document and reports ErrCorrupted if its content changed
+func (s *FileStore) Verify(hash string) error {
+	f, doc, err := s.Open(hash)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	actual, size, err := Hash(f)
+	if err != nil {
+		return fmt.Errorf("failed to read document: %v", err)
+	}
+	if actual != hash || size != doc.Size {
+		return ErrCorrupted
+	}
+	return nil
+}
+
+// Delete removes a document from the store. Its anchor on the ledger is kept.
+func (s *FileStore) Delete(hash string) error {
+	if !hashPattern.MatchString(hash) {
+		return ErrInvalidHash
+	}
+	err := os.Remove(s.path(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete document: %v", err)
+	}
+	if err := os.Remove(s.path(hash) + ".json"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete document metadata: %v", err)
+	}
+	return nil
+}
+
+// path returns the file of a document
+func (s *FileStore) path(hash string) string {
+	return filepath.Join(s.root, hash[:2], hash)
+}
@@ -0,0 +1,77 @@
+package docstore
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutOpenVerify(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+
+	content := "Hemoglobin 13.5 g/dL"
+	doc, err := store.Put(strings.NewReader(content), "text/plain")
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain", doc.MediaType)
+	assert.Equal(t, int64(len(content)), doc.Size)
+
+	hash, size, err := Hash(strings.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, hash, doc.SHA256)
+	assert.Equal(t, doc.Size, size)
+
+	// Storing the same content again keeps the first copy
+	again, err := store.Put(strings.NewReader(content), "application/octet-stream")
+	require.NoError(t, err)
+	assert.Equal(t, doc, again)
+
+	f, stored, err := store.Open(doc.SHA256)
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, string(data))
+	assert.Equal(t, doc, stored)
+	assert.NoError(t, store.Verify(doc.SHA256))
+
+	_, err = store.Stat("not-a-hash")
+	assert.ErrorIs(t, err, ErrInvalidHash)
+	_, err = store.Stat(strings.Repeat("0", 64))
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+
+	doc, err := store.Put(strings.NewReader("Discharge summary"), "text/plain")
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(store.path(doc.SHA256), []byte("Discharge summary, edited"), 0o600))
+	assert.ErrorIs(t, store.Verify(doc.SHA256), ErrCorrupted)
+
+	require.NoError(t, store.Delete(doc.SHA256))
+	assert.ErrorIs(t, store.Verify(doc.SHA256), ErrNotFound)
+	assert.ErrorIs(t, store.Delete(doc.SHA256), ErrNotFound)
+}
+
+func TestPutFailureLeavesNoMetadata(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+
+	// A non-empty directory in the content's place makes the rename fail
+	content := "Radiology report"
+	hash, _, err := Hash(strings.NewReader(content))
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(store.path(hash)+"/blocker", 0o700))
+
+	_, err = store.Put(strings.NewReader(content), "text/plain")
+	assert.ErrorContains(t, err, "failed to store document")
+	_, err = store.Stat(hash)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
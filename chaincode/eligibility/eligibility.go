@@ -0,0 +1,160 @@
+// Package eligibility signs and verifies compact BPJS card eligibility tokens.
+//
+// A token is the base64url encoded JSON claims and the base64url encoded signature
+// joined by a dot, small enough for a QR code. The chaincode returns the claims of a
+// card and the BPJS client signs them with the organization's key, which never leaves
+// BPJS; front desks verify the tokens offline against the organization's certificate,
+// without a connection to a peer.
+package eligibility
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Verification errors
+var (
+	ErrMalformed        = errors.New("malformed eligibility token")
+	ErrInvalidSignature = errors.New("invalid eligibility token signature")
+	ErrWrongIssuer      = errors.New("eligibility token issuer does not match the certificate")
+	ErrNotYetValid      = errors.New("eligibility token is not yet valid")
+	ErrExpired          = errors.New("eligibility token has expired")
+	ErrNotEligible      = errors.New("card is not eligible")
+	ErrUnsupportedKey   = errors.New("unsupported key type")
+)
+
+// Claims is the content of an eligibility token. Times are Unix seconds.
+type Claims struct {
+	CardID     string `json:"cid"`
+	Status     string `json:"st"`
+	CareClass  string `json:"cls"`
+	ValidFrom  int64  `json:"nbf"`
+	ValidUntil int64  `json:"exp"`
+	Issuer     string `json:"iss"` // MSP ID of the issuing organization
+	IssuedAt   int64  `json:"iat"`
+}
+
+// Sign encodes the claims and signs them with key, an ECDSA or Ed25519 private key
+func Sign(claims *Claims, key crypto.Signer) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal claims: %v", err)
+	}
+
+	var signature []byte
+	switch key.Public().(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(payload)
+		signature, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case ed25519.PublicKey:
+		signature, err = key.Sign(rand.Reader, payload, crypto.Hash(0))
+	default:
+		return "", ErrUnsupportedKey
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to sign claims: %v", err)
+	}
+
+	return encode(payload) + "." + encode(signature), nil
+}
+
+// Verify checks the token's signature against the issuing organization's certificate,
+// that the token names mspID, the organization the certificate belongs to, as its issuer
+// and that the card is active at the given time, and returns the token claims
+func Verify(token string, cert *x509.Certificate, mspID string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrMalformed
+	}
+	payload, err := decode(parts[0])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	signature, err := decode(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	switch publicKey := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(payload)
+		if !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+			return nil, ErrInvalidSignature
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(publicKey, payload, signature) {
+			return nil, ErrInvalidSignature
+		}
+	default:
+		return nil, ErrUnsupportedKey
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrMalformed
+	}
+
+	if claims.Issuer != mspID {
+		return nil, fmt.Errorf("%w: token issued by %q, certificate of %q", ErrWrongIssuer, claims.Issuer, mspID)
+	}
+	if now.Unix() < claims.ValidFrom {
+		return nil, ErrNotYetValid
+	}
+	if now.Unix() >= claims.ValidUntil {
+		return nil, ErrExpired
+	}
+	if claims.Status != "active" {
+		return nil, fmt.Errorf("%w: card %s status is %s", ErrNotEligible, claims.CardID, claims.Status)
+	}
+
+	return &claims, nil
+}
+
+// ParseCertificatePEM parses a PEM encoded X.509 certificate
+func ParseCertificatePEM(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// ParsePrivateKeyPEM parses a PEM encoded PKCS#8 or SEC 1 EC private key, as found in a Fabric MSP keystore
+func ParsePrivateKeyPEM(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found")
+	}
+
+	if block.Type == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+	return signer, nil
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decode(data string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(data)
+}
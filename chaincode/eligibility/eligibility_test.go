@@ -0,0 +1,90 @@
+package eligibility
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCertificate returns a self-signed certificate and its PEM encoded PKCS#8 key
+func newTestCertificate(t *testing.T) (*x509.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Admin@bpjs.bpjs-network.com"},
+		NotBefore:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2034, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := ParseCertificatePEM(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}))
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestSignAndVerify(t *testing.T) {
+	cert, keyPEM := newTestCertificate(t)
+	otherCert, _ := newTestCertificate(t)
+
+	key, err := ParsePrivateKeyPEM(keyPEM)
+	require.NoError(t, err)
+
+	issuedAt := time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)
+	claims := &Claims{
+		CardID:     "CARD001",
+		Status:     "active",
+		CareClass:  "2",
+		ValidFrom:  issuedAt.Unix(),
+		ValidUntil: issuedAt.Add(time.Hour).Unix(),
+		Issuer:     "BPJSMSP",
+		IssuedAt:   issuedAt.Unix(),
+	}
+	token, err := Sign(claims, key)
+	require.NoError(t, err)
+
+	verified, err := Verify(token, cert, "BPJSMSP", issuedAt.Add(30*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, claims, verified)
+
+	_, err = Verify(token, otherCert, "BPJSMSP", issuedAt.Add(30*time.Minute))
+	assert.True(t, errors.Is(err, ErrInvalidSignature), "Token must be signed by the certificate's key")
+	_, err = Verify(token, cert, "BPJSMSP", issuedAt.Add(time.Hour))
+	assert.True(t, errors.Is(err, ErrExpired))
+	_, err = Verify(token, cert, "BPJSMSP", issuedAt.Add(-time.Minute))
+	assert.True(t, errors.Is(err, ErrNotYetValid))
+	_, err = Verify(token, cert, "RumahSakitMSP", issuedAt.Add(30*time.Minute))
+	assert.True(t, errors.Is(err, ErrWrongIssuer), "Token must name the certificate's organization as issuer")
+	_, err = Verify("not-a-token", cert, "BPJSMSP", issuedAt)
+	assert.True(t, errors.Is(err, ErrMalformed))
+
+	// Changing the claims breaks the signature
+	tampered := *claims
+	tampered.CareClass = "1"
+	tamperedToken, err := Sign(&tampered, key)
+	require.NoError(t, err)
+	forged := strings.Split(tamperedToken, ".")[0] + "." + strings.Split(token, ".")[1]
+	_, err = Verify(forged, cert, "BPJSMSP", issuedAt.Add(30*time.Minute))
+	assert.True(t, errors.Is(err, ErrInvalidSignature))
+
+	claims.Status = "suspended"
+	suspendedToken, err := Sign(claims, key)
+	require.NoError(t, err)
+	_, err = Verify(suspendedToken, cert, "BPJSMSP", issuedAt.Add(30*time.Minute))
+	assert.True(t, errors.Is(err, ErrNotEligible))
+}
@@ -8,11 +8,11 @@ function CardTest({ addLog }) {
     cardID: 'CARD' + Date.now(),
     patientID: 'P' + Date.now(),
     patientName: 'John Doe',
-    nik: '1234567890123456',
+    nik: '3171010101900001',
     dateOfBirth: '1990-01-01',
     gender: 'Male',
     address: 'Jakarta, Indonesia',
-    cardType: 'PBI',
+    cardType: 'PBPU',
     issueDate: new Date().toISOString().split('T')[0],
     expiryDate: new Date(Date.now() + 365*24*60*60*1000).toISOString().split('T')[0]
   })
@@ -65,15 +65,18 @@ function CardTest({ addLog }) {
 
   const generateSampleData = () => {
     const timestamp = Date.now()
+    const gender = Math.random() > 0.5 ? 'Male' : 'Female'
+    // NIK embeds the birth date as DDMMYY, with 40 added to the day for women
+    const birthDay = gender === 'Female' ? '41' : '01'
     setFormData({
       cardID: 'CARD' + timestamp,
       patientID: 'P' + timestamp,
       patientName: 'Sample Patient ' + Math.floor(Math.random() * 1000),
-      nik: '32' + String(Math.floor(Math.random() * 1000000000000000)).padStart(14, '0'),
+      nik: '327301' + birthDay + '0190' + String(Math.floor(Math.random() * 10000)).padStart(4, '0'),
       dateOfBirth: '1990-01-01',
-      gender: Math.random() > 0.5 ? 'Male' : 'Female',
+      gender,
       address: ['Jakarta', 'Surabaya', 'Bandung', 'Medan'][Math.floor(Math.random() * 4)] + ', Indonesia',
-      cardType: Math.random() > 0.5 ? 'PBI' : 'Non-PBI',
+      cardType: ['PPU', 'PBPU', 'BP'][Math.floor(Math.random() * 3)],
       issueDate: new Date().toISOString().split('T')[0],
       expiryDate: new Date(Date.now() + 365*24*60*60*1000).toISOString().split('T')[0]
     })
@@ -126,7 +129,7 @@ function CardTest({ addLog }) {
             name="nik"
             value={formData.nik}
             onChange={handleInputChange}
-            placeholder="1234567890123456"
+            placeholder="3171010101900001"
             className="w-full px-3 py-2 border border-gray-300 rounded-md focus:outline-none focus:ring-2 focus:ring-bpjs-primary focus:border-transparent"
           />
         </div>
@@ -175,8 +178,11 @@ function CardTest({ addLog }) {
             onChange={handleInputChange}
             className="w-full px-3 py-2 border border-gray-300 rounded-md focus:outline-none focus:ring-2 focus:ring-bpjs-primary focus:border-transparent"
           >
-            <option value="PBI">PBI (Penerima Bantuan Iuran)</option>
-            <option value="Non-PBI">Non-PBI</option>
+            <option value="PBI-APBN">PBI-APBN (Penerima Bantuan Iuran - APBN)</option>
+            <option value="PBI-APBD">PBI-APBD (Penerima Bantuan Iuran - APBD)</option>
+            <option value="PPU">PPU (Pekerja Penerima Upah)</option>
+            <option value="PBPU">PBPU (Pekerja Bukan Penerima Upah)</option>
+            <option value="BP">BP (Bukan Pekerja)</option>
           </select>
         </div>
 
@@ -10,7 +10,7 @@ function ChaincodeTest({ addLog }) {
     'IssueCard': {
       description: 'Issue a new BPJS card',
       args: ['cardID', 'patientID', 'patientName', 'nik', 'dateOfBirth', 'gender', 'address', 'cardType', 'issueDate', 'expiryDate'],
-      example: '["CARD001", "P001", "John Doe", "1234567890123456", "1990-01-01", "Male", "Jakarta", "PBI", "2024-01-01", "2025-01-01"]'
+      example: '["CARD001", "P001", "John Doe", "3171010101900001", "1990-01-01", "Male", "Jakarta", "PBPU", "2024-01-01", "2025-01-01"]'
     },
     'VerifyCard': {
       description: 'Verify a BPJS card',
@@ -19,33 +19,83 @@ function ChaincodeTest({ addLog }) {
     },
     'UpdateCardStatus': {
       description: 'Update card status',
-      args: ['cardID', 'newStatus', 'reason'],
-      example: '["CARD001", "suspended", "Payment overdue"]'
+      args: ['cardID', 'newStatus', 'reasonCode', 'reason'],
+      example: '["CARD001", "suspended", "CONTRIBUTION_ARREARS", "Payment overdue"]'
+    },
+    'RegisterFaskes': {
+      description: 'Register a health facility (BPJS only)',
+      args: ['faskesCode', 'name', 'faskesType', 'hospitalClass', 'regionCode', 'ownerMSP', 'contractStart', 'contractEnd'],
+      example: '["RS001", "RS Siloam", "FKRTL", "B", "3171", "RumahSakitMSP", "2024-01-01", "2025-12-31"]'
+    },
+    'RenewFaskesContract': {
+      description: 'Renew the contract period of a facility (BPJS only)',
+      args: ['faskesCode', 'contractStart', 'contractEnd'],
+      example: '["RS001", "2026-01-01", "2027-12-31"]'
+    },
+    'GetFaskes': {
+      description: 'Get a registered facility',
+      args: ['faskesCode'],
+      example: '["RS001"]'
+    },
+    'RegisterPractitioner': {
+      description: 'Register a practitioner (BPJS only)',
+      args: ['practitionerID', 'name', 'specialty', 'strNumber', 'strValidUntil'],
+      example: '["DOC001", "Dr. Smith", "Umum", "STR-DOC001", ""]'
+    },
+    'GrantPracticeLicense': {
+      description: 'Record a practice license (SIP) at a facility (BPJS only)',
+      args: ['practitionerID', 'sipNumber', 'faskesCode', 'validFrom', 'validUntil'],
+      example: '["DOC001", "SIP-DOC001-RS001", "RS001", "2024-01-01", "2028-12-31"]'
+    },
+    'GetPractitionerActivity': {
+      description: 'Get visits and referrals of a practitioner across facilities',
+      args: ['practitionerID'],
+      example: '["DOC001"]'
     },
     'RecordVisit': {
       description: 'Record a patient visit',
-      args: ['visitID', 'cardID', 'patientID', 'patientName', 'faskesCode', 'faskesName', 'faskesType', 'visitDate', 'visitType', 'diagnosis', 'treatment', 'doctorName', 'doctorID', 'notes'],
-      example: '["VISIT001", "CARD001", "P001", "John Doe", "RS001", "RS Siloam", "rumahsakit", "2024-01-01", "outpatient", "Flu", "Medicine", "Dr. Smith", "DOC001", "Notes"]'
+      args: ['visitID', 'cardID', 'patientID', 'patientName', 'faskesCode', 'visitDate', 'visitType', 'diagnosis', 'treatment', 'doctorID', 'notes', 'primaryDiagnosisCode', 'secondaryDiagnosisCodes', 'procedures', 'referralID'],
+      example: '["VISIT001", "CARD001", "P001", "John Doe", "RS001", "2024-01-01", "outpatient", "Flu", "Medicine", "DOC001", "Notes", "J11.1", "", "", "REF001"]'
+    },
+    'AddVisitAddendum': {
+      description: 'Append a correction or clarification to a visit',
+      args: ['visitID', 'reason', 'changesJSON'],
+      example: '["VISIT001", "Lab result", "{\\"diagnosis\\":\\"Typhoid fever\\",\\"primaryDiagnosisCode\\":\\"A01.0\\"}"]'
     },
     'GetPatientVisits': {
       description: 'Get all visits for a patient',
+      args: ['patientID', 'showOriginal'],
+      example: '["P001", "false"]'
+    },
+    'CreatePrescription': {
+      description: 'Record the drugs prescribed during a visit',
+      args: ['prescriptionID', 'visitID', 'prescriberID', 'itemsJSON'],
+      example: '["RX001", "VISIT001", "DOC001", "[{\\"drugCode\\":\\"MET500\\",\\"drugName\\":\\"Metformin\\",\\"dose\\":\\"500 mg 2x1\\",\\"quantity\\":60,\\"daysSupply\\":30}]"]'
+    },
+    'DispenseMedication': {
+      description: 'Record medication handed over by a pharmacy',
+      args: ['prescriptionID', 'pharmacyCode', 'dispenseDate', 'itemsJSON'],
+      example: '["RX001", "APT001", "2024-01-01", "[{\\"drugCode\\":\\"MET500\\",\\"quantity\\":30}]"]'
+    },
+    'GetPatientPrescriptions': {
+      description: 'Get all prescriptions for a patient',
       args: ['patientID'],
       example: '["P001"]'
     },
     'CreateReferral': {
       description: 'Create a referral',
-      args: ['referralID', 'patientID', 'patientName', 'cardID', 'fromFaskesCode', 'fromFaskesName', 'toFaskesCode', 'toFaskesName', 'referralReason', 'diagnosis', 'referringDoctor', 'referralDate', 'validUntil', 'notes'],
-      example: '["REF001", "P001", "John Doe", "CARD001", "PKM001", "Puskesmas", "RS001", "RS Siloam", "Specialist needed", "Complex case", "Dr. Lee", "2024-01-01", "2024-01-31", "Urgent"]'
+      args: ['referralID', 'patientID', 'patientName', 'cardID', 'fromFaskesCode', 'toFaskesCode', 'referralReason', 'diagnosis', 'referringDoctor', 'referralDate', 'validUntil', 'notes'],
+      example: '["REF001", "P001", "John Doe", "CARD001", "PKM001", "RS001", "Specialist needed", "Complex case", "DOC002", "2024-01-01", "2024-01-31", "Urgent"]'
     },
     'UpdateReferralStatus': {
       description: 'Update referral status',
-      args: ['referralID', 'newStatus', 'acceptedBy', 'notes'],
-      example: '["REF001", "accepted", "Dr. Wong", "Patient scheduled"]'
+      args: ['referralID', 'newStatus', 'notes'],
+      example: '["REF001", "accepted", "Patient scheduled"]'
     },
     'SubmitClaim': {
       description: 'Submit an insurance claim',
-      args: ['claimID', 'patientID', 'patientName', 'cardID', 'visitID', 'faskesCode', 'faskesName', 'claimType', 'serviceDate', 'diagnosis', 'treatment', 'totalAmount', 'claimAmount'],
-      example: '["CLAIM001", "P001", "John Doe", "CARD001", "VISIT001", "RS001", "RS Siloam", "rawat-jalan", "2024-01-01", "Flu", "Consultation", "500000", "450000"]'
+      args: ['claimID', 'patientID', 'patientName', 'cardID', 'visitID', 'faskesCode', 'claimType', 'serviceDate', 'diagnosis', 'treatment', 'totalAmount', 'claimAmount', 'roomClass', 'primaryDiagnosisCode', 'secondaryDiagnosisCodes'],
+      example: '["CLAIM001", "P001", "John Doe", "CARD001", "VISIT001", "RS001", "rawat-jalan", "2024-01-01", "Flu", "Consultation", "500000", "450000", "", "J11.1", ""]'
     },
     'ProcessClaim': {
       description: 'Process a claim (approve/reject)',
@@ -57,6 +107,21 @@ function ChaincodeTest({ addLog }) {
       args: ['patientID'],
       example: '["P001"]'
     },
+    'GetClaimsByProcedure': {
+      description: 'Get all claims billing an ICD-9-CM procedure',
+      args: ['procedureCode'],
+      example: '["89.52"]'
+    },
+    'AnchorDocument': {
+      description: 'Anchor the SHA-256 hash of an off-chain document',
+      args: ['documentID', 'sha256Hash', 'mediaType', 'size', 'visitID', 'claimID'],
+      example: '["DOC-LAB-001", "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", "application/pdf", "48213", "VISIT001", ""]'
+    },
+    'VerifyDocument': {
+      description: 'Check a document hash against its anchor',
+      args: ['documentID', 'sha256Hash'],
+      example: '["DOC-LAB-001", "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"]'
+    },
     'QueryAuditLogs': {
       description: 'Query audit logs',
       args: ['startKey', 'endKey'],
@@ -15,6 +15,7 @@ function ClaimTest({ addLog }) {
     claimType: 'rawat-jalan',
     serviceDate: new Date().toISOString().split('T')[0],
     diagnosis: 'Common Cold',
+    primaryDiagnosisCode: 'J00',
     treatment: 'Consultation + Medicine',
     totalAmount: 500000,
     claimAmount: 450000
@@ -131,6 +132,13 @@ function ClaimTest({ addLog }) {
     const claimTypes = ['rawat-jalan', 'rawat-inap', 'emergency']
     const amounts = [150000, 300000, 500000, 750000, 1000000, 2000000]
     const selectedAmount = amounts[Math.floor(Math.random() * amounts.length)]
+    const diagnoses = [
+      { diagnosis: 'Flu', code: 'J11.1' },
+      { diagnosis: 'Diabetes', code: 'E11.9' },
+      { diagnosis: 'Hypertension', code: 'I10' },
+      { diagnosis: 'Checkup', code: 'Z00.0' }
+    ]
+    const selectedDiagnosis = diagnoses[Math.floor(Math.random() * diagnoses.length)]
     
     setFormData({
       claimID: 'CLAIM' + timestamp,
@@ -142,7 +150,8 @@ function ClaimTest({ addLog }) {
       faskesName: ['RS Siloam', 'RS Cipto', 'RS Harapan Kita', 'Puskesmas Menteng'][Math.floor(Math.random() * 4)],
       claimType: claimTypes[Math.floor(Math.random() * claimTypes.length)],
       serviceDate: new Date().toISOString().split('T')[0],
-      diagnosis: ['Flu', 'Diabetes', 'Hypertension', 'Checkup'][Math.floor(Math.random() * 4)],
+      diagnosis: selectedDiagnosis.diagnosis,
+      primaryDiagnosisCode: selectedDiagnosis.code,
       treatment: 'Medical consultation and prescribed medication',
       totalAmount: selectedAmount,
       claimAmount: Math.floor(selectedAmount * 0.9) // 90% coverage
@@ -266,6 +275,18 @@ function ClaimTest({ addLog }) {
           />
         </div>
 
+        <div>
+          <label className="block text-sm font-medium text-gray-700 mb-1">ICD-10 Code</label>
+          <input
+            type="text"
+            name="primaryDiagnosisCode"
+            value={formData.primaryDiagnosisCode}
+            onChange={handleInputChange}
+            placeholder="J00"
+            className="w-full px-3 py-2 border border-gray-300 rounded-md focus:outline-none focus:ring-2 focus:ring-bpjs-primary focus:border-transparent"
+          />
+        </div>
+
         <div className="md:col-span-2">
           <label className="block text-sm font-medium text-gray-700 mb-1">Treatment</label>
           <textarea
@@ -15,6 +15,7 @@ function VisitTest({ addLog }) {
     visitDate: new Date().toISOString().split('T')[0],
     visitType: 'outpatient',
     diagnosis: 'Common Cold',
+    primaryDiagnosisCode: 'J00',
     treatment: 'Paracetamol, Rest',
     doctorName: 'Dr. Smith',
     doctorID: 'DOC001',
@@ -64,7 +65,15 @@ function VisitTest({ addLog }) {
 
   const generateSampleData = () => {
     const timestamp = Date.now()
-    const diagnoses = ['Common Cold', 'Flu', 'Fever', 'Headache', 'Checkup', 'Diabetes Control']
+    const diagnoses = [
+      { diagnosis: 'Common Cold', code: 'J00' },
+      { diagnosis: 'Flu', code: 'J11.1' },
+      { diagnosis: 'Fever', code: 'R50.9' },
+      { diagnosis: 'Headache', code: 'R51' },
+      { diagnosis: 'Checkup', code: 'Z00.0' },
+      { diagnosis: 'Diabetes Control', code: 'E11.9' }
+    ]
+    const selectedDiagnosis = diagnoses[Math.floor(Math.random() * diagnoses.length)]
     const faskes = [
       { code: 'RS001', name: 'RS Siloam', type: 'rumahsakit' },
       { code: 'RS002', name: 'RS Cipto', type: 'rumahsakit' },
@@ -82,7 +91,8 @@ function VisitTest({ addLog }) {
       faskesType: selectedFaskes.type,
       visitDate: new Date().toISOString().split('T')[0],
       visitType: ['outpatient', 'inpatient', 'emergency'][Math.floor(Math.random() * 3)],
-      diagnosis: diagnoses[Math.floor(Math.random() * diagnoses.length)],
+      diagnosis: selectedDiagnosis.diagnosis,
+      primaryDiagnosisCode: selectedDiagnosis.code,
       treatment: 'Medication and rest prescribed',
       doctorName: 'Dr. ' + ['Smith', 'Johnson', 'Lee', 'Wong', 'Kumar'][Math.floor(Math.random() * 5)],
       doctorID: 'DOC' + Math.floor(Math.random() * 100),
@@ -209,6 +219,18 @@ function VisitTest({ addLog }) {
           />
         </div>
 
+        <div>
+          <label className="block text-sm font-medium text-gray-700 mb-1">ICD-10 Code</label>
+          <input
+            type="text"
+            name="primaryDiagnosisCode"
+            value={formData.primaryDiagnosisCode}
+            onChange={handleInputChange}
+            placeholder="J00"
+            className="w-full px-3 py-2 border border-gray-300 rounded-md focus:outline-none focus:ring-2 focus:ring-bpjs-primary focus:border-transparent"
+          />
+        </div>
+
         <div className="md:col-span-2">
           <label className="block text-sm font-medium text-gray-700 mb-1">Treatment</label>
           <textarea
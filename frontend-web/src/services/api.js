@@ -93,10 +93,10 @@ class ApiService {
     });
   }
 
-  async updateReferralStatus(referralID, status, acceptedBy, notes) {
+  async updateReferralStatus(referralID, status, notes) {
     return this.request(`/referrals/${referralID}/status`, {
       method: 'PUT',
-      body: JSON.stringify({ status, acceptedBy, notes }),
+      body: JSON.stringify({ status, notes }),
     });
   }
 
@@ -191,7 +191,7 @@ echo "  -e CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric
 echo "  ${CLI} peer chaincode invoke \\"
 echo "  -o ${ORDERER}:7050 \\"
 echo "  -C ${CHANNEL_NAME} -n ${CHAINCODE_NAME} \\"
-echo "  -c '{\"Args\":[\"IssueCard\",\"CARD001\",\"P001\",\"Budi Santoso\",\"1234567890123456\",\"1990-01-01\",\"Male\",\"Jakarta\",\"PBI\",\"2024-01-01\",\"2025-01-01\"]}'"
+echo "  -c '{\"Args\":[\"IssueCard\",\"CARD001\",\"P001\",\"Budi Santoso\",\"3171010101900001\",\"1990-01-01\",\"Male\",\"Jakarta\",\"PBPU\",\"2024-01-01\",\"2025-01-01\"]}'"
 echo ""
 echo "# Verify card from different peer:"
 echo "docker exec -e CORE_PEER_LOCALMSPID=RumahSakitMSP \\"
@@ -156,5 +156,5 @@ echo ""
 print_success "Chaincode deployment completed!"
 echo ""
 echo "Test the chaincode:"
-echo "  docker exec cli peer chaincode invoke -o orderer1.bpjs-network.com:7050 --tls --cafile /opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ordererOrganizations/bpjs-network.com/orderers/orderer1.bpjs-network.com/msp/tlscacerts/tlsca.bpjs-network.com-cert.pem -C bpjs-main -n bpjs --peerAddresses peer0.bpjs.bpjs-network.com:7051 --tlsRootCertFiles /opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/bpjs.bpjs-network.com/peers/peer0.bpjs.bpjs-network.com/tls/ca.crt -c '{\"function\":\"IssueCard\",\"Args\":[\"CARD001\",\"P001\",\"John Doe\",\"1234567890\",\"1990-01-01\",\"Male\",\"Jakarta\",\"PBI\",\"2024-01-01\",\"2025-01-01\"]}'"
+echo "  docker exec cli peer chaincode invoke -o orderer1.bpjs-network.com:7050 --tls --cafile /opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ordererOrganizations/bpjs-network.com/orderers/orderer1.bpjs-network.com/msp/tlscacerts/tlsca.bpjs-network.com-cert.pem -C bpjs-main -n bpjs --peerAddresses peer0.bpjs.bpjs-network.com:7051 --tlsRootCertFiles /opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/bpjs.bpjs-network.com/peers/peer0.bpjs.bpjs-network.com/tls/ca.crt -c '{\"function\":\"IssueCard\",\"Args\":[\"CARD001\",\"P001\",\"John Doe\",\"1234567890\",\"1990-01-01\",\"Male\",\"Jakarta\",\"PBPU\",\"2024-01-01\",\"2025-01-01\"]}'"
 echo ""
@@ -1,5 +1,5 @@
 #!/usr/bin/env bash
-# full-workflow-test.sh - Test the complete workflow: Issue Card → Record Visit → Submit Claim
+# full-workflow-test.sh - Test the complete workflow: Issue Card → Referral → Record Visit → Submit Claim
 
 echo "=========================================="
 echo "BPJS FULL WORKFLOW TEST"
@@ -10,23 +10,90 @@ echo ""
 TIMESTAMP=$(date +%s)
 CARD_ID="CARD${TIMESTAMP}"
 PATIENT_ID="P${TIMESTAMP}"
+REFERRAL_ID="REF${TIMESTAMP}"
 VISIT_ID="VISIT${TIMESTAMP}"
 CLAIM_ID="CLAIM${TIMESTAMP}"
 
 echo "Test IDs:"
 echo "  Card ID: ${CARD_ID}"
 echo "  Patient ID: ${PATIENT_ID}"
+echo "  Referral ID: ${REFERRAL_ID}"
 echo "  Visit ID: ${VISIT_ID}"
 echo "  Claim ID: ${CLAIM_ID}"
 echo ""
 
+# Setup: ICD-10 reference codes used by visits and claims (fails harmlessly if already active)
+echo "Setup: Loading ICD-10 reference codes..."
+echo "-------------------------------------------"
+docker exec cli peer chaincode invoke \
+  -o orderer1.bpjs-network.com:7050 \
+  -C bpjschannel -n bpjs \
+  -c '{"Args":["LoadICD10Codes","2019","[{\"code\":\"J11.1\",\"description\":\"Influenza with other respiratory manifestations, virus not identified\"},{\"code\":\"I10\",\"description\":\"Essential (primary) hypertension\"},{\"code\":\"E11.9\",\"description\":\"Type 2 diabetes mellitus without complications\"}]"]}' \
+  --peerAddresses bpjs-blockchain-fabric-peer0.bpjs.bpjs-network.com-1:7051 \
+  --peerAddresses bpjs-blockchain-fabric-peer0.rumahsakit.bpjs-network.com-1:9051 \
+  --waitForEvent \
+  && docker exec cli peer chaincode invoke \
+  -o orderer1.bpjs-network.com:7050 \
+  -C bpjschannel -n bpjs \
+  -c '{"Args":["ActivateICD10Version","2019"]}' \
+  --peerAddresses bpjs-blockchain-fabric-peer0.bpjs.bpjs-network.com-1:7051 \
+  --peerAddresses bpjs-blockchain-fabric-peer0.rumahsakit.bpjs-network.com-1:9051 \
+  --waitForEvent \
+  || echo "ICD-10 version 2019 already active"
+echo ""
+sleep 2
+
+# Setup: facilities and doctor used by the referral, visit and claim (fails harmlessly if already registered)
+echo "Setup: Registering faskes RS001, PKM001 and practitioner DOC001..."
+echo "-------------------------------------------"
+docker exec cli peer chaincode invoke \
+  -o orderer1.bpjs-network.com:7050 \
+  -C bpjschannel -n bpjs \
+  -c '{"Args":["RegisterFaskes","RS001","RS Siloam","FKRTL","B","3171","RumahSakitMSP","2024-01-01","2030-12-31"]}' \
+  --peerAddresses bpjs-blockchain-fabric-peer0.bpjs.bpjs-network.com-1:7051 \
+  --peerAddresses bpjs-blockchain-fabric-peer0.rumahsakit.bpjs-network.com-1:9051 \
+  --waitForEvent \
+  || echo "Faskes RS001 already registered"
+docker exec cli peer chaincode invoke \
+  -o orderer1.bpjs-network.com:7050 \
+  -C bpjschannel -n bpjs \
+  -c '{"Args":["RegisterFaskes","PKM001","Puskesmas Kelapa Gading","FKTP","","3172","PuskesmasMSP","2024-01-01","2030-12-31"]}' \
+  --peerAddresses bpjs-blockchain-fabric-peer0.bpjs.bpjs-network.com-1:7051 \
+  --peerAddresses bpjs-blockchain-fabric-peer0.rumahsakit.bpjs-network.com-1:9051 \
+  --waitForEvent \
+  || echo "Faskes PKM001 already registered"
+docker exec cli peer chaincode invoke \
+  -o orderer1.bpjs-network.com:7050 \
+  -C bpjschannel -n bpjs \
+  -c '{"Args":["RegisterPractitioner","DOC001","Dr. Smith","Umum","STR-DOC001",""]}' \
+  --peerAddresses bpjs-blockchain-fabric-peer0.bpjs.bpjs-network.com-1:7051 \
+  --peerAddresses bpjs-blockchain-fabric-peer0.rumahsakit.bpjs-network.com-1:9051 \
+  --waitForEvent \
+  && docker exec cli peer chaincode invoke \
+  -o orderer1.bpjs-network.com:7050 \
+  -C bpjschannel -n bpjs \
+  -c '{"Args":["GrantPracticeLicense","DOC001","SIP-DOC001-RS001","RS001","2024-01-01","2030-12-31"]}' \
+  --peerAddresses bpjs-blockchain-fabric-peer0.bpjs.bpjs-network.com-1:7051 \
+  --peerAddresses bpjs-blockchain-fabric-peer0.rumahsakit.bpjs-network.com-1:9051 \
+  --waitForEvent \
+  || echo "Practitioner DOC001 already registered"
+docker exec cli peer chaincode invoke \
+  -o orderer1.bpjs-network.com:7050 \
+  -C bpjschannel -n bpjs \
+  -c '{"Args":["GrantPracticeLicense","DOC001","SIP-DOC001-PKM001","PKM001","2024-01-01","2030-12-31"]}' \
+  --peerAddresses bpjs-blockchain-fabric-peer0.bpjs.bpjs-network.com-1:7051 \
+  --peerAddresses bpjs-blockchain-fabric-peer0.rumahsakit.bpjs-network.com-1:9051 \
+  --waitForEvent
+echo ""
+sleep 2
+
 # Step 1: Issue BPJS Card
 echo "Step 1: Issuing BPJS Card..."
 echo "-------------------------------------------"
 docker exec cli peer chaincode invoke \
   -o orderer1.bpjs-network.com:7050 \
   -C bpjschannel -n bpjs \
-  -c "{\"Args\":[\"IssueCard\",\"${CARD_ID}\",\"${PATIENT_ID}\",\"John Doe\",\"1234567890123456\",\"1990-01-01\",\"Male\",\"Jakarta\",\"PBI\",\"2024-01-01\",\"2025-12-31\"]}" \
+  -c "{\"Args\":[\"IssueCard\",\"${CARD_ID}\",\"${PATIENT_ID}\",\"John Doe\",\"3171010101900001\",\"1990-01-01\",\"Male\",\"Jakarta\",\"PBPU\",\"2024-01-01\",\"2025-12-31\"]}" \
   --peerAddresses bpjs-blockchain-fabric-peer0.bpjs.bpjs-network.com-1:7051 \
   --peerAddresses bpjs-blockchain-fabric-peer0.rumahsakit.bpjs-network.com-1:9051 \
   --waitForEvent
@@ -48,13 +115,36 @@ echo "✅ Card verified!"
 echo ""
 sleep 2
 
-# Step 3: Record Patient Visit
-echo "Step 3: Recording Patient Visit..."
+# Step 3: Refer the patient from primary care to the hospital
+echo "Step 3: Creating and Accepting Referral..."
+echo "-------------------------------------------"
+docker exec cli peer chaincode invoke \
+  -o orderer1.bpjs-network.com:7050 \
+  -C bpjschannel -n bpjs \
+  -c "{\"Args\":[\"CreateReferral\",\"${REFERRAL_ID}\",\"${PATIENT_ID}\",\"John Doe\",\"${CARD_ID}\",\"PKM001\",\"RS001\",\"Specialist consultation\",\"Flu\",\"DOC001\",\"$(date +%Y-%m-%d)\",\"$(date -d '+30 days' +%Y-%m-%d)\",\"\"]}" \
+  --peerAddresses bpjs-blockchain-fabric-peer0.bpjs.bpjs-network.com-1:7051 \
+  --peerAddresses bpjs-blockchain-fabric-peer0.rumahsakit.bpjs-network.com-1:9051 \
+  --waitForEvent
+
+docker exec cli peer chaincode invoke \
+  -o orderer1.bpjs-network.com:7050 \
+  -C bpjschannel -n bpjs \
+  -c "{\"Args\":[\"UpdateReferralStatus\",\"${REFERRAL_ID}\",\"accepted\",\"\"]}" \
+  --peerAddresses bpjs-blockchain-fabric-peer0.bpjs.bpjs-network.com-1:7051 \
+  --peerAddresses bpjs-blockchain-fabric-peer0.rumahsakit.bpjs-network.com-1:9051 \
+  --waitForEvent
+
+echo "✅ Referral accepted!"
+echo ""
+sleep 2
+
+# Step 4: Record Patient Visit
+echo "Step 4: Recording Patient Visit..."
 echo "-------------------------------------------"
 docker exec cli peer chaincode invoke \
   -o orderer1.bpjs-network.com:7050 \
   -C bpjschannel -n bpjs \
-  -c "{\"Args\":[\"RecordVisit\",\"${VISIT_ID}\",\"${CARD_ID}\",\"${PATIENT_ID}\",\"John Doe\",\"RS001\",\"RS Siloam\",\"rumahsakit\",\"$(date +%Y-%m-%d)\",\"outpatient\",\"Flu\",\"Paracetamol\",\"Dr. Smith\",\"DOC001\",\"Regular checkup\"]}" \
+  -c "{\"Args\":[\"RecordVisit\",\"${VISIT_ID}\",\"${CARD_ID}\",\"${PATIENT_ID}\",\"John Doe\",\"RS001\",\"$(date +%Y-%m-%d)\",\"outpatient\",\"Flu\",\"Paracetamol\",\"DOC001\",\"Regular checkup\",\"J11.1\",\"\",\"\",\"${REFERRAL_ID}\"]}" \
   --peerAddresses bpjs-blockchain-fabric-peer0.bpjs.bpjs-network.com-1:7051 \
   --peerAddresses bpjs-blockchain-fabric-peer0.rumahsakit.bpjs-network.com-1:9051 \
   --waitForEvent
@@ -63,12 +153,12 @@ echo "✅ Visit recorded!"
 echo ""
 sleep 2
 
-# Step 4: Query Patient Visits
-echo "Step 4: Querying Patient Visits..."
+# Step 5: Query Patient Visits
+echo "Step 5: Querying Patient Visits..."
 echo "-------------------------------------------"
 VISITS_DATA=$(docker exec cli peer chaincode query \
   -C bpjschannel -n bpjs \
-  -c "{\"Args\":[\"GetPatientVisits\",\"${PATIENT_ID}\"]}")
+  -c "{\"Args\":[\"GetPatientVisits\",\"${PATIENT_ID}\",\"false\"]}")
 
 echo "Patient Visits:"
 echo ${VISITS_DATA} | jq .
@@ -76,13 +166,13 @@ echo "✅ Visits retrieved!"
 echo ""
 sleep 2
 
-# Step 5: Submit Insurance Claim
-echo "Step 5: Submitting Insurance Claim..."
+# Step 6: Submit Insurance Claim
+echo "Step 6: Submitting Insurance Claim..."
 echo "-------------------------------------------"
 docker exec cli peer chaincode invoke \
   -o orderer1.bpjs-network.com:7050 \
   -C bpjschannel -n bpjs \
-  -c "{\"Args\":[\"SubmitClaim\",\"${CLAIM_ID}\",\"${PATIENT_ID}\",\"John Doe\",\"${CARD_ID}\",\"${VISIT_ID}\",\"RS001\",\"RS Siloam\",\"rawat-jalan\",\"$(date +%Y-%m-%d)\",\"Flu\",\"Consultation and medicine\",\"500000\",\"450000\"]}" \
+  -c "{\"Args\":[\"SubmitClaim\",\"${CLAIM_ID}\",\"${PATIENT_ID}\",\"John Doe\",\"${CARD_ID}\",\"${VISIT_ID}\",\"RS001\",\"rawat-jalan\",\"$(date +%Y-%m-%d)\",\"Flu\",\"Consultation and medicine\",\"500000\",\"450000\",\"\",\"J11.1\",\"\"]}" \
   --peerAddresses bpjs-blockchain-fabric-peer0.bpjs.bpjs-network.com-1:7051 \
   --peerAddresses bpjs-blockchain-fabric-peer0.rumahsakit.bpjs-network.com-1:9051 \
   --waitForEvent
@@ -91,8 +181,8 @@ echo "✅ Claim submitted!"
 echo ""
 sleep 2
 
-# Step 6: Process Claim (Approve)
-echo "Step 6: Processing Claim (Approving)..."
+# Step 7: Process Claim (Approve)
+echo "Step 7: Processing Claim (Approving)..."
 echo "-------------------------------------------"
 docker exec cli peer chaincode invoke \
   -o orderer1.bpjs-network.com:7050 \
@@ -106,8 +196,8 @@ echo "✅ Claim approved!"
 echo ""
 sleep 2
 
-# Step 7: Query Patient Claims
-echo "Step 7: Querying Patient Claims..."
+# Step 8: Query Patient Claims
+echo "Step 8: Querying Patient Claims..."
 echo "-------------------------------------------"
 CLAIMS_DATA=$(docker exec cli peer chaincode query \
   -C bpjschannel -n bpjs \
@@ -123,7 +213,7 @@ echo "=========================================="
 echo ""
 echo "Summary:"
 echo "  ✓ Card ${CARD_ID} issued for patient ${PATIENT_ID}"
-echo "  ✓ Visit ${VISIT_ID} recorded"
+echo "  ✓ Visit ${VISIT_ID} recorded on referral ${REFERRAL_ID}"
 echo "  ✓ Claim ${CLAIM_ID} submitted and approved"
 echo "  ✓ All data stored on blockchain!"
 echo ""
@@ -10,7 +10,7 @@ echo "1. Issuing BPJS Card..."
 docker exec cli peer chaincode invoke \
   -o orderer1.bpjs-network.com:7050 \
   -C bpjschannel -n bpjs \
-  -c '{"Args":["IssueCard","CARD999","P999","Test Patient","1111222233334444","1995-01-01","Male","Jakarta","PBI","2024-01-01","2025-12-31"]}' \
+  -c '{"Args":["IssueCard","CARD999","P999","Test Patient","3171010101950004","1995-01-01","Male","Jakarta","PBPU","2024-01-01","2025-12-31"]}' \
   --peerAddresses bpjs-blockchain-fabric-peer0.bpjs.bpjs-network.com-1:7051 \
   --peerAddresses bpjs-blockchain-fabric-peer0.rumahsakit.bpjs-network.com-1:9051 \
   --waitForEvent
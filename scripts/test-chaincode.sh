@@ -31,7 +31,7 @@ docker exec -e CORE_PEER_LOCALMSPID=BPJSMSP \
     ${CLI} peer chaincode invoke \
     -o ${ORDERER}:7050 \
     -C ${CHANNEL_NAME} -n ${CHAINCODE_NAME} \
-    -c '{"Args":["IssueCard","CARD001","P001","Budi Santoso","1234567890123456","1990-01-01","Male","Jakarta Selatan","PBI","2024-01-01","2025-01-01"]}' \
+    -c '{"Args":["IssueCard","CARD001","P001","Budi Santoso","3171010101900001","1990-01-01","Male","Jakarta Selatan","PBPU","2024-01-01","2025-01-01"]}' \
     --peerAddresses ${PEER_BPJS}:7051 \
     --peerAddresses ${PEER_RS}:9051 \
     --waitForEvent
@@ -55,16 +55,90 @@ echo -e "${GREEN}✓ Card verified from different peer - Peer communication work
 echo ""
 sleep 2
 
-# Test 3: Record visit from RS peer
-echo -e "${BLUE}Test 3: Record Patient Visit from Rumah Sakit Peer${NC}"
-echo "Recording visit VISIT001..."
+# Setup: load and activate the ICD-10 reference codes used by visits and claims
+echo -e "${BLUE}Setup: Load ICD-10 Reference Codes from BPJS Peer${NC}"
+for ARGS in '{"Args":["LoadICD10Codes","2019","[{\"code\":\"J11.1\",\"description\":\"Influenza with other respiratory manifestations, virus not identified\"},{\"code\":\"I10\",\"description\":\"Essential (primary) hypertension\"},{\"code\":\"E11.9\",\"description\":\"Type 2 diabetes mellitus without complications\"}]"]}' '{"Args":["ActivateICD10Version","2019"]}'; do
+    docker exec -e CORE_PEER_LOCALMSPID=BPJSMSP \
+        -e CORE_PEER_ADDRESS=${PEER_BPJS}:7051 \
+        -e CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/bpjs.bpjs-network.com/users/Admin@bpjs.bpjs-network.com/msp \
+        ${CLI} peer chaincode invoke \
+        -o ${ORDERER}:7050 \
+        -C ${CHANNEL_NAME} -n ${CHAINCODE_NAME} \
+        -c "${ARGS}" \
+        --peerAddresses ${PEER_BPJS}:7051 \
+        --peerAddresses ${PEER_RS}:9051 \
+        --waitForEvent
+done
+
+echo -e "${GREEN}✓ ICD-10 version 2019 active${NC}"
+echo ""
+sleep 2
+
+# Setup: register the facilities and practitioners used by visits, claims and referrals
+echo -e "${BLUE}Setup: Register Faskes and Practitioners from BPJS Peer${NC}"
+for ARGS in '{"Args":["RegisterFaskes","RS001","RS Siloam Jakarta","FKRTL","B","3171","RumahSakitMSP","2024-01-01","2030-12-31"]}' '{"Args":["RegisterFaskes","PKM001","Puskesmas Kelapa Gading","FKTP","","3172","PuskesmasMSP","2024-01-01","2030-12-31"]}' '{"Args":["RegisterPractitioner","DOC001","Dr. Ahmad","Penyakit Dalam","STR-DOC001",""]}' '{"Args":["GrantPracticeLicense","DOC001","SIP-DOC001-RS001","RS001","2024-01-01","2028-12-31"]}' '{"Args":["RegisterPractitioner","DOC002","Dr. Siti","Umum","STR-DOC002",""]}' '{"Args":["GrantPracticeLicense","DOC002","SIP-DOC002-PKM001","PKM001","2024-01-01","2028-12-31"]}'; do
+    docker exec -e CORE_PEER_LOCALMSPID=BPJSMSP \
+        -e CORE_PEER_ADDRESS=${PEER_BPJS}:7051 \
+        -e CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/bpjs.bpjs-network.com/users/Admin@bpjs.bpjs-network.com/msp \
+        ${CLI} peer chaincode invoke \
+        -o ${ORDERER}:7050 \
+        -C ${CHANNEL_NAME} -n ${CHAINCODE_NAME} \
+        -c "${ARGS}" \
+        --peerAddresses ${PEER_BPJS}:7051 \
+        --peerAddresses ${PEER_RS}:9051 \
+        --waitForEvent
+done
+
+echo -e "${GREEN}✓ Faskes RS001, PKM001 and practitioners DOC001, DOC002 registered${NC}"
+echo ""
+sleep 2
+
+# Test 3: Create referral from PKM001 to RS001 (BPJS may act for any facility)
+echo -e "${BLUE}Test 3: Create Referral from BPJS Peer${NC}"
+echo "Creating referral REF001..."
+docker exec -e CORE_PEER_LOCALMSPID=BPJSMSP \
+    -e CORE_PEER_ADDRESS=${PEER_BPJS}:7051 \
+    -e CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/bpjs.bpjs-network.com/users/Admin@bpjs.bpjs-network.com/msp \
+    ${CLI} peer chaincode invoke \
+    -o ${ORDERER}:7050 \
+    -C ${CHANNEL_NAME} -n ${CHAINCODE_NAME} \
+    -c '{"Args":["CreateReferral","REF001","P001","Budi Santoso","CARD001","PKM001","RS001","Specialist consultation needed","Complex respiratory condition","DOC002","2024-01-15","2024-02-15","Urgent referral for pulmonologist"]}' \
+    --peerAddresses ${PEER_BPJS}:7051 \
+    --peerAddresses ${PEER_RS}:9051 \
+    --waitForEvent
+
+echo -e "${GREEN}✓ Referral created${NC}"
+echo ""
+sleep 2
+
+# Test 4: Update referral status
+echo -e "${BLUE}Test 4: Update Referral Status${NC}"
+echo "Accepting referral REF001..."
+docker exec -e CORE_PEER_LOCALMSPID=RumahSakitMSP \
+    -e CORE_PEER_ADDRESS=${PEER_RS}:9051 \
+    -e CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/rumahsakit.bpjs-network.com/users/Admin@rumahsakit.bpjs-network.com/msp \
+    ${CLI} peer chaincode invoke \
+    -o ${ORDERER}:7050 \
+    -C ${CHANNEL_NAME} -n ${CHAINCODE_NAME} \
+    -c '{"Args":["UpdateReferralStatus","REF001","accepted","Patient scheduled for consultation tomorrow"]}' \
+    --peerAddresses ${PEER_BPJS}:7051 \
+    --peerAddresses ${PEER_RS}:9051 \
+    --waitForEvent
+
+echo -e "${GREEN}✓ Referral accepted${NC}"
+echo ""
+sleep 2
+
+# Test 5: Record visit from RS peer
+echo -e "${BLUE}Test 5: Record Patient Visit from Rumah Sakit Peer${NC}"
+echo "Recording visit VISIT001 on referral REF001..."
 docker exec -e CORE_PEER_LOCALMSPID=RumahSakitMSP \
     -e CORE_PEER_ADDRESS=${PEER_RS}:9051 \
     -e CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/rumahsakit.bpjs-network.com/users/Admin@rumahsakit.bpjs-network.com/msp \
     ${CLI} peer chaincode invoke \
     -o ${ORDERER}:7050 \
     -C ${CHANNEL_NAME} -n ${CHAINCODE_NAME} \
-    -c '{"Args":["RecordVisit","VISIT001","CARD001","P001","Budi Santoso","RS001","RS Siloam Jakarta","rumahsakit","2024-01-15","outpatient","Influenza","Paracetamol and rest","Dr. Ahmad","DOC001","Regular checkup"]}' \
+    -c '{"Args":["RecordVisit","VISIT001","CARD001","P001","Budi Santoso","RS001","2024-01-15","outpatient","Influenza","Paracetamol and rest","DOC001","Regular checkup","J11.1","","","REF001"]}' \
     --peerAddresses ${PEER_BPJS}:7051 \
     --peerAddresses ${PEER_RS}:9051 \
     --waitForEvent
@@ -73,23 +147,23 @@ echo -e "${GREEN}✓ Visit recorded${NC}"
 echo ""
 sleep 2
 
-# Test 4: Query visits from BPJS peer
-echo -e "${BLUE}Test 4: Query Patient Visits from BPJS Peer (Cross-peer query)${NC}"
+# Test 6: Query visits from BPJS peer
+echo -e "${BLUE}Test 6: Query Patient Visits from BPJS Peer (Cross-peer query)${NC}"
 echo "Querying visits for patient P001..."
 VISITS_RESULT=$(docker exec -e CORE_PEER_LOCALMSPID=BPJSMSP \
     -e CORE_PEER_ADDRESS=${PEER_BPJS}:7051 \
     -e CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/bpjs.bpjs-network.com/users/Admin@bpjs.bpjs-network.com/msp \
     ${CLI} peer chaincode query \
     -C ${CHANNEL_NAME} -n ${CHAINCODE_NAME} \
-    -c '{"Args":["GetPatientVisits","P001"]}')
+    -c '{"Args":["GetPatientVisits","P001","false"]}')
 
 echo "Result: ${VISITS_RESULT}"
 echo -e "${GREEN}✓ Visits queried from different peer${NC}"
 echo ""
 sleep 2
 
-# Test 5: Submit claim from RS peer
-echo -e "${BLUE}Test 5: Submit Insurance Claim from Rumah Sakit Peer${NC}"
+# Test 7: Submit claim from RS peer
+echo -e "${BLUE}Test 7: Submit Insurance Claim from Rumah Sakit Peer${NC}"
 echo "Submitting claim CLAIM001..."
 docker exec -e CORE_PEER_LOCALMSPID=RumahSakitMSP \
     -e CORE_PEER_ADDRESS=${PEER_RS}:9051 \
@@ -97,7 +171,7 @@ docker exec -e CORE_PEER_LOCALMSPID=RumahSakitMSP \
     ${CLI} peer chaincode invoke \
     -o ${ORDERER}:7050 \
     -C ${CHANNEL_NAME} -n ${CHAINCODE_NAME} \
-    -c '{"Args":["SubmitClaim","CLAIM001","P001","Budi Santoso","CARD001","VISIT001","RS001","RS Siloam Jakarta","rawat-jalan","2024-01-15","Influenza","Consultation and medicine","500000","450000"]}' \
+    -c '{"Args":["SubmitClaim","CLAIM001","P001","Budi Santoso","CARD001","VISIT001","RS001","rawat-jalan","2024-01-15","Influenza","Consultation and medicine","500000","450000","","J11.1",""]}' \
     --peerAddresses ${PEER_BPJS}:7051 \
     --peerAddresses ${PEER_RS}:9051 \
     --waitForEvent
@@ -106,8 +180,8 @@ echo -e "${GREEN}✓ Claim submitted${NC}"
 echo ""
 sleep 2
 
-# Test 6: Process claim from BPJS peer
-echo -e "${BLUE}Test 6: Process Claim from BPJS Peer (Approve)${NC}"
+# Test 8: Process claim from BPJS peer
+echo -e "${BLUE}Test 8: Process Claim from BPJS Peer (Approve)${NC}"
 echo "Processing claim CLAIM001..."
 docker exec -e CORE_PEER_LOCALMSPID=BPJSMSP \
     -e CORE_PEER_ADDRESS=${PEER_BPJS}:7051 \
@@ -124,8 +198,8 @@ echo -e "${GREEN}✓ Claim approved${NC}"
 echo ""
 sleep 2
 
-# Test 7: Query claims from RS peer
-echo -e "${BLUE}Test 7: Query Patient Claims from Rumah Sakit Peer${NC}"
+# Test 9: Query claims from RS peer
+echo -e "${BLUE}Test 9: Query Patient Claims from Rumah Sakit Peer${NC}"
 echo "Querying claims for patient P001..."
 CLAIMS_RESULT=$(docker exec -e CORE_PEER_LOCALMSPID=RumahSakitMSP \
     -e CORE_PEER_ADDRESS=${PEER_RS}:9051 \
@@ -139,42 +213,6 @@ echo -e "${GREEN}✓ Claims queried${NC}"
 echo ""
 sleep 2
 
-# Test 8: Create referral from RS peer
-echo -e "${BLUE}Test 8: Create Referral from Rumah Sakit Peer${NC}"
-echo "Creating referral REF001..."
-docker exec -e CORE_PEER_LOCALMSPID=RumahSakitMSP \
-    -e CORE_PEER_ADDRESS=${PEER_RS}:9051 \
-    -e CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/rumahsakit.bpjs-network.com/users/Admin@rumahsakit.bpjs-network.com/msp \
-    ${CLI} peer chaincode invoke \
-    -o ${ORDERER}:7050 \
-    -C ${CHANNEL_NAME} -n ${CHAINCODE_NAME} \
-    -c '{"Args":["CreateReferral","REF001","P001","Budi Santoso","CARD001","PKM001","Puskesmas Kelapa Gading","RS001","RS Siloam Jakarta","Specialist consultation needed","Complex respiratory condition","Dr. Siti","2024-01-15","2024-02-15","Urgent referral for pulmonologist"]}' \
-    --peerAddresses ${PEER_BPJS}:7051 \
-    --peerAddresses ${PEER_RS}:9051 \
-    --waitForEvent
-
-echo -e "${GREEN}✓ Referral created${NC}"
-echo ""
-sleep 2
-
-# Test 9: Update referral status
-echo -e "${BLUE}Test 9: Update Referral Status${NC}"
-echo "Accepting referral REF001..."
-docker exec -e CORE_PEER_LOCALMSPID=RumahSakitMSP \
-    -e CORE_PEER_ADDRESS=${PEER_RS}:9051 \
-    -e CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/rumahsakit.bpjs-network.com/users/Admin@rumahsakit.bpjs-network.com/msp \
-    ${CLI} peer chaincode invoke \
-    -o ${ORDERER}:7050 \
-    -C ${CHANNEL_NAME} -n ${CHAINCODE_NAME} \
-    -c '{"Args":["UpdateReferralStatus","REF001","accepted","Dr. Wong","Patient scheduled for consultation tomorrow"]}' \
-    --peerAddresses ${PEER_BPJS}:7051 \
-    --peerAddresses ${PEER_RS}:9051 \
-    --waitForEvent
-
-echo -e "${GREEN}✓ Referral accepted${NC}"
-echo ""
-sleep 2
-
 # Test 10: Query audit logs
 echo -e "${BLUE}Test 10: Query Audit Logs${NC}"
 echo "Querying audit logs..."